@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	asyncSendSemMu sync.Mutex
+	asyncSendSem   chan struct{} // sized by max_async_sends
+
+	// asyncSends tracks background sends so shutdown can wait for them
+	asyncSends sync.WaitGroup
+)
+
+// tryAcquireAsyncSendSlot reserves one of max_async_sends background slots without
+// waiting. When all are taken it returns false and the caller sends synchronously,
+// which pushes back on the client instead of piling up goroutines.
+func tryAcquireAsyncSendSlot() (func(), bool) {
+	asyncSendSemMu.Lock()
+	limit := max(config.MaxAsyncSends, 1)
+	if cap(asyncSendSem) != limit {
+		asyncSendSem = make(chan struct{}, limit)
+	}
+	sem := asyncSendSem
+	asyncSendSemMu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, true
+	default:
+		return nil, false
+	}
+}
+
+// sendAsync delivers an already accepted message (async_accept) in the background.
+// Graph retries still apply; a final failure can no longer be reported to the client,
+// so it is logged, sent to the webhook and always kept as a dead letter.
+// release frees the slot taken with tryAcquireAsyncSendSlot; logAttrs are added to
+// the result log.
+func sendAsync(parent context.Context, release func(), token, username, mailFrom string, rcptTo []string, pm *parsedMessage, msg string, logAttrs []any) {
+	asyncSends.Add(1)
+	go func() {
+		defer asyncSends.Done()
+		defer release()
+
+		ctx, span := tracer.Start(context.Background(), "smtp.async_send", trace.WithLinks(trace.LinkFromContext(parent)))
+		ctx, cancel := context.WithTimeout(ctx, sendTimeout(pm))
+		defer cancel()
+
+		_, err := sendMessage(ctx, token, username, mailFrom, rcptTo, pm)
+		endSpan(span, err)
+		notifyWebhook(newDeliveryEvent(username, mailFrom, rcptTo, pm, err))
+		if err != nil {
+			logger.Error("Background send via Graph API failed", append([]any{"error", err, "username", username, "mailFrom", mailFrom}, logAttrs...)...)
+			storeDeadLetter(msg, deadLetterInfo{
+				Timestamp: time.Now(), User: username, From: mailFrom, Recipients: rcptTo, Subject: pm.subject, Error: err.Error(),
+			})
+			return
+		}
+		logger.Info("E-mail sent successfully", append([]any{"username", username, "mailFrom", mailFrom, "subject", pm.subject, "async", true}, logAttrs...)...)
+	}()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsyncAccept(t *testing.T) {
+	initTestConfig(false)
+	config.AsyncAccept = true
+	config.DeadLetterDir = filepath.Join(t.TempDir(), "dead")
+	config.DeadLetterMaxFiles = 10
+	config.DeadLetterMaxBytes = 1 << 20
+	TokenCache.Store("async@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("async@example.com")
+
+	// Graph holds the request until the client already got its reply, then rejects it
+	unblock := make(chan struct{})
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"code":"ErrorInvalidRecipients","message":"bad recipient"}}`))
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	if resp := authPlain(client, reader, "async@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Fatalf("expected 235, got: %s", resp)
+	}
+	client.Write([]byte("MAIL FROM:<async@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("DATA\r\n"))
+	readResponse(reader) // 354
+	go client.Write([]byte("Subject: async\r\n\r\nbody\r\n.\r\n"))
+	if resp := readResponse(reader); resp != "250 2.0.0 Ok: queued as graphapi" {
+		t.Fatalf("expected 250 before Graph answered, got: %s", resp)
+	}
+
+	close(unblock)
+	asyncSends.Wait()
+
+	// The failure can't reach the client any more, so it is kept as a dead letter
+	entries, err := os.ReadDir(config.DeadLetterDir)
+	if err != nil {
+		t.Fatalf("reading dead letter dir: %v", err)
+	}
+	var eml []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".eml") {
+			eml = append(eml, e.Name())
+		}
+	}
+	if len(eml) != 1 {
+		t.Fatalf("expected one dead letter, got %v", entries)
+	}
+	data, _ := os.ReadFile(filepath.Join(config.DeadLetterDir, eml[0]))
+	if !strings.Contains(string(data), "Subject: async") {
+		t.Errorf("unexpected dead letter content: %q", data)
+	}
+}
+
+func TestTryAcquireAsyncSendSlot(t *testing.T) {
+	initTestConfig(false)
+	config.MaxAsyncSends = 1
+
+	release, ok := tryAcquireAsyncSendSlot()
+	if !ok {
+		t.Fatal("expected a free slot")
+	}
+	if _, ok := tryAcquireAsyncSendSlot(); ok {
+		t.Error("expected no slot while max_async_sends are in flight")
+	}
+	release()
+	if release, ok := tryAcquireAsyncSendSlot(); !ok {
+		t.Error("expected the slot to be free again")
+	} else {
+		release()
+	}
+}
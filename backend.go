@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// backendDown is set while the last backend probe could not reach Azure AD
+// (reject_when_backend_down); new connections are then refused with 421
+var backendDown atomic.Bool
+
+// maxBackendProbeBackoff caps the probe interval after Azure AD rejected the fallback credentials
+const maxBackendProbeBackoff = time.Hour
+
+// StartBackendProbe checks Azure AD every interval by getting a token for
+// fallback_smtp_user, starting immediately. The goroutine stops with ctx.
+func StartBackendProbe(ctx context.Context, interval time.Duration) {
+	if config.FallbackSMTPuser == "" || config.FallbackSMTPpass == "" {
+		logger.Warn("reject_when_backend_down is enabled but fallback_smtp_user/fallback_smtp_pass are not set, connections are not gated")
+		return
+	}
+	go func() {
+		delay := interval
+		for {
+			rejected, err := probeBackend(ctx)
+			updateBackendState(err)
+			delay = nextBackendProbeDelay(delay, interval, rejected)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+}
+
+// nextBackendProbeDelay doubles the delay (up to maxBackendProbeBackoff) while Azure AD
+// rejects the fallback credentials, and returns to interval once a probe gets past that
+func nextBackendProbeDelay(delay, interval time.Duration, rejected bool) time.Duration {
+	if !rejected {
+		return interval
+	}
+	return max(interval, min(delay*2, maxBackendProbeBackoff))
+}
+
+// probeBackend gets a token through the token cache, so a sign-in only happens when the
+// cached token expired (a refresh token is used when available); a probe that signs in
+// every interval would count towards Entra smart lockout. Credential errors mean the
+// backend is up and are reported as rejected; only transport failures and temporary
+// OAuth errors (5xx, throttling) count as down.
+func probeBackend(ctx context.Context) (rejected bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	_, err = getCachedOAuth2Token(ctx, config.FallbackSMTPuser, config.FallbackSMTPpass)
+	var oauthErr *OAuthError
+	if errors.As(err, &oauthErr) && !oauthErr.Temporary() {
+		logger.Warn("Backend probe: Azure AD rejected fallback credentials, backing off", "error", err, "username", config.FallbackSMTPuser)
+		return true, nil
+	}
+	return false, err
+}
+
+// updateBackendState records a probe result, logging transitions only
+func updateBackendState(err error) {
+	if err != nil {
+		if !backendDown.Swap(true) {
+			logger.Error("Backend unavailable, rejecting new connections", "error", err)
+		}
+		return
+	}
+	if backendDown.Swap(false) {
+		logger.Info("Backend available again, accepting connections")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeBackend(t *testing.T) {
+	initTestConfig(false)
+	status := http.StatusServiceUnavailable
+	var signIns atomic.Int32
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signIns.Add(1)
+		w.WriteHeader(status)
+		switch status {
+		case http.StatusOK:
+			w.Write([]byte(`{"access_token":"tok","expires_in":3600}`))
+		case http.StatusBadRequest:
+			w.Write([]byte(`{"error":"invalid_grant","error_description":"AADSTS50126: Invalid username or password."}`))
+		default:
+			w.Write([]byte(`{"error":"temporarily_unavailable","error_description":"AADSTS90033: service unavailable"}`))
+		}
+	}))
+	defer idp.Close()
+	prevClient := authHTTPClient
+	authHTTPClient = idp.Client()
+	defer func() { authHTTPClient = prevClient }()
+	config.OAuth2Config.TokenEndpoint = idp.URL + "/{tenant}/token"
+	defer backendDown.Store(false)
+	defer TokenCache.Delete(config.FallbackSMTPuser)
+
+	probe := func() bool {
+		rejected, err := probeBackend(context.Background())
+		updateBackendState(err)
+		return rejected
+	}
+	probe()
+	if !backendDown.Load() {
+		t.Error("expected backend down on 503")
+	}
+	// Rejected credentials still prove Azure AD answers
+	status = http.StatusBadRequest
+	if !probe() {
+		t.Error("expected the credential rejection to be reported")
+	}
+	if backendDown.Load() {
+		t.Error("expected backend up when credentials are rejected")
+	}
+	status = http.StatusServiceUnavailable
+	probe()
+	status = http.StatusOK
+	if probe() || backendDown.Load() {
+		t.Error("expected backend up after a successful probe")
+	}
+	// Later probes use the cached token instead of signing in again
+	before := signIns.Load()
+	status = http.StatusServiceUnavailable
+	probe()
+	if signIns.Load() != before || backendDown.Load() {
+		t.Errorf("expected the cached token to be used, got %d new sign-ins", signIns.Load()-before)
+	}
+}
+
+func TestNextBackendProbeDelay(t *testing.T) {
+	interval := time.Minute
+	delay := interval
+	for _, want := range []time.Duration{2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour} {
+		if delay = nextBackendProbeDelay(delay, interval, true); delay != want {
+			t.Errorf("after a rejection: expected %v, got %v", want, delay)
+		}
+	}
+	if delay = nextBackendProbeDelay(delay, interval, false); delay != interval {
+		t.Errorf("expected the interval again once credentials are accepted, got %v", delay)
+	}
+	if got := nextBackendProbeDelay(2*time.Hour, 2*time.Hour, true); got != 2*time.Hour {
+		t.Errorf("expected an interval above the cap to be kept, got %v", got)
+	}
+}
+
+func TestRejectWhenBackendDown(t *testing.T) {
+	initTestConfig(false)
+	config.RejectWhenBackendDown = true
+	backendDown.Store(true)
+	defer backendDown.Store(false)
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	if resp := readResponse(bufio.NewReader(client)); resp != "421 4.3.2 Backend unavailable, try again later" {
+		t.Errorf("expected 421 at connect, got: %s", resp)
+	}
+
+	// Without the option the probe state is ignored
+	config.RejectWhenBackendDown = false
+	client2, server2 := net.Pipe()
+	defer startHandler(client2, server2, handleSMTPConnection)()
+
+	if resp := readResponse(bufio.NewReader(client2)); resp != "220 SMTP Relay Ready" {
+		t.Errorf("expected 220 greeting, got: %s", resp)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -11,30 +14,250 @@ import (
 
 // Config holds the relay and upstream SMTP configuration
 type tConfig struct {
-	Log              string        `yaml:"log"`
-	LogLevel         string        `yaml:"log_level"`
-	ListenAddr       string        `yaml:"listen_addr"`
-	OAuth2Config     tOAuth2Config `yaml:"oauth2_config"`
-	FallbackSMTPuser string        `yaml:"fallback_smtp_user"`
-	FallbackSMTPpass string        `yaml:"fallback_smtp_pass"`
-	AllowAnonymous   bool          `yaml:"allow_anonymous"`
-	SaveToSent       bool          `yaml:"save_to_sent"`
+	Log                     string        `yaml:"log"`
+	LogLevel                string        `yaml:"log_level"`
+	ServiceName             string        `yaml:"service_name"`         // OS service name (default azureSMTPwithOAuth); set per instance to install several side by side
+	ServiceDisplayName      string        `yaml:"service_display_name"` // OS service display name (default: service_name)
+	ListenAddr              string        `yaml:"listen_addr"`
+	ListenNetwork           string        `yaml:"listen_network"`       // tcp (dual-stack), tcp4 or tcp6; empty = inferred from listen_addr
+	ListenBacklog           int           `yaml:"listen_backlog"`       // Accept queue length of the listeners (default 0 = OS default); not on Windows
+	ListenReusePort         bool          `yaml:"listen_reuse_port"`    // Set SO_REUSEPORT on the listeners (default false); not on Windows
+	LMTPListenAddr          string        `yaml:"lmtp_listen_addr"`     // Optional second listener speaking LMTP (RFC 2033); empty = disabled
+	TLSCertFile             string        `yaml:"tls_cert_file"`        // PEM certificate (chain) for STARTTLS; empty = STARTTLS disabled
+	TLSKeyFile              string        `yaml:"tls_key_file"`         // PEM private key for tls_cert_file
+	TLSClientCAFile         string        `yaml:"tls_client_ca_file"`   // PEM CA bundle for client certificates; when set, STARTTLS asks clients for one
+	RequireClientCert       bool          `yaml:"require_client_cert"`  // Fail the TLS handshake without a valid client certificate (default false)
+	ClientCertIdentity      string        `yaml:"client_cert_identity"` // Certificate field matched against user_map client_cert: cn or san (default cn)
+	OAuth2Config            tOAuth2Config `yaml:"oauth2_config"`
+	FallbackSMTPuser        string        `yaml:"fallback_smtp_user"`
+	FallbackSMTPpass        string        `yaml:"fallback_smtp_pass"`
+	AllowAnonymous          bool          `yaml:"allow_anonymous"`
+	LogFallbackUsername     bool          `yaml:"log_fallback_client_username"` // Log a username supplied without password when fallback credentials are used (default false)
+	SaveToSent              bool          `yaml:"save_to_sent"`
+	AttachPlaintextFallback bool          `yaml:"attach_plaintext_fallback"` // Attach a generated message.txt to HTML-only messages
+	RawPassthrough          bool          `yaml:"raw_passthrough"`           // Send the message as received (MIME) instead of rebuilding it from parsed fields (default false)
+	LenientHeaderParsing    bool          `yaml:"lenient_header_parsing"`    // Ignore malformed header lines instead of rejecting the message (default false)
+	RejectEmptyBody         bool          `yaml:"reject_empty_body"`         // Reject messages without body text and attachments (554) (default false)
+	AddAutoSubmitted        bool          `yaml:"add_auto_submitted"`        // Treat every message as Auto-Submitted: auto-generated (suppresses auto-replies) (default false)
+	ForwardListHeaders      bool          `yaml:"forward_list_headers"`      // Forward List-* headers (List-Unsubscribe, List-Id, ...) to recipients (default false)
+	MessageIDDomain         string        `yaml:"message_id_domain"`         // Generate a Message-ID <random@domain> for messages without one (empty = leave to Exchange)
+	RequireTLSForAuth       bool          `yaml:"require_tls_for_auth"`      // Refuse AUTH (538) and hide it from EHLO on cleartext connections
+	AuthMechanisms          []string      `yaml:"auth_mechanisms"`           // AUTH mechanisms advertised and accepted: LOGIN, PLAIN (default both)
+	ResetClearsAuth         bool          `yaml:"reset_clears_auth"`         // RSET also drops authentication (next message must re-authenticate)
+	EnableXStatus           bool          `yaml:"enable_xstatus"`            // Non-standard XSTATUS command for authenticated clients (default false)
+	AddReceivedHeader       bool          `yaml:"add_received_header"`       // Add an X-Received trace header documenting the relay hop
+	SetSenderOnBehalf       bool          `yaml:"set_sender_on_behalf"`      // Set Graph sender to the authenticated mailbox when from differs (Send on Behalf)
+	UseMeEndpoint           bool          `yaml:"use_me_endpoint"`           // Send via /me/sendMail (the token's own mailbox) instead of /users/{sender}/sendMail
+	CompressRequests        bool          `yaml:"compress_requests"`         // gzip Graph request bodies larger than compressRequestThreshold
+	UserAgent               string        `yaml:"user_agent"`                // User-Agent of outbound Graph, token and webhook requests (default azureSMTPwithOAuth/<version>)
+
+	// Observability
+	OtelEndpoint       string `yaml:"otel_endpoint"`         // OTLP/HTTP collector URL for tracing, e.g. http://localhost:4318 (empty = disabled)
+	WebhookURL         string `yaml:"webhook_url"`           // POST a JSON delivery report here after each send attempt (empty = disabled)
+	DeadLetterDir      string `yaml:"dead_letter_dir"`       // Store messages that failed to send here as .eml + .json (empty = disabled)
+	DeadLetterMaxFiles int    `yaml:"dead_letter_max_files"` // Max stored messages (default 1000)
+	DeadLetterMaxBytes int64  `yaml:"dead_letter_max_bytes"` // Max total size of stored messages (default 500MB)
+	DebugGraphIO       bool   `yaml:"debug_graph_io"`        // Log Graph request/response bodies at debug level (attachment content elided)
+	GeoIPDB            string `yaml:"geoip_db"`              // MaxMind .mmdb (Country/City or ASN) for connection log enrichment (empty = disabled)
+
+	// Relay policy
+	AllowedRecipientDomains     []string `yaml:"allowed_recipient_domains"`      // Restrict RCPT TO to these domains (empty = any)
+	AllowDuplicateRecipients    bool     `yaml:"allow_duplicate_recipients"`     // Keep repeated RCPT TO addresses instead of ignoring them (default false)
+	RecipientOverflow           string   `yaml:"recipient_overflow"`             // RCPT TO beyond the recipient limit: reject_extra (452) or reject_transaction (550, RSET required) (default reject_extra)
+	StripHeaders                []string `yaml:"strip_headers"`                  // Header names never sent to Graph (case-insensitive)
+	DeriveRecipientsFromHeaders bool     `yaml:"derive_recipients_from_headers"` // Without RCPT TO, deliver to the To/Cc/Bcc header addresses
+	TrustedMTACIDRs             []string `yaml:"trusted_mta_cidrs"`              // Clients whose MAIL FROM AUTH= identity is used as sender (CIDRs or IPs)
+	TrustedProxies              []string `yaml:"trusted_proxies"`                // Proxies allowed to pass the client address with XCLIENT (CIDRs or IPs)
+	NullSender                  string   `yaml:"null_sender"`                    // MAIL FROM:<> handling: reject or substitute (the authenticated user) (default reject)
+	SuccessMessage              string   `yaml:"success_message"`                // Text of the 250 reply after DATA, placeholders {id} and {user} (default "Ok: queued as {id}")
+
+	// Per-user settings keyed by SMTP username (case-insensitive)
+	UserMap map[string]tUserSettings `yaml:"user_map"`
 
 	// Stability configuration (all have sensible defaults)
-	MaxMessageSize    int64  `yaml:"max_message_size"`    // Max email size in bytes (default 25MB)
-	MaxConnections    int    `yaml:"max_connections"`     // Max concurrent connections (default 100)
-	ConnectionTimeout int    `yaml:"connection_timeout"`  // Connection timeout in seconds (default 300)
-	StrictAttachments bool   `yaml:"strict_attachments"`  // Fail on attachment decode error (default false)
-	RetryAttempts     int    `yaml:"retry_attempts"`      // Graph API retry attempts (default 3)
-	RetryInitialDelay int `yaml:"retry_initial_delay"` // Initial retry delay in ms (default 500)
+	MaxMessageSize              int64    `yaml:"max_message_size"`                 // Max email size in bytes (default 25MB)
+	MaxGraphPayloadSize         int64    `yaml:"max_graph_payload_size"`           // Max Graph request size after base64 re-encoding in bytes (default 35MB)
+	MaxDataLineLength           int      `yaml:"max_data_line_length"`             // Max DATA line length in bytes incl. CRLF (default 0 = unlimited, RFC 5321 = 1000)
+	MaxHeaderBytes              int64    `yaml:"max_header_bytes"`                 // Max size of the header block in bytes (default 0 = unlimited)
+	MaxMultipartDepth           int      `yaml:"max_multipart_depth"`              // Max nesting of multipart parts, deeper parts are ignored (default 10)
+	DataLineOverflow            string   `yaml:"data_line_overflow"`               // Over-long DATA line handling: reject or wrap (default reject)
+	MaxInternetMessageHeaders   int      `yaml:"max_internet_message_headers"`     // Max headers in Graph internetMessageHeaders, the excess is dropped (default 5)
+	MaxForwardedHeaders         int      `yaml:"max_forwarded_headers"`            // Max headers forwarded to Graph incl. List-* (default 0 = unlimited)
+	MaxForwardedHeaderBytes     int      `yaml:"max_forwarded_header_bytes"`       // Max total size of forwarded header names and values (default 0 = unlimited)
+	ForwardedHeaderOverflow     string   `yaml:"forwarded_header_overflow"`        // Over max_forwarded_headers/_bytes: truncate or reject (default truncate)
+	MaxConnections              int      `yaml:"max_connections"`                  // Max concurrent connections (default 100)
+	MaxConnectionsPerUser       int      `yaml:"max_connections_per_user"`         // Max concurrent authenticated connections per user (default 0 = unlimited)
+	MaxMessagesPerConnection    int      `yaml:"max_messages_per_connection"`      // Max delivered messages per connection before 421 (default 0 = unlimited)
+	MaxMessagesPerUserPerMinute int      `yaml:"max_messages_per_user_per_minute"` // Max messages per user in any 60s window (default 0 = unlimited)
+	MaxMessagesPerUserPerHour   int      `yaml:"max_messages_per_user_per_hour"`   // Max messages per user in any 60min window (default 0 = unlimited)
+	DedupWindowSeconds          int      `yaml:"dedup_window_seconds"`             // Acknowledge identical messages resubmitted within this window without sending them (default 0 = disabled)
+	ConnectionTimeout           int      `yaml:"connection_timeout"`               // Connection timeout in seconds (default 300)
+	ReadTimeoutSeconds          int      `yaml:"read_timeout_seconds"`             // Per-command (and per DATA line) read timeout in seconds (default 60)
+	DataTotalTimeoutSeconds     int      `yaml:"data_total_timeout_seconds"`       // Max time to receive a whole DATA body in seconds (default 0 = only connection_timeout)
+	SendTimeoutSeconds          int      `yaml:"send_timeout_seconds"`             // Deadline for token lookup + Graph send per message, raised for large attachments (default 60)
+	GraphTimeoutSeconds         int      `yaml:"graph_timeout_seconds"`            // Timeout of a single Graph HTTP request (each retry attempt) (default 60)
+	MaxProcessingTimeSeconds    int      `yaml:"max_processing_time_seconds"`      // Hard cap on token lookup + Graph send per message, retries stop when spent (default 0 = send_timeout_seconds)
+	StrictAttachments           bool     `yaml:"strict_attachments"`               // Fail on attachment decode error (default false)
+	AttachmentDecodeFailure     string   `yaml:"attachment_decode_failure"`        // Undecodable attachment: fail, skip or placeholder (default skip, fail with strict_attachments)
+	SniffAttachmentContentType  *bool    `yaml:"sniff_attachment_content_type"`    // Detect the type of octet-stream/untyped attachments from their content (default true)
+	BlockedAttachmentExtensions []string `yaml:"blocked_attachment_extensions"`    // Reject messages with attachments ending in these extensions, e.g. [".exe", ".js"]
+	StripDanglingCIDImages      bool     `yaml:"strip_dangling_cid_images"`        // Remove <img> tags whose cid: has no inline attachment (default false)
+	RetryAttempts               int      `yaml:"retry_attempts"`                   // Graph API retry attempts (default 3)
+	RetryInitialDelay           int      `yaml:"retry_initial_delay"`              // Initial retry delay in ms (default 500)
+	RetryJitter                 string   `yaml:"retry_jitter"`                     // Jitter added to retry backoff: none, equal or full (default equal)
+	TokenRefreshSkewSeconds     int      `yaml:"token_refresh_skew_seconds"`       // Refresh cached tokens this many seconds before expiry (default 60)
+	TokenMaxCacheAge            int      `yaml:"token_max_cache_age"`              // Max seconds a cached token is reused regardless of its expiry (default 0 = until expiry)
+	MaxTokenRequestsPerTenant   int      `yaml:"max_token_requests_per_tenant"`    // Max concurrent token endpoint requests per tenant (default 4)
+	MaxConcurrentGraphRequests  int      `yaml:"max_concurrent_graph_requests"`    // Max Graph API sends in flight, further sends wait (default 20)
+	AsyncAccept                 bool     `yaml:"async_accept"`                     // Reply 250 after token validation and send via Graph in the background (default false)
+	MaxAsyncSends               int      `yaml:"max_async_sends"`                  // Max background sends in flight with async_accept, further messages are sent synchronously (default 100)
+	PrefetchTokenOnStart        bool     `yaml:"prefetch_token_on_start"`          // Fetch a token for fallback_smtp_user at startup (default false)
+	RejectWhenBackendDown       bool     `yaml:"reject_when_backend_down"`         // Answer new connections with 421 while the backend probe fails (default false)
+	BackendProbeIntervalSeconds int      `yaml:"backend_probe_interval_seconds"`   // Backend probe interval for reject_when_backend_down (default 60)
+	ConnectivityCheckInterval   int      `yaml:"connectivity_check_interval"`      // Seconds between Graph connectivity checks as fallback_smtp_user, logged (default 0 = disabled)
+}
+
+// tUserSettings holds per-user overrides from user_map
+type tUserSettings struct {
+	MaxMessageSize int64  `yaml:"max_message_size"` // Overrides max_message_size for this user (0 = global limit)
+	ClientCert     string `yaml:"client_cert"`      // TLS client certificate identity (CN or SAN) that authenticates as this user
+	Password       string `yaml:"password"`         // Password for the token of client certificate sessions (default fallback_smtp_pass for fallback_smtp_user)
 }
 
 // OAuth2Config holds OAuth2 client configuration
 type tOAuth2Config struct {
-	ClientID     string   `yaml:"client_id"`
-	ClientSecret string   `yaml:"client_secret"`
-	TenantID     string   `yaml:"tenant_id"`
-	Scopes       []string `yaml:"scopes"`
+	ClientID      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret"`
+	TenantID      string   `yaml:"tenant_id"`
+	Scopes        []string `yaml:"scopes"`
+	TokenEndpoint string   `yaml:"token_endpoint"` // {tenant} is replaced by tenant_id (default Azure AD v2.0 endpoint)
+}
+
+// configEnvOverrides lists the config fields taken from environment variables (logged at startup)
+var configEnvOverrides []string
+
+// envOverrides maps environment variables to the config fields they override.
+// Values set in the environment take precedence over config.yaml:
+//
+//	AZSMTP_CLIENT_ID      -> oauth2_config.client_id
+//	AZSMTP_CLIENT_SECRET  -> oauth2_config.client_secret
+//	AZSMTP_TENANT_ID      -> oauth2_config.tenant_id
+//	AZSMTP_FALLBACK_USER  -> fallback_smtp_user
+//	AZSMTP_FALLBACK_PASS  -> fallback_smtp_pass
+var envOverrides = []struct {
+	env   string
+	field string
+	dest  func(c *tConfig) *string
+}{
+	{"AZSMTP_CLIENT_ID", "oauth2_config.client_id", func(c *tConfig) *string { return &c.OAuth2Config.ClientID }},
+	{"AZSMTP_CLIENT_SECRET", "oauth2_config.client_secret", func(c *tConfig) *string { return &c.OAuth2Config.ClientSecret }},
+	{"AZSMTP_TENANT_ID", "oauth2_config.tenant_id", func(c *tConfig) *string { return &c.OAuth2Config.TenantID }},
+	{"AZSMTP_FALLBACK_USER", "fallback_smtp_user", func(c *tConfig) *string { return &c.FallbackSMTPuser }},
+	{"AZSMTP_FALLBACK_PASS", "fallback_smtp_pass", func(c *tConfig) *string { return &c.FallbackSMTPpass }},
+}
+
+// applyEnvOverrides overlays set environment variables onto the config
+// and returns the names of the fields that were overridden.
+func applyEnvOverrides(c *tConfig) []string {
+	var applied []string
+	for _, o := range envOverrides {
+		if v, ok := os.LookupEnv(o.env); ok && v != "" {
+			*o.dest(c) = v
+			applied = append(applied, o.field)
+		}
+	}
+	return applied
+}
+
+// configSecretRefs lists the secret fields resolved from file:/env: references (logged at startup)
+var configSecretRefs []string
+
+// secretRefFields are the config fields that accept a file:/path or env:VAR reference
+var secretRefFields = []struct {
+	field string
+	dest  func(c *tConfig) *string
+}{
+	{"oauth2_config.client_secret", func(c *tConfig) *string { return &c.OAuth2Config.ClientSecret }},
+	{"fallback_smtp_pass", func(c *tConfig) *string { return &c.FallbackSMTPpass }},
+}
+
+// resolveSecretRefs replaces secret values (secretRefFields and user_map passwords)
+// of the form file:/path (file content, a trailing newline removed; relative paths
+// are resolved against the executable's directory) or env:VAR (environment variable)
+// with the referenced secret, and returns the names of the resolved fields. A missing
+// or empty source is an error.
+func resolveSecretRefs(c *tConfig) ([]string, error) {
+	var resolved []string
+	resolve := func(field string, dest *string) error {
+		ok, err := resolveSecretRef(field, dest)
+		if ok {
+			resolved = append(resolved, field)
+		}
+		return err
+	}
+	for _, f := range secretRefFields {
+		if err := resolve(f.field, f.dest(c)); err != nil {
+			return nil, err
+		}
+	}
+	for user, settings := range c.UserMap {
+		if err := resolve("user_map."+user+".password", &settings.Password); err != nil {
+			return nil, err
+		}
+		c.UserMap[user] = settings
+	}
+	return resolved, nil
+}
+
+// resolveSecretRef resolves a single file:/env: reference in place and reports
+// whether dest was a reference
+func resolveSecretRef(field string, dest *string) (bool, error) {
+	switch {
+	case strings.HasPrefix(*dest, "file:"):
+		path := strings.TrimPrefix(*dest, "file:")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(os.Args[0]), path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return true, fmt.Errorf("%s: failed to read secret file: %w", field, err)
+		}
+		secret := strings.TrimRight(string(data), "\r\n")
+		if secret == "" {
+			return true, fmt.Errorf("%s: secret file %q is empty", field, path)
+		}
+		*dest = secret
+	case strings.HasPrefix(*dest, "env:"):
+		name := strings.TrimPrefix(*dest, "env:")
+		secret := os.Getenv(name)
+		if secret == "" {
+			return true, fmt.Errorf("%s: environment variable %q is not set", field, name)
+		}
+		*dest = secret
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// redactedConfig returns a copy of c with secrets replaced by "***" (for -print-config)
+func redactedConfig(c *tConfig) tConfig {
+	redacted := *c
+	for _, secret := range []*string{&redacted.OAuth2Config.ClientSecret, &redacted.FallbackSMTPpass} {
+		if *secret != "" {
+			*secret = "***"
+		}
+	}
+	if c.UserMap != nil {
+		redacted.UserMap = make(map[string]tUserSettings, len(c.UserMap))
+		for user, settings := range c.UserMap {
+			if settings.Password != "" {
+				settings.Password = "***"
+			}
+			redacted.UserMap[user] = settings
+		}
+	}
+	return redacted
 }
 
 func loadConfig() error {
@@ -47,29 +270,302 @@ func loadConfig() error {
 	if err != nil {
 		return err
 	}
+	if configSecretRefs, err = resolveSecretRefs(config); err != nil {
+		return err
+	}
 	decryptConfigStrings()
+	configEnvOverrides = applyEnvOverrides(config)
+
+	if config.ServiceName == "" {
+		config.ServiceName = "azureSMTPwithOAuth"
+	}
+	if config.ServiceDisplayName == "" {
+		config.ServiceDisplayName = config.ServiceName
+	}
 
 	// Set sensible defaults for stability configuration
+	if config.MaxGraphPayloadSize <= 0 {
+		config.MaxGraphPayloadSize = defaultMaxGraphPayloadSize
+	}
 	if config.MaxMessageSize == 0 {
 		config.MaxMessageSize = 25 * 1024 * 1024 // 25MB (Graph API limit)
 	}
+	if config.MaxHeaderBytes < 0 {
+		return fmt.Errorf("invalid max_header_bytes %d (must not be negative)", config.MaxHeaderBytes)
+	}
+	if config.MaxMultipartDepth < 0 {
+		return fmt.Errorf("invalid max_multipart_depth %d (must be positive)", config.MaxMultipartDepth)
+	}
+	if config.MaxMultipartDepth == 0 {
+		config.MaxMultipartDepth = defaultMaxMultipartDepth
+	}
 	if config.MaxConnections == 0 {
 		config.MaxConnections = 100
 	}
 	if config.ConnectionTimeout == 0 {
 		config.ConnectionTimeout = 300 // 5 minutes
 	}
+	if config.ReadTimeoutSeconds == 0 {
+		config.ReadTimeoutSeconds = 60
+	}
+	if config.ReadTimeoutSeconds < 0 {
+		return fmt.Errorf("invalid read_timeout_seconds %d (must be positive)", config.ReadTimeoutSeconds)
+	}
+	if config.DataTotalTimeoutSeconds < 0 {
+		return fmt.Errorf("invalid data_total_timeout_seconds %d (must be positive)", config.DataTotalTimeoutSeconds)
+	}
+	if config.SendTimeoutSeconds == 0 {
+		config.SendTimeoutSeconds = 60
+	}
+	if config.SendTimeoutSeconds < 0 {
+		return fmt.Errorf("invalid send_timeout_seconds %d (must be positive)", config.SendTimeoutSeconds)
+	}
+	if config.GraphTimeoutSeconds == 0 {
+		config.GraphTimeoutSeconds = 60
+	}
+	if config.GraphTimeoutSeconds < 0 {
+		return fmt.Errorf("invalid graph_timeout_seconds %d (must be positive)", config.GraphTimeoutSeconds)
+	}
+	if config.DedupWindowSeconds < 0 {
+		return fmt.Errorf("invalid dedup_window_seconds %d (must not be negative)", config.DedupWindowSeconds)
+	}
+	if config.MaxProcessingTimeSeconds < 0 {
+		return fmt.Errorf("invalid max_processing_time_seconds %d (must not be negative)", config.MaxProcessingTimeSeconds)
+	}
 	if config.RetryAttempts < 1 {
 		config.RetryAttempts = 3
 	}
 	if config.RetryInitialDelay == 0 {
 		config.RetryInitialDelay = 500 // 500ms
 	}
+	if config.MaxConcurrentGraphRequests < 1 {
+		config.MaxConcurrentGraphRequests = 20 // 2x graphHTTPClient MaxIdleConnsPerHost
+	}
+	if config.ConnectivityCheckInterval < 0 {
+		return fmt.Errorf("invalid connectivity_check_interval %d (must not be negative)", config.ConnectivityCheckInterval)
+	}
+	if config.BackendProbeIntervalSeconds < 1 {
+		config.BackendProbeIntervalSeconds = 60
+	}
+	if config.MaxAsyncSends < 1 {
+		config.MaxAsyncSends = 100
+	}
+	if config.MaxTokenRequestsPerTenant < 1 {
+		config.MaxTokenRequestsPerTenant = 4
+	}
+	if config.RetryJitter == "" {
+		config.RetryJitter = "equal"
+	}
+	switch config.RetryJitter {
+	case "none", "equal", "full":
+	default:
+		return fmt.Errorf("invalid retry_jitter %q (expected none, equal or full)", config.RetryJitter)
+	}
+	if config.TokenRefreshSkewSeconds == 0 {
+		config.TokenRefreshSkewSeconds = 60
+	}
+	if config.TokenRefreshSkewSeconds < 0 {
+		return fmt.Errorf("invalid token_refresh_skew_seconds %d (must be positive)", config.TokenRefreshSkewSeconds)
+	}
+	if config.TokenMaxCacheAge < 0 {
+		return fmt.Errorf("invalid token_max_cache_age %d (must not be negative)", config.TokenMaxCacheAge)
+	}
+
+	if config.SniffAttachmentContentType == nil {
+		enabled := true
+		config.SniffAttachmentContentType = &enabled
+	}
+	if config.AttachmentDecodeFailure == "" {
+		config.AttachmentDecodeFailure = attachmentDecodeFailureMode()
+	}
+	switch config.AttachmentDecodeFailure {
+	case "fail", "skip", "placeholder":
+	default:
+		return fmt.Errorf("invalid attachment_decode_failure %q (expected fail, skip or placeholder)", config.AttachmentDecodeFailure)
+	}
+
+	if len(config.AuthMechanisms) == 0 {
+		config.AuthMechanisms = slices.Clone(supportedAuthMechanisms)
+	}
+	for i, mech := range config.AuthMechanisms {
+		config.AuthMechanisms[i] = strings.ToUpper(strings.TrimSpace(mech))
+		if !slices.Contains(supportedAuthMechanisms, config.AuthMechanisms[i]) {
+			return fmt.Errorf("invalid auth_mechanisms entry %q (expected %s)", mech, strings.Join(supportedAuthMechanisms, " or "))
+		}
+	}
+
+	if config.RecipientOverflow == "" {
+		config.RecipientOverflow = "reject_extra"
+	}
+	if config.RecipientOverflow != "reject_extra" && config.RecipientOverflow != "reject_transaction" {
+		return fmt.Errorf("invalid recipient_overflow %q (expected reject_extra or reject_transaction)", config.RecipientOverflow)
+	}
+
+	if config.NullSender == "" {
+		config.NullSender = "reject"
+	}
+	if config.NullSender != "reject" && config.NullSender != "substitute" {
+		return fmt.Errorf("invalid null_sender %q (expected reject or substitute)", config.NullSender)
+	}
+
+	config.MessageIDDomain = strings.TrimSpace(config.MessageIDDomain)
+	if config.MessageIDDomain != "" && !isValidMessageIDDomain(config.MessageIDDomain) {
+		return fmt.Errorf("invalid message_id_domain %q (expected a domain name such as relay.example.com)", config.MessageIDDomain)
+	}
+
+	if config.SuccessMessage == "" {
+		config.SuccessMessage = defaultSuccessMessage
+	}
+	if err := validateSuccessMessage(config.SuccessMessage); err != nil {
+		return fmt.Errorf("invalid success_message %q: %w", config.SuccessMessage, err)
+	}
+
+	if config.MaxInternetMessageHeaders == 0 {
+		config.MaxInternetMessageHeaders = defaultMaxInternetMessageHeaders
+	}
+	if config.MaxInternetMessageHeaders < 0 {
+		return fmt.Errorf("invalid max_internet_message_headers %d (must be positive)", config.MaxInternetMessageHeaders)
+	}
+	if config.MaxForwardedHeaders < 0 {
+		return fmt.Errorf("invalid max_forwarded_headers %d (must not be negative)", config.MaxForwardedHeaders)
+	}
+	if config.MaxForwardedHeaderBytes < 0 {
+		return fmt.Errorf("invalid max_forwarded_header_bytes %d (must not be negative)", config.MaxForwardedHeaderBytes)
+	}
+	if config.ForwardedHeaderOverflow == "" {
+		config.ForwardedHeaderOverflow = "truncate"
+	}
+	if config.ForwardedHeaderOverflow != "truncate" && config.ForwardedHeaderOverflow != "reject" {
+		return fmt.Errorf("invalid forwarded_header_overflow %q (expected truncate or reject)", config.ForwardedHeaderOverflow)
+	}
+
+	if config.DataLineOverflow == "" {
+		config.DataLineOverflow = "reject"
+	}
+	if config.DataLineOverflow != "reject" && config.DataLineOverflow != "wrap" {
+		return fmt.Errorf("invalid data_line_overflow %q (expected reject or wrap)", config.DataLineOverflow)
+	}
+
+	if config.OtelEndpoint != "" {
+		if u, err := url.Parse(config.OtelEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid otel_endpoint %q (expected http(s)://host:port)", config.OtelEndpoint)
+		}
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+	if config.TLSClientCAFile != "" && config.TLSCertFile == "" {
+		return fmt.Errorf("tls_client_ca_file requires tls_cert_file and tls_key_file")
+	}
+	if config.RequireClientCert && config.TLSClientCAFile == "" {
+		return fmt.Errorf("require_client_cert requires tls_client_ca_file")
+	}
+	config.ClientCertIdentity = strings.ToLower(strings.TrimSpace(config.ClientCertIdentity))
+	switch config.ClientCertIdentity {
+	case "":
+		config.ClientCertIdentity = "cn"
+	case "cn", "san":
+	default:
+		return fmt.Errorf("invalid client_cert_identity %q (expected cn or san)", config.ClientCertIdentity)
+	}
+	for _, f := range []*string{&config.TLSCertFile, &config.TLSKeyFile, &config.TLSClientCAFile} {
+		if *f != "" && !filepath.IsAbs(*f) {
+			*f = filepath.Join(filepath.Dir(os.Args[0]), *f)
+		}
+	}
+
+	if config.OAuth2Config.TokenEndpoint != "" {
+		if u, err := url.Parse(config.OAuth2Config.TokenEndpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid token_endpoint %q (expected https URL)", config.OAuth2Config.TokenEndpoint)
+		}
+	}
+
+	if config.DeadLetterDir != "" {
+		if !filepath.IsAbs(config.DeadLetterDir) {
+			config.DeadLetterDir = filepath.Join(filepath.Dir(os.Args[0]), config.DeadLetterDir)
+		}
+		if config.DeadLetterMaxFiles < 1 {
+			config.DeadLetterMaxFiles = 1000
+		}
+		if config.DeadLetterMaxBytes < 1 {
+			config.DeadLetterMaxBytes = 500 * 1024 * 1024 // 500MB
+		}
+	}
+
+	if config.GeoIPDB != "" && !filepath.IsAbs(config.GeoIPDB) {
+		config.GeoIPDB = filepath.Join(filepath.Dir(os.Args[0]), config.GeoIPDB)
+	}
+
+	if config.WebhookURL != "" {
+		if u, err := url.Parse(config.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook_url %q (expected http(s) URL)", config.WebhookURL)
+		}
+	}
+
+	for _, cidr := range config.TrustedMTACIDRs {
+		if _, err := parsePrefix(cidr); err != nil {
+			return fmt.Errorf("invalid trusted_mta_cidrs entry %q: %w", cidr, err)
+		}
+	}
+
+	for _, cidr := range config.TrustedProxies {
+		if _, err := parsePrefix(cidr); err != nil {
+			return fmt.Errorf("invalid trusted_proxies entry %q: %w", cidr, err)
+		}
+	}
+
+	if config.Log == logEventLog && !eventLogSupported {
+		return fmt.Errorf("invalid log %q (the Windows Event Log is only available on Windows)", config.Log)
+	}
+
+	if config.ListenBacklog < 0 {
+		return fmt.Errorf("invalid listen_backlog %d (must be positive)", config.ListenBacklog)
+	}
+	switch config.ListenNetwork {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("invalid listen_network %q (expected tcp, tcp4 or tcp6)", config.ListenNetwork)
+	}
+
+	// Normalize user_map keys for case-insensitive username lookup
+	if len(config.UserMap) > 0 {
+		userMap := make(map[string]tUserSettings, len(config.UserMap))
+		for user, settings := range config.UserMap {
+			if settings.MaxMessageSize < 0 {
+				return fmt.Errorf("invalid max_message_size %d for user_map entry %q", settings.MaxMessageSize, user)
+			}
+			user = strings.ToLower(strings.TrimSpace(user))
+			if settings.ClientCert != "" && settings.Password == "" {
+				if !strings.EqualFold(user, config.FallbackSMTPuser) || config.FallbackSMTPpass == "" {
+					return fmt.Errorf("user_map entry %q: client_cert requires password", user)
+				}
+				settings.Password = config.FallbackSMTPpass
+			}
+			userMap[user] = settings
+		}
+		config.UserMap = userMap
+	}
+
+	// Normalize recipient domain allowlist for case-insensitive matching
+	for i, d := range config.AllowedRecipientDomains {
+		config.AllowedRecipientDomains[i] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@"))
+	}
+	// Normalize blocked extensions to ".ext" for case-insensitive suffix matching
+	for i, ext := range config.BlockedAttachmentExtensions {
+		normalized := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if normalized == "" {
+			return fmt.Errorf("invalid blocked_attachment_extensions entry %q", ext)
+		}
+		config.BlockedAttachmentExtensions[i] = "." + normalized
+	}
 	return nil
 }
 
+// slogSetup creates the logger. With log: eventlog it logs to stdout until main
+// switches to the Event Log once the service exists (useEventLog).
 func slogSetup() (err error) {
-	if config.Log != "" {
+	if config.Log != "" && config.Log != logEventLog {
 		logPath := config.Log
 		if filepath.Base(config.Log) == config.Log {
 			logPath = filepath.Join(filepath.Dir(os.Args[0]), config.Log)
@@ -84,22 +580,23 @@ func slogSetup() (err error) {
 	if config.LogLevel == "" {
 		config.LogLevel = "info"
 	}
-	var level slog.Level
+
+	logger = slog.New(slog.NewTextHandler(logFile, &slog.HandlerOptions{
+		Level: logLevel(),
+	}))
+	return nil
+}
+
+// logLevel returns the slog level of log_level (info when unknown)
+func logLevel() slog.Level {
 	switch strings.ToLower(config.LogLevel) {
 	case "debug":
-		level = slog.LevelDebug
-	case "info":
-		level = slog.LevelInfo
+		return slog.LevelDebug
 	case "warn", "warning":
-		level = slog.LevelWarn
+		return slog.LevelWarn
 	case "error":
-		level = slog.LevelError
+		return slog.LevelError
 	default:
-		level = slog.LevelInfo
+		return slog.LevelInfo
 	}
-
-	logger = slog.New(slog.NewTextHandler(logFile, &slog.HandlerOptions{
-		Level: level,
-	}))
-	return nil
 }
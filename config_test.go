@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	t.Setenv("AZSMTP_CLIENT_SECRET", "env-secret")
+	t.Setenv("AZSMTP_FALLBACK_PASS", "env-pass")
+	t.Setenv("AZSMTP_TENANT_ID", "")
+
+	c := &tConfig{
+		FallbackSMTPpass: "file-pass",
+		OAuth2Config: tOAuth2Config{
+			ClientID:     "file-client",
+			ClientSecret: "file-secret",
+			TenantID:     "file-tenant",
+		},
+	}
+	applied := applyEnvOverrides(c)
+
+	if c.OAuth2Config.ClientSecret != "env-secret" {
+		t.Errorf("expected client_secret from environment, got '%s'", c.OAuth2Config.ClientSecret)
+	}
+	if c.FallbackSMTPpass != "env-pass" {
+		t.Errorf("expected fallback_smtp_pass from environment, got '%s'", c.FallbackSMTPpass)
+	}
+	if c.OAuth2Config.ClientID != "file-client" || c.OAuth2Config.TenantID != "file-tenant" {
+		t.Errorf("expected unset/empty variables to keep file values, got client_id '%s' tenant_id '%s'", c.OAuth2Config.ClientID, c.OAuth2Config.TenantID)
+	}
+	want := []string{"oauth2_config.client_secret", "fallback_smtp_pass"}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("expected applied fields %v, got %v", want, applied)
+	}
+}
+
+func TestRedactedConfig(t *testing.T) {
+	c := &tConfig{
+		FallbackSMTPuser: "fallback@example.com",
+		FallbackSMTPpass: "fallback-pass",
+		MaxConnections:   100,
+		OAuth2Config: tOAuth2Config{
+			ClientID:     "client-id",
+			ClientSecret: "client-secret",
+		},
+		UserMap: map[string]tUserSettings{"printer@example.com": {ClientCert: "printer01", Password: "printer-pass"}},
+	}
+	redacted := redactedConfig(c)
+	if redacted.UserMap["printer@example.com"].Password != "***" || c.UserMap["printer@example.com"].Password != "printer-pass" {
+		t.Errorf("expected user_map password redacted in the copy only, got %+v / %+v", redacted.UserMap, c.UserMap)
+	}
+
+	if redacted.OAuth2Config.ClientSecret != "***" || redacted.FallbackSMTPpass != "***" {
+		t.Errorf("expected secrets redacted, got client_secret '%s' fallback_smtp_pass '%s'", redacted.OAuth2Config.ClientSecret, redacted.FallbackSMTPpass)
+	}
+	if redacted.OAuth2Config.ClientID != "client-id" || redacted.FallbackSMTPuser != "fallback@example.com" || redacted.MaxConnections != 100 {
+		t.Error("expected non-secret fields to be kept")
+	}
+	if c.OAuth2Config.ClientSecret != "client-secret" || c.FallbackSMTPpass != "fallback-pass" {
+		t.Error("redactedConfig must not modify the running config")
+	}
+
+	// Unset secrets stay empty so the output shows they are not configured
+	if r := redactedConfig(&tConfig{}); r.FallbackSMTPpass != "" {
+		t.Errorf("expected empty secret to stay empty, got '%s'", r.FallbackSMTPpass)
+	}
+}
+
+func TestResolveSecretRefs_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client_secret")
+	if err := os.WriteFile(path, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := &tConfig{
+		FallbackSMTPpass: "plain-pass",
+		OAuth2Config:     tOAuth2Config{ClientSecret: "file:" + path},
+	}
+	resolved, err := resolveSecretRefs(c)
+	if err != nil {
+		t.Fatalf("resolveSecretRefs failed: %v", err)
+	}
+	if c.OAuth2Config.ClientSecret != "file-secret" {
+		t.Errorf("expected client_secret from file without trailing newline, got '%s'", c.OAuth2Config.ClientSecret)
+	}
+	if c.FallbackSMTPpass != "plain-pass" {
+		t.Errorf("expected plain value kept, got '%s'", c.FallbackSMTPpass)
+	}
+	if want := []string{"oauth2_config.client_secret"}; !reflect.DeepEqual(resolved, want) {
+		t.Errorf("expected resolved fields %v, got %v", want, resolved)
+	}
+
+	c = &tConfig{FallbackSMTPpass: "file:" + filepath.Join(t.TempDir(), "missing")}
+	if _, err := resolveSecretRefs(c); err == nil || !strings.Contains(err.Error(), "fallback_smtp_pass") {
+		t.Errorf("expected an error naming the field for a missing file, got %v", err)
+	}
+}
+
+func TestResolveSecretRefs_Env(t *testing.T) {
+	t.Setenv("TEST_FALLBACK_PASS", "env-pass")
+	c := &tConfig{FallbackSMTPpass: "env:TEST_FALLBACK_PASS"}
+	resolved, err := resolveSecretRefs(c)
+	if err != nil {
+		t.Fatalf("resolveSecretRefs failed: %v", err)
+	}
+	if c.FallbackSMTPpass != "env-pass" {
+		t.Errorf("expected fallback_smtp_pass from environment, got '%s'", c.FallbackSMTPpass)
+	}
+	if want := []string{"fallback_smtp_pass"}; !reflect.DeepEqual(resolved, want) {
+		t.Errorf("expected resolved fields %v, got %v", want, resolved)
+	}
+
+	c = &tConfig{OAuth2Config: tOAuth2Config{ClientSecret: "env:TEST_UNSET_CLIENT_SECRET"}}
+	if _, err := resolveSecretRefs(c); err == nil || !strings.Contains(err.Error(), "TEST_UNSET_CLIENT_SECRET") {
+		t.Errorf("expected an error naming the unset variable, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// StartConnectivityCheck calls Graph as fallback_smtp_user every interval
+// (connectivity_check_interval), starting immediately, so expired credentials or
+// network problems show up in the log before a message fails. The goroutine stops with ctx.
+func StartConnectivityCheck(ctx context.Context, interval time.Duration) {
+	if config.FallbackSMTPuser == "" || config.FallbackSMTPpass == "" {
+		logger.Warn("connectivity_check_interval is set but fallback_smtp_user/fallback_smtp_pass are not, connectivity is not checked")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			runConnectivityCheck(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runConnectivityCheck performs one check and logs its result
+func runConnectivityCheck(ctx context.Context) {
+	start := time.Now()
+	if err := checkGraphConnectivity(ctx); err != nil {
+		logger.Warn("Graph connectivity check failed", "error", err, "username", config.FallbackSMTPuser)
+		return
+	}
+	logger.Info("Graph connectivity check succeeded", "username", config.FallbackSMTPuser, "duration_ms", time.Since(start).Milliseconds())
+}
+
+// checkGraphConnectivity reads the id of the fallback mailbox from Graph with a token
+// from the cache, so both the token endpoint (when the token needs refreshing) and
+// Graph are exercised the way a send would, retries included
+func checkGraphConnectivity(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	token, err := getCachedOAuth2Token(ctx, config.FallbackSMTPuser, config.FallbackSMTPpass)
+	if err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", graphBaseURL+graphMailboxPath(config.FallbackSMTPuser)+"?$select=id", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("User-Agent", userAgent())
+	retryCfg := getRetryConfig()
+	retryCfg.Target = "Graph connectivity check"
+	resp, err := doWithRetry(ctx, graphClient(), request, nil, retryCfg)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%w (%w)", err, newGraphError(resp))
+			resp.Body.Close()
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newGraphError(resp)
+	}
+	return nil
+}
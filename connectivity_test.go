@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectivityCheck(t *testing.T) {
+	initTestConfig(false)
+	config.RetryAttempts = 1
+	var logs bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&logs, nil))
+	TokenCache.Store("fallback@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("fallback@example.com")
+
+	status := http.StatusOK
+	checked := make(chan string, 10)
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checked <- r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery + " " + r.Header.Get("Authorization")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write([]byte(`{"id":"00000000-0000-0000-0000-000000000001"}`))
+		} else {
+			w.Write([]byte(`{"error":{"code":"InvalidAuthenticationToken"}}`))
+		}
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	runConnectivityCheck(context.Background())
+	if !strings.Contains(logs.String(), `level=INFO msg="Graph connectivity check succeeded" username=fallback@example.com`) {
+		t.Errorf("expected success logged at info, got: %s", logs.String())
+	}
+
+	logs.Reset()
+	status = http.StatusUnauthorized
+	runConnectivityCheck(context.Background())
+	if !strings.Contains(logs.String(), `level=WARN msg="Graph connectivity check failed"`) || !strings.Contains(logs.String(), "status 401") {
+		t.Errorf("expected the 401 logged at warn, got: %s", logs.String())
+	}
+
+	// The check runs immediately when started, then every interval
+	<-checked
+	<-checked
+	status = http.StatusOK
+	logged := make(chan struct{}, 1)
+	logger = slog.New(slog.NewTextHandler(logWriterFunc(func(p []byte) { logged <- struct{}{} }), nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	StartConnectivityCheck(ctx, time.Hour)
+	select {
+	case got := <-checked:
+		if want := "GET /users/fallback@example.com?$select=id Bearer tok"; got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a connectivity check at start")
+	}
+	<-logged
+}
+
+// logWriterFunc is an io.Writer calling a function with each log record
+type logWriterFunc func(p []byte)
+
+func (f logWriterFunc) Write(p []byte) (int, error) {
+	f(p)
+	return len(p), nil
+}
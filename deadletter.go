@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadLetterMu serializes the bound check and write so concurrent failures can't overshoot the limits
+var deadLetterMu sync.Mutex
+
+// deadLetterInfo is the JSON sidecar written next to a dead-lettered .eml
+type deadLetterInfo struct {
+	Timestamp  time.Time `json:"timestamp"`
+	User       string    `json:"user"`
+	From       string    `json:"from"`
+	Recipients []string  `json:"recipients"`
+	Subject    string    `json:"subject"`
+	Error      string    `json:"error"`
+}
+
+// writeDeadLetter stores a message that failed to send in dead_letter_dir as
+// <id>.eml (the message as submitted) plus <id>.json (envelope and failure reason).
+// Files are written atomically (temp file + rename). When dead_letter_max_files or
+// dead_letter_max_bytes would be exceeded the message is not stored.
+func writeDeadLetter(msg string, info deadLetterInfo) (string, error) {
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	if err := os.MkdirAll(config.DeadLetterDir, 0700); err != nil {
+		return "", err
+	}
+	count, size, err := deadLetterUsage(config.DeadLetterDir)
+	if err != nil {
+		return "", err
+	}
+	if count >= config.DeadLetterMaxFiles || size+int64(len(msg)) > config.DeadLetterMaxBytes {
+		return "", fmt.Errorf("dead letter directory full (%d messages, %d bytes)", count, size)
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	id := info.Timestamp.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+
+	sidecar, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(filepath.Join(config.DeadLetterDir, id+".eml"), []byte(msg)); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(filepath.Join(config.DeadLetterDir, id+".json"), sidecar); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// storeDeadLetter writes a dead letter when dead_letter_dir is set and logs the outcome
+func storeDeadLetter(msg string, info deadLetterInfo) {
+	if config.DeadLetterDir == "" {
+		return
+	}
+	id, err := writeDeadLetter(msg, info)
+	if err != nil {
+		logger.Warn("Failed to store dead letter", "error", err)
+		return
+	}
+	logger.Info("Failed message stored as dead letter", "id", id, "dir", config.DeadLetterDir)
+}
+
+// deadLetterUsage returns the number and total size of stored .eml files
+func deadLetterUsage(dir string) (count int, size int64, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".eml") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		count++
+		size += fi.Size()
+	}
+	return count, size, nil
+}
+
+// writeFileAtomic writes data to a temp file in the target directory and renames
+// it into place, so readers never see a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteDeadLetter(t *testing.T) {
+	initTestConfig(false)
+	config.DeadLetterDir = filepath.Join(t.TempDir(), "dead")
+	config.DeadLetterMaxFiles = 2
+	config.DeadLetterMaxBytes = 1024
+
+	msg := "Subject: Test\r\n\r\nHello\r\n"
+	info := deadLetterInfo{
+		Timestamp:  time.Date(2025, 3, 14, 9, 26, 53, 0, time.UTC),
+		User:       "user@example.com",
+		From:       "user@example.com",
+		Recipients: []string{"bob@example.com"},
+		Subject:    "Test",
+		Error:      "Graph API error (status 400): bad request",
+	}
+	id, err := writeDeadLetter(msg, info)
+	if err != nil {
+		t.Fatalf("writeDeadLetter failed: %v", err)
+	}
+	if !strings.HasPrefix(id, "20250314T092653Z-") {
+		t.Errorf("unexpected id %q", id)
+	}
+
+	eml, err := os.ReadFile(filepath.Join(config.DeadLetterDir, id+".eml"))
+	if err != nil || string(eml) != msg {
+		t.Errorf("eml = %q, %v; want %q", eml, err, msg)
+	}
+	sidecar, err := os.ReadFile(filepath.Join(config.DeadLetterDir, id+".json"))
+	if err != nil {
+		t.Fatalf("reading sidecar: %v", err)
+	}
+	var got deadLetterInfo
+	if err := json.Unmarshal(sidecar, &got); err != nil {
+		t.Fatalf("invalid sidecar JSON: %v", err)
+	}
+	if got.Error != info.Error || len(got.Recipients) != 1 || got.Recipients[0] != "bob@example.com" {
+		t.Errorf("unexpected sidecar %+v", got)
+	}
+
+	entries, _ := os.ReadDir(config.DeadLetterDir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".tmp-") {
+			t.Errorf("temp file left behind: %s", e.Name())
+		}
+	}
+
+	// Size bound
+	if _, err := writeDeadLetter(strings.Repeat("x", 1024), info); err == nil {
+		t.Error("expected error when exceeding dead_letter_max_bytes")
+	}
+	// Count bound
+	if _, err := writeDeadLetter(msg, info); err != nil {
+		t.Fatalf("second write failed: %v", err)
+	}
+	if _, err := writeDeadLetter(msg, info); err == nil {
+		t.Error("expected error when exceeding dead_letter_max_files")
+	}
+	if count, _, _ := deadLetterUsage(config.DeadLetterDir); count != 2 {
+		t.Errorf("stored %d messages, want 2", count)
+	}
+}
+
+func TestSendFailure_StoresDeadLetterAfterRetries(t *testing.T) {
+	initTestConfig(false)
+	config.DeadLetterDir = filepath.Join(t.TempDir(), "dead")
+	config.DeadLetterMaxFiles = 10
+	config.DeadLetterMaxBytes = 1 << 20
+	TokenCache.Store("dead@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("dead@example.com")
+
+	// Graph still throttles after the relay's own retries; the client gets 451
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		return "", &GraphError{StatusCode: 429, Message: "throttled"}
+	}
+	defer func() { sendMessage = prevSend }()
+
+	runConversation(t, []conversationStep{
+		{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00dead@example.com\x00pass")) + "\r\n", "235 2.7.0 Authentication successful"},
+		{"MAIL FROM:<dead@example.com>\r\n", "250 2.1.0 Ok"},
+		{"RCPT TO:<to@example.com>\r\n", "250 2.1.5 Ok"},
+		{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+		{"Subject: throttled\r\n\r\nbody\r\n.\r\n", "451 4.3.0 Temporary delivery failure, try again later"},
+	})
+
+	if count, _, err := deadLetterUsage(config.DeadLetterDir); err != nil || count != 1 {
+		t.Errorf("expected the message to be stored after the retries, got %d (%v)", count, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupPrefixBytes is how much of the message body goes into a message fingerprint
+const dedupPrefixBytes = 4096
+
+// maxDedupEntries bounds the fingerprints kept for dedup_window_seconds; when full,
+// the oldest fingerprint is forgotten
+const maxDedupEntries = 10000
+
+// recentMessages holds the fingerprints of messages accepted within dedup_window_seconds
+// and when they were accepted
+var recentMessages = struct {
+	sync.Mutex
+	seen map[[sha256.Size]byte]time.Time
+}{seen: make(map[[sha256.Size]byte]time.Time)}
+
+// dedupEnabled reports whether duplicate submissions are suppressed
+func dedupEnabled() bool {
+	return config.DedupWindowSeconds > 0
+}
+
+// dedupWindow is the configured dedup_window_seconds as a duration
+func dedupWindow() time.Duration {
+	return time.Duration(config.DedupWindowSeconds) * time.Second
+}
+
+// messageFingerprint identifies a submission by user, envelope sender, recipients (in
+// any order), subject, body length and the first dedupPrefixBytes of the body. Header
+// fields that differ between two runs of the same job (Date, Message-ID) are left out.
+func messageFingerprint(username, mailFrom string, rcptTo []string, pm *parsedMessage, msg string) [sha256.Size]byte {
+	rcpts := make([]string, len(rcptTo))
+	for i, rcpt := range rcptTo {
+		rcpts[i] = strings.ToLower(rcpt)
+	}
+	slices.Sort(rcpts)
+	body := msg
+	if i := strings.Index(msg, "\r\n\r\n"); i >= 0 {
+		body = msg[i+4:]
+	}
+	fields := []string{
+		strings.ToLower(username), strings.ToLower(mailFrom), strings.Join(rcpts, ","),
+		pm.subject, strconv.Itoa(len(body)), body[:min(len(body), dedupPrefixBytes)],
+	}
+	// NUL separators keep the field boundaries unambiguous
+	return sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+}
+
+// claimMessage records fingerprint and reports whether it is new, false when an
+// identical message was accepted within the window. Claiming before the send also
+// catches two identical submissions racing on separate connections; release forgets
+// the claim again when the send fails, so the client's retry is not suppressed.
+func claimMessage(fingerprint [sha256.Size]byte, now time.Time) (release func(), ok bool) {
+	recentMessages.Lock()
+	defer recentMessages.Unlock()
+	if claimed, found := recentMessages.seen[fingerprint]; found && now.Sub(claimed) < dedupWindow() {
+		return nil, false
+	}
+	if len(recentMessages.seen) >= maxDedupEntries {
+		pruneRecentMessages(now)
+	}
+	if len(recentMessages.seen) >= maxDedupEntries {
+		oldest, oldestAt := fingerprint, now
+		for fp, claimed := range recentMessages.seen {
+			if claimed.Before(oldestAt) {
+				oldest, oldestAt = fp, claimed
+			}
+		}
+		delete(recentMessages.seen, oldest)
+	}
+	recentMessages.seen[fingerprint] = now
+	return func() {
+		recentMessages.Lock()
+		defer recentMessages.Unlock()
+		if recentMessages.seen[fingerprint].Equal(now) {
+			delete(recentMessages.seen, fingerprint)
+		}
+	}, true
+}
+
+// pruneRecentMessages drops fingerprints older than the window; the caller holds the lock
+func pruneRecentMessages(now time.Time) int {
+	var deleted int
+	for fp, claimed := range recentMessages.seen {
+		if now.Sub(claimed) >= dedupWindow() {
+			delete(recentMessages.seen, fp)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// StartDedupCleanup periodically forgets fingerprints outside the dedup window
+func StartDedupCleanup(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				recentMessages.Lock()
+				deleted := pruneRecentMessages(now)
+				recentMessages.Unlock()
+				if deleted > 0 {
+					logger.Debug("Dedup cache cleanup completed", "deleted", deleted)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func resetRecentMessages() {
+	recentMessages.Lock()
+	recentMessages.seen = make(map[[sha256.Size]byte]time.Time)
+	recentMessages.Unlock()
+}
+
+func TestClaimMessage_Window(t *testing.T) {
+	initTestConfig(false)
+	config.DedupWindowSeconds = 30
+	resetRecentMessages()
+	defer resetRecentMessages()
+
+	pm := &parsedMessage{subject: "Nightly report"}
+	msg := "Subject: Nightly report\r\n\r\nbody"
+	fp := messageFingerprint("user@example.com", "cron@example.com", []string{"a@example.com", "b@example.com"}, pm, msg)
+	if other := messageFingerprint("USER@example.com", "cron@example.com", []string{"B@example.com", "a@example.com"}, pm, "Date: later\r\n\r\nbody"); other != fp {
+		t.Error("expected recipient order, case and headers outside the subject not to change the fingerprint")
+	}
+	if other := messageFingerprint("user@example.com", "cron@example.com", []string{"a@example.com"}, pm, msg); other == fp {
+		t.Error("expected different recipients to change the fingerprint")
+	}
+
+	t0 := time.Now()
+	if _, ok := claimMessage(fp, t0); !ok {
+		t.Fatal("expected the first submission to be claimed")
+	}
+	if _, ok := claimMessage(fp, t0.Add(10*time.Second)); ok {
+		t.Error("expected a duplicate within the window to be refused")
+	}
+	release, ok := claimMessage(fp, t0.Add(31*time.Second))
+	if !ok {
+		t.Fatal("expected the message to be claimable again after the window")
+	}
+	release()
+	if _, ok := claimMessage(fp, t0.Add(32*time.Second)); !ok {
+		t.Error("expected a released claim to allow the retry")
+	}
+}
+
+func TestDedup_SuppressesDuplicateSend(t *testing.T) {
+	initTestConfig(false)
+	config.DedupWindowSeconds = 60
+	resetRecentMessages()
+	defer resetRecentMessages()
+	TokenCache.Store("dedup@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("dedup@example.com")
+
+	sends := 0
+	failNext := false
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		sends++
+		if failNext {
+			failNext = false
+			return "", &GraphError{StatusCode: 503, Message: "unavailable"}
+		}
+		return "", nil
+	}
+	defer func() { sendMessage = prevSend }()
+
+	message := []conversationStep{
+		{"MAIL FROM:<dedup@example.com>\r\n", "250 2.1.0 Ok"},
+		{"RCPT TO:<to@example.com>\r\n", "250 2.1.5 Ok"},
+		{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+	}
+	auth := conversationStep{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00dedup@example.com\x00pass")) + "\r\n", "235 2.7.0 Authentication successful"}
+	var steps []conversationStep
+	steps = append(steps, auth)
+	steps = append(steps, message...)
+	steps = append(steps, conversationStep{"Subject: cron\r\n\r\nreport\r\n.\r\n", "250 2.0.0 Ok: queued as graphapi"})
+	steps = append(steps, message...)
+	steps = append(steps, conversationStep{"Subject: cron\r\n\r\nreport\r\n.\r\n", "250 2.0.0 Ok (duplicate suppressed)"})
+	steps = append(steps, message...)
+	steps = append(steps, conversationStep{"Subject: cron\r\n\r\nother report\r\n.\r\n", "250 2.0.0 Ok: queued as graphapi"})
+	steps = append(steps, conversationStep{"QUIT\r\n", "221 2.0.0 Bye"})
+	runConversation(t, steps)
+	if sends != 2 {
+		t.Errorf("expected the duplicate not to reach Graph (2 sends), got %d", sends)
+	}
+
+	// A failed send releases its claim, so the client's retry is delivered
+	resetRecentMessages()
+	failNext = true
+	steps = append([]conversationStep{auth}, message...)
+	steps = append(steps, conversationStep{"Subject: retry\r\n\r\nreport\r\n.\r\n", "451 4.3.0 Temporary delivery failure, try again later"})
+	runConversation(t, steps)
+	steps = append([]conversationStep{auth}, message...)
+	steps = append(steps, conversationStep{"Subject: retry\r\n\r\nreport\r\n.\r\n", "250 2.0.0 Ok: queued as graphapi"})
+	runConversation(t, steps)
+	if sends != 4 {
+		t.Errorf("expected the retry after a failure to be sent, got %d sends", sends)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// dsnParams holds the RFC 3461 DSN parameters of a RCPT TO command. The relay does
+// not generate DSNs (Exchange Online reports delivery failures to the sender itself),
+// so the parameters are only recorded in the send logs.
+type dsnParams struct {
+	notify string // NOTIFY: NEVER, or a comma-separated list of SUCCESS, FAILURE and DELAY
+	orcpt  string // ORCPT: the original recipient as addr-type;address, xtext decoded
+}
+
+// parseDSNParams returns the NOTIFY and ORCPT parameters of a RCPT TO command line,
+// with NOTIFY upper-cased. An invalid NOTIFY or ORCPT value is an error.
+func parseDSNParams(line string) (dsnParams, error) {
+	var dsn dsnParams
+	params := parseMailParams(line)
+	if notify, ok := params["NOTIFY"]; ok {
+		notify = strings.ToUpper(notify)
+		keywords := strings.Split(notify, ",")
+		for _, k := range keywords {
+			switch k {
+			case "SUCCESS", "FAILURE", "DELAY":
+			case "NEVER":
+				if len(keywords) > 1 {
+					return dsnParams{}, fmt.Errorf("NOTIFY=NEVER cannot be combined with other values")
+				}
+			default:
+				return dsnParams{}, fmt.Errorf("unknown NOTIFY value %q", k)
+			}
+		}
+		dsn.notify = notify
+	}
+	if orcpt, ok := params["ORCPT"]; ok {
+		addrType, addr, found := strings.Cut(orcpt, ";")
+		if !found || addrType == "" || addr == "" {
+			return dsnParams{}, fmt.Errorf("ORCPT must be addr-type;address")
+		}
+		decoded, err := decodeXtext(addr)
+		if err != nil {
+			return dsnParams{}, fmt.Errorf("invalid ORCPT address: %w", err)
+		}
+		dsn.orcpt = addrType + ";" + decoded
+	}
+	return dsn, nil
+}
+
+// dsnAttrs returns a "dsn" log group with the DSN parameters of each recipient that
+// had any, e.g. dsn.bob@example.com.notify=FAILURE,DELAY; nil when none had
+func dsnAttrs(rcptTo []string, dsn map[string]dsnParams) []any {
+	var recipients []any
+	for _, rcpt := range rcptTo {
+		p, ok := dsn[strings.ToLower(rcpt)]
+		if !ok {
+			continue
+		}
+		var attrs []any
+		if p.notify != "" {
+			attrs = append(attrs, "notify", p.notify)
+		}
+		if p.orcpt != "" {
+			attrs = append(attrs, "orcpt", p.orcpt)
+		}
+		recipients = append(recipients, slog.Group(rcpt, attrs...))
+	}
+	if recipients == nil {
+		return nil
+	}
+	return []any{slog.Group("dsn", recipients...)}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDSNParams(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    dsnParams
+		wantErr bool
+	}{
+		{"RCPT TO:<a@x> NOTIFY=FAILURE,DELAY", dsnParams{notify: "FAILURE,DELAY"}, false},
+		{"RCPT TO:<a@x> notify=never ORCPT=rfc822;orig+2Bext@example.com", dsnParams{notify: "NEVER", orcpt: "rfc822;orig+ext@example.com"}, false},
+		{"RCPT TO:<a@x>", dsnParams{}, false},
+		{"RCPT TO:<a@x> NOTIFY=NEVER,FAILURE", dsnParams{}, true},
+		{"RCPT TO:<a@x> NOTIFY=SOMETIMES", dsnParams{}, true},
+		{"RCPT TO:<a@x> ORCPT=orig@example.com", dsnParams{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDSNParams(tt.line)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseDSNParams(%q) = %+v, %v; want %+v, error %v", tt.line, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDSNParams_SendLog(t *testing.T) {
+	initTestConfig(false)
+	var logs bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&logs, nil))
+	TokenCache.Store("dsn@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("dsn@example.com")
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		return "", nil
+	}
+	defer func() { sendMessage = prevSend }()
+
+	runConversation(t, []conversationStep{
+		{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00dsn@example.com\x00pass")) + "\r\n", "235 2.7.0 Authentication successful"},
+		{"MAIL FROM:<dsn@example.com>\r\n", "250 2.1.0 Ok"},
+		{"RCPT TO:<a@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;a@example.com\r\n", "250 2.1.5 Ok"},
+		{"RCPT TO:<b@example.com>\r\n", "250 2.1.5 Ok"},
+		{"RCPT TO:<c@example.com> NOTIFY=BOGUS\r\n", "501 5.5.4 Invalid DSN parameter"},
+		{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+		{"Subject: dsn\r\n\r\nbody\r\n.\r\n", "250 2.0.0 Ok: queued as graphapi"},
+		{"QUIT\r\n", "221 2.0.0 Bye"},
+	})
+
+	var sent string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "E-mail sent successfully") {
+			sent = line
+		}
+	}
+	if want := "dsn.a@example.com.notify=FAILURE,DELAY dsn.a@example.com.orcpt=rfc822;a@example.com"; !strings.Contains(sent, want) {
+		t.Errorf("expected %s in send log, got: %s", want, sent)
+	}
+	if strings.Contains(sent, "dsn.b@example.com") || strings.Contains(sent, "c@example.com") {
+		t.Errorf("expected DSN parameters only for a@example.com, got: %s", sent)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+)
+
+// OAuthError is returned when the token endpoint answers with an OAuth2 error
+type OAuthError struct {
+	StatusCode  int    // HTTP status of the token response
+	Code        string // OAuth2 error code, e.g. invalid_grant
+	Description string // error_description (includes the AADSTS code)
+}
+
+func (e *OAuthError) Error() string {
+	return fmt.Sprintf("OAuth2 error: %s - %s", e.Code, e.Description)
+}
+
+// Temporary reports whether retrying later may succeed (throttling or an Azure AD outage)
+func (e *OAuthError) Temporary() bool {
+	return e.StatusCode == 429 || e.StatusCode >= 500 ||
+		e.Code == "temporarily_unavailable" || e.Code == "server_error"
+}
+
+// aadstsCodeRe extracts the AADSTS code from an error_description
+var aadstsCodeRe = regexp.MustCompile(`AADSTS\d+`)
+
+// ropcBlockedHints maps AADSTS codes meaning "ROPC cannot work for this account" to an
+// actionable hint. These are MFA and conditional access outcomes: retrying with the
+// same password never succeeds.
+var ropcBlockedHints = map[string]string{
+	"AADSTS50076": "MFA is required for this sign-in; exclude the account from the MFA/conditional access policy or use a service account without MFA",
+	"AADSTS50079": "the user must register for MFA; ROPC cannot complete registration, exclude the account from the MFA registration policy",
+	"AADSTS50074": "strong authentication is required; exclude the account from the MFA/conditional access policy",
+	"AADSTS50158": "an external security challenge (third-party MFA) is required; exclude the account from the conditional access policy",
+	"AADSTS53000": "conditional access requires a compliant device; ROPC sign-ins have no device, exclude the account from the policy",
+	"AADSTS53001": "conditional access requires a domain-joined device; ROPC sign-ins have no device, exclude the account from the policy",
+	"AADSTS53002": "conditional access requires an approved client app; exclude the account or this app from the policy",
+	"AADSTS53003": "access is blocked by a conditional access policy; check the Entra ID sign-in logs for the policy name and exclude the account or location",
+	"AADSTS53004": "the user must complete MFA registration (proof-up) interactively before ROPC can be used",
+}
+
+// AADSTSCode returns the AADSTS code from the description (e.g. AADSTS50076), or ""
+func (e *OAuthError) AADSTSCode() string {
+	return aadstsCodeRe.FindString(e.Description)
+}
+
+// Hint returns an operator hint when Azure AD policy (MFA, conditional access)
+// prevents the ROPC flow for this account, or "" for other errors
+func (e *OAuthError) Hint() string {
+	return ropcBlockedHints[e.AADSTSCode()]
+}
+
+// GraphError is returned when the Graph API answers with a non-2xx status
+type GraphError struct {
+	StatusCode int
+	Message    string // response body
+}
+
+func (e *GraphError) Error() string {
+	return fmt.Sprintf("Graph API error (status %d): %s", e.StatusCode, e.Message)
+}
+
+// newGraphError builds a GraphError from a failed Graph response, consuming its body
+func newGraphError(resp *http.Response) *GraphError {
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &GraphError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("failed to read body: %v", err)}
+	}
+	return &GraphError{StatusCode: resp.StatusCode, Message: string(b)}
+}
+
+// Temporary reports whether retrying later may succeed (throttling or a Graph outage)
+func (e *GraphError) Temporary() bool {
+	return e.StatusCode == 429 || e.StatusCode >= 500
+}
+
+// authErrorReply maps a token failure during AUTH to an SMTP reply (RFC 4954)
+func authErrorReply(err error) string {
+	var oauthErr *OAuthError
+	if errors.As(err, &oauthErr) && oauthErr.Temporary() {
+		return "454 4.7.0 Temporary authentication failure"
+	}
+	if oauthErr != nil && oauthErr.Hint() != "" {
+		// Give the client a reference operators can look up; the hint itself is logged
+		return "535 5.7.8 Authentication failed (" + oauthErr.AADSTSCode() + ": blocked by Azure AD policy)"
+	}
+	return "535 5.7.8 Authentication failed"
+}
+
+// tokenErrorReply maps a token failure after DATA to an SMTP reply code and text
+func tokenErrorReply(err error) (code, text string) {
+	var oauthErr *OAuthError
+	if errors.As(err, &oauthErr) && !oauthErr.Temporary() {
+		if oauthErr.Hint() != "" {
+			return "550 5.7.8", "Authentication credentials rejected (" + oauthErr.AADSTSCode() + ": blocked by Azure AD policy)"
+		}
+		return "550 5.7.8", "Authentication credentials rejected"
+	}
+	return "451 4.7.0", "Temporary authentication failure"
+}
+
+// sendErrorReply maps a Graph send failure to an SMTP reply code and text
+func sendErrorReply(err error) (code, text string) {
+	var graphErr *GraphError
+	var netErr net.Error
+	// A send cut off by its deadline (send_timeout_seconds, max_processing_time_seconds)
+	// or by the network (refused or reset connections, DNS failures) may succeed when
+	// the client retries
+	if errors.As(err, &graphErr) && graphErr.Temporary() || errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr) {
+		return "451 4.3.0", "Temporary delivery failure, try again later"
+	}
+	return "550 5.7.0", "Delivery failed"
+}
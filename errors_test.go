@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+)
+
+func TestSendMailGraphAPI_ReturnsGraphError(t *testing.T) {
+	initTestConfig(false)
+	config.RetryAttempts = 1
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":{"code":"ServiceUnavailable"}}`))
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	_, err := sendMailGraphAPI(context.Background(), "tok", "user@example.com", "user@example.com", []string{"to@example.com"}, &parsedMessage{})
+	var graphErr *GraphError
+	if !errors.As(err, &graphErr) {
+		t.Fatalf("expected *GraphError in chain, got: %v", err)
+	}
+	if graphErr.StatusCode != http.StatusServiceUnavailable || !graphErr.Temporary() {
+		t.Errorf("expected temporary 503, got status %d", graphErr.StatusCode)
+	}
+	if code, _ := sendErrorReply(err); code != "451 4.3.0" {
+		t.Errorf("expected 451 for throttled/unavailable Graph, got %s", code)
+	}
+}
+
+func TestSendErrorReply_TransportFailure(t *testing.T) {
+	initTestConfig(false)
+	config.RetryAttempts = 1
+	// Nothing listens on the closed server's address: the dial is refused
+	graph := httptest.NewServer(http.NotFoundHandler())
+	graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	_, err := sendMailGraphAPI(context.Background(), "tok", "user@example.com", "user@example.com", []string{"to@example.com"}, &parsedMessage{})
+	if err == nil {
+		t.Fatal("expected the send to fail")
+	}
+	if code, _ := sendErrorReply(err); code != "451 4.3.0" {
+		t.Errorf("expected 451 for a refused connection, got %s (%v)", code, err)
+	}
+	reset := fmt.Errorf("Graph API call failed after retries: %w", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET})
+	if code, _ := sendErrorReply(reset); code != "451 4.3.0" {
+		t.Errorf("expected 451 for a reset connection, got %s", code)
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	invalidGrant := &OAuthError{StatusCode: 400, Code: "invalid_grant", Description: "AADSTS50126: Invalid username or password"}
+	throttled := &OAuthError{StatusCode: 429, Code: "temporarily_unavailable"}
+	badRequest := &GraphError{StatusCode: 400, Message: "ErrorInvalidRecipients"}
+
+	if got := authErrorReply(invalidGrant); got != "535 5.7.8 Authentication failed" {
+		t.Errorf("authErrorReply(invalid_grant) = %q", got)
+	}
+	if got := authErrorReply(throttled); got != "454 4.7.0 Temporary authentication failure" {
+		t.Errorf("authErrorReply(throttled) = %q", got)
+	}
+	if code, _ := tokenErrorReply(fmt.Errorf("wrapped: %w", invalidGrant)); code != "550 5.7.8" {
+		t.Errorf("tokenErrorReply(invalid_grant) = %s", code)
+	}
+	if code, _ := tokenErrorReply(errors.New("token request failed: connection refused")); code != "451 4.7.0" {
+		t.Errorf("tokenErrorReply(network) = %s", code)
+	}
+	if code, _ := sendErrorReply(badRequest); code != "550 5.7.0" {
+		t.Errorf("sendErrorReply(400) = %s", code)
+	}
+	if got := invalidGrant.Error(); got != "OAuth2 error: invalid_grant - AADSTS50126: Invalid username or password" {
+		t.Errorf("unexpected OAuthError message: %q", got)
+	}
+}
+
+func TestOAuthError_PolicyHint(t *testing.T) {
+	mfa := &OAuthError{StatusCode: 400, Code: "invalid_grant", Description: "AADSTS50076: Due to a configuration change made by your administrator, or because you moved to a new location, you must use multi-factor authentication to access '00000003-0000-0000-c000-000000000000'. Trace ID: abc"}
+	badPassword := &OAuthError{StatusCode: 400, Code: "invalid_grant", Description: "AADSTS50126: Invalid username or password"}
+
+	if got := mfa.AADSTSCode(); got != "AADSTS50076" {
+		t.Errorf("AADSTSCode() = %q", got)
+	}
+	if mfa.Hint() == "" {
+		t.Error("expected a hint for AADSTS50076")
+	}
+	if badPassword.Hint() != "" {
+		t.Errorf("expected no hint for AADSTS50126, got %q", badPassword.Hint())
+	}
+	if got := authErrorReply(fmt.Errorf("wrapped: %w", mfa)); got != "535 5.7.8 Authentication failed (AADSTS50076: blocked by Azure AD policy)" {
+		t.Errorf("authErrorReply(mfa) = %q", got)
+	}
+	if code, text := tokenErrorReply(mfa); code != "550 5.7.8" || text != "Authentication credentials rejected (AADSTS50076: blocked by Azure AD policy)" {
+		t.Errorf("tokenErrorReply(mfa) = %s %s", code, text)
+	}
+}
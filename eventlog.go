@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/kardianos/service"
+)
+
+// logEventLog is the log value that sends the log to the Windows Event Log
+const logEventLog = "eventlog"
+
+// eventLogHandler is the slog.Handler of log: eventlog. Records are formatted like the
+// file log (key=value text, without the time the Event Log records itself) and written
+// through the service's system logger as Information, Warning or Error entries.
+type eventLogHandler struct {
+	inner slog.Handler
+	out   *eventLogWriter
+}
+
+// eventLogWriter receives the text of one record at a time from the inner handler
+// and passes it to the system logger at the record's level
+type eventLogWriter struct {
+	mu    sync.Mutex
+	sink  service.Logger
+	level slog.Level
+}
+
+// newEventLogHandler returns a handler writing records at or above level to sink
+func newEventLogHandler(sink service.Logger, level slog.Leveler) *eventLogHandler {
+	out := &eventLogWriter{sink: sink}
+	inner := slog.NewTextHandler(out, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return &eventLogHandler{inner: inner, out: out}
+}
+
+func (h *eventLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.level = r.Level
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &eventLogHandler{inner: h.inner.WithAttrs(attrs), out: h.out}
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	return &eventLogHandler{inner: h.inner.WithGroup(name), out: h.out}
+}
+
+// Write maps the slog level to the Event Log entry type: Error, Warning, and
+// Information for info and debug records
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	var err error
+	switch {
+	case w.level >= slog.LevelError:
+		err = w.sink.Error(msg)
+	case w.level >= slog.LevelWarn:
+		err = w.sink.Warning(msg)
+	default:
+		err = w.sink.Info(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// useEventLog switches the logger to the Windows Event Log of service s, for log: eventlog
+func useEventLog(s service.Service) error {
+	sink, err := s.SystemLogger(nil)
+	if err != nil {
+		return err
+	}
+	logger = slog.New(newEventLogHandler(sink, logLevel()))
+	return nil
+}
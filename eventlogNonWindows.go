@@ -0,0 +1,7 @@
+//go:build !windows
+
+package main
+
+// eventLogSupported reports whether log: eventlog is available on this platform;
+// the Event Log only exists on Windows
+const eventLogSupported = false
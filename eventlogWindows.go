@@ -0,0 +1,6 @@
+//go:build windows
+
+package main
+
+// eventLogSupported reports whether log: eventlog is available on this platform
+const eventLogSupported = true
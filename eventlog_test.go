@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"testing"
+)
+
+// recordingLogger is a service.Logger that records entries as "type: message"
+type recordingLogger struct {
+	entries []string
+}
+
+func (l *recordingLogger) Error(v ...interface{}) error {
+	l.entries = append(l.entries, "Error: "+fmt.Sprint(v...))
+	return nil
+}
+
+func (l *recordingLogger) Warning(v ...interface{}) error {
+	l.entries = append(l.entries, "Warning: "+fmt.Sprint(v...))
+	return nil
+}
+
+func (l *recordingLogger) Info(v ...interface{}) error {
+	l.entries = append(l.entries, "Information: "+fmt.Sprint(v...))
+	return nil
+}
+
+func (l *recordingLogger) Errorf(format string, a ...interface{}) error {
+	return l.Error(fmt.Sprintf(format, a...))
+}
+
+func (l *recordingLogger) Warningf(format string, a ...interface{}) error {
+	return l.Warning(fmt.Sprintf(format, a...))
+}
+
+func (l *recordingLogger) Infof(format string, a ...interface{}) error {
+	return l.Info(fmt.Sprintf(format, a...))
+}
+
+func TestEventLogHandler_Levels(t *testing.T) {
+	sink := &recordingLogger{}
+	log := slog.New(newEventLogHandler(sink, slog.LevelDebug)).With("remote", "192.0.2.1")
+	log.Debug("debug message")
+	log.Info("info message", "username", "user@example.com")
+	log.Warn("warn message")
+	log.WithGroup("graph").Error("error message", "status", 503)
+
+	want := []string{
+		"Information: level=DEBUG msg=\"debug message\" remote=192.0.2.1",
+		"Information: level=INFO msg=\"info message\" remote=192.0.2.1 username=user@example.com",
+		"Warning: level=WARN msg=\"warn message\" remote=192.0.2.1",
+		"Error: level=ERROR msg=\"error message\" remote=192.0.2.1 graph.status=503",
+	}
+	if len(sink.entries) != len(want) {
+		t.Fatalf("expected %d entries, got %q", len(want), sink.entries)
+	}
+	for i := range want {
+		if sink.entries[i] != want[i] {
+			t.Errorf("entry %d = %q, want %q", i, sink.entries[i], want[i])
+		}
+	}
+
+	sink.entries = nil
+	slog.New(newEventLogHandler(sink, slog.LevelWarn)).Info("filtered")
+	if len(sink.entries) != 0 {
+		t.Errorf("expected records below log_level to be dropped, got %q", sink.entries)
+	}
+}
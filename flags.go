@@ -11,10 +11,19 @@ import (
 
 func flagsProcess() {
 	encrypt := flag.Bool("encrypt", false, "Encrypt sensitive configuration strings in the config file")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration (defaults and environment overrides applied, secrets redacted) and exit")
 
 	flag.Parse()
 
 	if *encrypt {
+		if len(configEnvOverrides) > 0 {
+			// Marshaling would persist the environment values into config.yaml
+			log.Fatalf("Unset AZSMTP_* environment variables before encrypting (overridden: %v)", configEnvOverrides)
+		}
+		if len(configSecretRefs) > 0 {
+			// Marshaling would replace the references with the secrets they point to
+			log.Fatalf("Remove file:/env: secret references before encrypting (referenced: %v)", configSecretRefs)
+		}
 		encryptConfigStrings()
 		marshaled, err := yaml.Marshal(config)
 		if err != nil {
@@ -26,4 +35,12 @@ func flagsProcess() {
 		fmt.Println("Configuration strings encrypted successfully.")
 		os.Exit(0)
 	}
+	if *printConfig {
+		marshaled, err := yaml.Marshal(redactedConfig(config))
+		if err != nil {
+			log.Fatalf("Failed to marshal config: %v", err)
+		}
+		fmt.Print(string(marshaled))
+		os.Exit(0)
+	}
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPReader is the shared, read-only geoip_db reader; nil when disabled or unavailable
+var geoIPReader *maxminddb.Reader
+
+// geoIPRecord holds the fields used from MaxMind Country/City and ASN databases.
+// A database provides only one of the groups; missing fields stay empty.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// setupGeoIP opens geoip_db. A missing or invalid database is logged once and
+// connections are served without enrichment.
+func setupGeoIP() {
+	if config.GeoIPDB == "" {
+		return
+	}
+	reader, err := maxminddb.Open(config.GeoIPDB)
+	if err != nil {
+		logger.Warn("Failed to open GeoIP database, connection logs are not enriched", "geoip_db", config.GeoIPDB, "error", err)
+		return
+	}
+	geoIPReader = reader
+	logger.Info("GeoIP enrichment enabled", "geoip_db", config.GeoIPDB, "database_type", reader.Metadata.DatabaseType)
+}
+
+// geoIPAttrs returns log attributes (country, asn, as_org) for a remote address,
+// or nil when geoip_db is not in use or the address is not in the database
+func geoIPAttrs(addr net.Addr) []any {
+	if geoIPReader == nil {
+		return nil
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	var rec geoIPRecord
+	if err := geoIPReader.Lookup(tcpAddr.IP, &rec); err != nil {
+		logger.Debug("GeoIP lookup failed", "ip", tcpAddr.IP.String(), "error", err)
+		return nil
+	}
+	var attrs []any
+	if rec.Country.ISOCode != "" {
+		attrs = append(attrs, "country", rec.Country.ISOCode)
+	}
+	if rec.ASN != 0 {
+		attrs = append(attrs, "asn", rec.ASN, "as_org", rec.ASOrg)
+	}
+	return attrs
+}
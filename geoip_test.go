@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetupGeoIP_MissingDatabase(t *testing.T) {
+	initTestConfig(false)
+	var logs bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&logs, nil))
+	config.GeoIPDB = filepath.Join(t.TempDir(), "missing.mmdb")
+
+	setupGeoIP()
+	if geoIPReader != nil {
+		t.Fatal("expected no reader for a missing database")
+	}
+	if !strings.Contains(logs.String(), "Failed to open GeoIP database") {
+		t.Errorf("expected a startup warning, got: %s", logs.String())
+	}
+
+	// Connections are served without enrichment and without further warnings
+	logs.Reset()
+	if attrs := geoIPAttrs(&net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 25}); attrs != nil {
+		t.Errorf("expected no attributes without a database, got %v", attrs)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("expected the warning only once, got: %s", logs.String())
+	}
+}
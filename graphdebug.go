@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// logGraphRequest logs the outgoing Graph JSON (debug_graph_io) with attachment
+// contentBytes replaced by their size. The access token is a header and never logged.
+func logGraphRequest(method, graphURL string, jsonBody []byte) {
+	if !config.DebugGraphIO {
+		return
+	}
+	logger.Debug("Graph API request", "method", method, "url", graphURL, "bytes", len(jsonBody), "body", redactGraphPayload(jsonBody))
+}
+
+// logGraphResponse logs the Graph response status and body (debug_graph_io). The
+// body is read and replaced, so the caller can still consume it.
+func logGraphResponse(resp *http.Response) {
+	if !config.DebugGraphIO || resp == nil {
+		return
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		logger.Debug("Graph API response", "status", resp.StatusCode, "read_error", err)
+		return
+	}
+	logger.Debug("Graph API response", "status", resp.StatusCode, "request_id", resp.Header.Get("request-id"), "body", string(body))
+}
+
+// redactGraphPayload returns the JSON payload with every contentBytes value
+// replaced by a byte count, so attachment content never reaches the log
+func redactGraphPayload(jsonBody []byte) string {
+	var payload any
+	if err := json.Unmarshal(jsonBody, &payload); err != nil {
+		return fmt.Sprintf("<unparsable payload: %v>", err)
+	}
+	// No HTML escaping: keeps HTML bodies and the elision markers readable
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(elideContentBytes(payload)); err != nil {
+		return fmt.Sprintf("<unparsable payload: %v>", err)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// elideContentBytes walks a decoded JSON value and replaces contentBytes strings
+func elideContentBytes(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if s, ok := value.(string); ok && key == "contentBytes" {
+				v[key] = fmt.Sprintf("<%d bytes elided>", len(s))
+				continue
+			}
+			v[key] = elideContentBytes(value)
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = elideContentBytes(value)
+		}
+	}
+	return v
+}
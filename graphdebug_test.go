@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugGraphIO(t *testing.T) {
+	initTestConfig(false)
+	config.DebugGraphIO = true
+	var logs bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"code":"ErrorInvalidRecipients"}}`))
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	pm := &parsedMessage{subject: "Invoice", body: "see attachment", attachments: []Attachment{
+		{Filename: "invoice.pdf", ContentType: "application/pdf", Content: "SECRETPDFCONTENT"},
+	}}
+	_, err := sendMailGraphAPI(context.Background(), "SECRETTOKEN", "user@example.com", "user@example.com", []string{"to@example.com"}, pm)
+	if err == nil || !strings.Contains(err.Error(), "ErrorInvalidRecipients") {
+		t.Fatalf("expected Graph error with response body still readable, got: %v", err)
+	}
+
+	out := logs.String()
+	for _, want := range []string{"Graph API request", "invoice.pdf", "<16 bytes elided>", "Graph API response", "ErrorInvalidRecipients"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in debug log, got: %s", want, out)
+		}
+	}
+	for _, secret := range []string{"SECRETPDFCONTENT", "SECRETTOKEN"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("debug log leaks %q: %s", secret, out)
+		}
+	}
+
+	// Disabled: nothing is logged
+	config.DebugGraphIO = false
+	logs.Reset()
+	sendMailGraphAPI(context.Background(), "tok", "user@example.com", "user@example.com", []string{"to@example.com"}, pm)
+	if strings.Contains(logs.String(), "Graph API request") {
+		t.Errorf("expected no request log without debug_graph_io, got: %s", logs.String())
+	}
+}
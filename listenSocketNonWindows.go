@@ -0,0 +1,48 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenControl sets socket options before bind: SO_REUSEADDR, so a restarted relay
+// can bind while connections of the previous process linger in TIME_WAIT, and with
+// listen_reuse_port SO_REUSEPORT, so several processes can share the port.
+func listenControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if sockErr == nil && config.ListenReusePort {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setListenBacklog changes the accept backlog of a listening socket: listen() on a
+// socket that is already listening only updates the backlog. The kernel caps it
+// (net.core.somaxconn on Linux).
+func setListenBacklog(listener net.Listener, backlog int) error {
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	raw, err := tcpListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	if err := raw.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return listenErr
+}
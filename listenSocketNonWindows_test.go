@@ -0,0 +1,37 @@
+//go:build !windows
+
+package main
+
+import (
+	"testing"
+)
+
+func TestListen_ReusePort(t *testing.T) {
+	initTestConfig(false)
+	p := &program{}
+	defer func() {
+		for _, l := range p.listeners {
+			l.Close()
+		}
+	}()
+
+	first, err := p.listen("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	addr := first.Addr().String()
+	if _, err := p.listen("test", addr); err == nil {
+		t.Fatal("expected a second bind to fail without listen_reuse_port")
+	}
+
+	// Both sockets need SO_REUSEPORT to share the port
+	config.ListenReusePort = true
+	config.ListenBacklog = 16
+	reused, err := p.listen("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen with listen_reuse_port failed: %v", err)
+	}
+	if _, err := p.listen("test", reused.Addr().String()); err != nil {
+		t.Errorf("expected a second listener on the same port with listen_reuse_port, got: %v", err)
+	}
+}
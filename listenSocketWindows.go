@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenControl sets no options: SO_REUSEADDR on Windows lets other processes bind
+// the same port (not only after TIME_WAIT), and SO_REUSEPORT does not exist
+func listenControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// setListenBacklog is a no-op: Winsock uses its own maximum backlog (SOMAXCONN)
+func setListenBacklog(listener net.Listener, backlog int) error {
+	return nil
+}
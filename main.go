@@ -18,11 +18,13 @@ import (
 
 // program implements service.Interface
 type program struct {
-	listener net.Listener
-	ctx      context.Context
-	cancel   context.CancelFunc
-	wg       sync.WaitGroup
-	connSem  chan struct{}
+	listeners []net.Listener
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	connSem   chan struct{}
+
+	shutdownTracing func(context.Context) error
 }
 
 const version = "1.1.3"
@@ -39,36 +41,121 @@ func (p *program) Start(s service.Service) error {
 	// Start should not block. Do the actual work async.
 	p.ctx, p.cancel = context.WithCancel(context.Background())
 	p.connSem = make(chan struct{}, config.MaxConnections)
+	shutdown, err := setupTracing(p.ctx)
+	if err != nil {
+		logger.Error("Failed to initialize OpenTelemetry tracing, continuing without it", "error", err)
+		shutdown = func(context.Context) error { return nil }
+	} else if config.OtelEndpoint != "" {
+		logger.Info("OpenTelemetry tracing enabled", "endpoint", config.OtelEndpoint)
+	}
+	p.shutdownTracing = shutdown
+	if err := setupTLS(); err != nil {
+		logger.Error("Failed to load TLS certificate", "error", err)
+		return err
+	}
+	if tlsServerConfig != nil {
+		logger.Info("STARTTLS enabled", "cert_file", config.TLSCertFile)
+	}
+	setupGeoIP()
+	watchReloadSignal(p.ctx)
 	go p.run()
 	return nil
 }
 
 func (p *program) run() {
-	var err error
-	p.listener, err = net.Listen("tcp", config.ListenAddr)
+	listener, err := p.listenSMTP()
 	if err != nil {
-		logger.Error("Failed to listen", "error", err)
 		return
 	}
-
-	logger.Info("SMTP relay listening", "address", config.ListenAddr, "max_connections", config.MaxConnections)
+	if config.LMTPListenAddr != "" {
+		lmtpListener, err := p.listen("LMTP", config.LMTPListenAddr)
+		if err != nil {
+			listener.Close()
+			return
+		}
+		go p.serve(lmtpListener, handleLMTPConnection)
+	}
 
 	// Start token cache cleanup
 	StartTokenCacheCleanup(p.ctx, 5*time.Minute)
+	if rateLimitEnabled() {
+		StartMessageRateCleanup(p.ctx, 5*time.Minute)
+	}
+	if dedupEnabled() {
+		StartDedupCleanup(p.ctx, time.Minute)
+	}
+	if config.PrefetchTokenOnStart {
+		go PrefetchFallbackToken(p.ctx)
+	}
+	if config.RejectWhenBackendDown {
+		StartBackendProbe(p.ctx, time.Duration(config.BackendProbeIntervalSeconds)*time.Second)
+	}
+	if config.ConnectivityCheckInterval > 0 {
+		StartConnectivityCheck(p.ctx, time.Duration(config.ConnectivityCheckInterval)*time.Second)
+	}
+
+	p.serve(listener, handleSMTPConnection)
+}
+
+// listenSMTP uses the socket passed by systemd socket activation when present
+// and falls back to listening on listen_addr.
+func (p *program) listenSMTP() (net.Listener, error) {
+	listener, err := systemdListener()
+	if err != nil {
+		logger.Error("Failed to use systemd socket", "error", err)
+		return nil, err
+	}
+	if listener == nil {
+		return p.listen("SMTP relay", config.ListenAddr)
+	}
+	p.listeners = append(p.listeners, listener)
+	logger.Info("SMTP relay listening",
+		"address", listener.Addr().String(),
+		"socket_activation", "systemd",
+		"max_connections", config.MaxConnections)
+	return listener, nil
+}
+
+// listen opens a listener on addr and registers it for shutdown
+func (p *program) listen(protocol, addr string) (net.Listener, error) {
+	network := listenNetwork(config.ListenNetwork, addr)
+	lc := net.ListenConfig{Control: listenControl}
+	listener, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		logger.Error("Failed to listen", "error", err, "protocol", protocol, "network", network)
+		return nil, err
+	}
+	if config.ListenBacklog > 0 {
+		if err := setListenBacklog(listener, config.ListenBacklog); err != nil {
+			logger.Warn("Failed to set listen backlog, using OS default", "error", err, "backlog", config.ListenBacklog)
+		}
+	}
+	p.listeners = append(p.listeners, listener)
 
+	logger.Info(protocol+" listening",
+		"address", listener.Addr().String(),
+		"network", network,
+		"address_family", addressFamily(network, listener.Addr()),
+		"max_connections", config.MaxConnections)
+	return listener, nil
+}
+
+// serve accepts connections on listener until shutdown. The connection semaphore
+// is shared by all listeners.
+func (p *program) serve(listener net.Listener, handle func(net.Conn)) {
 	for {
 		// Set accept deadline to check for shutdown periodically
-		if tcpListener, ok := p.listener.(*net.TCPListener); ok {
+		if tcpListener, ok := listener.(*net.TCPListener); ok {
 			tcpListener.SetDeadline(time.Now().Add(1 * time.Second))
 		}
 
-		conn, err := p.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
 				// Check if we're shutting down
 				select {
 				case <-p.ctx.Done():
-					logger.Info("Shutdown signal received, stopping accept loop")
+					logger.Info("Shutdown signal received, stopping accept loop", "address", listener.Addr().String())
 					return
 				default:
 					continue
@@ -91,7 +178,7 @@ func (p *program) run() {
 			go func() {
 				defer p.wg.Done()
 				defer func() { <-p.connSem }()
-				handleSMTPConnection(conn)
+				handle(conn)
 			}()
 		case <-p.ctx.Done():
 			conn.Close()
@@ -105,6 +192,46 @@ func (p *program) run() {
 	}
 }
 
+// listenNetwork returns the network for net.Listen. An explicit listen_network wins;
+// otherwise IPv4 literals bind IPv4 only, IPv6 literals bind IPv6 only, and
+// hostnames, empty hosts (":25") and "[::]" bind dual-stack.
+func listenNetwork(configured, addr string) string {
+	if configured != "" {
+		return configured
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	case ip.IsUnspecified():
+		return "tcp"
+	default:
+		return "tcp6"
+	}
+}
+
+// addressFamily describes the address family actually bound by the listener
+func addressFamily(network string, addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "unknown"
+	}
+	switch {
+	case network == "tcp" && tcpAddr.IP.IsUnspecified():
+		return "dual-stack"
+	case tcpAddr.IP.To4() != nil:
+		return "ipv4"
+	default:
+		return "ipv6"
+	}
+}
+
 func (p *program) Stop(s service.Service) error {
 	logger.Info("Service stopping, initiating graceful shutdown...")
 
@@ -113,15 +240,16 @@ func (p *program) Stop(s service.Service) error {
 		p.cancel()
 	}
 
-	// Close listener to stop accepting new connections
-	if p.listener != nil {
-		p.listener.Close()
+	// Close listeners to stop accepting new connections
+	for _, listener := range p.listeners {
+		listener.Close()
 	}
 
 	// Wait for existing connections with timeout
 	done := make(chan struct{})
 	go func() {
 		p.wg.Wait()
+		asyncSends.Wait() // messages already accepted with async_accept
 		close(done)
 	}()
 
@@ -132,6 +260,19 @@ func (p *program) Stop(s service.Service) error {
 		logger.Warn("Shutdown timeout (30s), some connections may not have completed")
 	}
 
+	// Flush pending trace spans
+	if p.shutdownTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := p.shutdownTracing(ctx); err != nil {
+			logger.Warn("Failed to flush traces", "error", err)
+		}
+		cancel()
+	}
+
+	if geoIPReader != nil {
+		geoIPReader.Close()
+	}
+
 	// Close log file
 	if logFile != nil && logFile != os.Stdout {
 		logFile.Close()
@@ -148,15 +289,22 @@ func main() {
 	if err := slogSetup(); err != nil {
 		log.Fatalf("failed to initialize logger: %v", err)
 	}
+	// -print-config and -encrypt exit here; log after them so stdout stays clean
 	flagsProcess()
+	if len(configEnvOverrides) > 0 {
+		logger.Debug("Config fields loaded from environment", "fields", configEnvOverrides)
+	}
+	if len(configSecretRefs) > 0 {
+		logger.Debug("Secrets loaded from file/env references", "fields", configSecretRefs)
+	}
 
 	logger.Info("azureSMTPwithOAuth (systems@work) Github: https://github.com/mmalcek/azureSMTPwithOAuth")
-	logger.Info("Starting Service", "version", version)
+	logger.Info("Starting Service", "version", version, "service_name", config.ServiceName)
 
 	prg := &program{}
 	svcConfig := &service.Config{
-		Name:        "azureSMTPwithOAuth",
-		DisplayName: "azureSMTPwithOAuth",
+		Name:        config.ServiceName,
+		DisplayName: config.ServiceDisplayName,
 		Description: "azureSMTPwithOAuth (systems@work) is a service that provides SMTP functionality with OAuth authentication through the Microsoft Graph API. https://github.com/mmalcek/azureSMTPwithOAuth",
 	}
 
@@ -165,6 +313,12 @@ func main() {
 		logger.Error("service.New failed", "err", err)
 		os.Exit(1)
 	}
+	if config.Log == logEventLog {
+		if err := useEventLog(s); err != nil {
+			logger.Error("Event Log setup failed", "err", err)
+			os.Exit(1)
+		}
+	}
 
 	// If -service flag is set, control the service (install, start, stop, uninstall)
 	if *svcFlag != "" {
@@ -174,13 +328,13 @@ func main() {
 		}
 		switch *svcFlag {
 		case "install":
-			fmt.Println("Service installed successfully")
+			fmt.Printf("Service %q installed successfully\n", config.ServiceName)
 		case "uninstall":
-			fmt.Println("Service uninstalled successfully")
+			fmt.Printf("Service %q uninstalled successfully\n", config.ServiceName)
 		case "start":
-			fmt.Println("Service started successfully")
+			fmt.Printf("Service %q started successfully\n", config.ServiceName)
 		case "stop":
-			fmt.Println("Service stopped successfully")
+			fmt.Printf("Service %q stopped successfully\n", config.ServiceName)
 		}
 		return
 	}
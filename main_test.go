@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenNetwork(t *testing.T) {
+	cases := []struct {
+		configured string
+		addr       string
+		want       string
+	}{
+		{"", "127.0.0.1:2526", "tcp4"},
+		{"", "0.0.0.0:25", "tcp4"},
+		{"", "[::1]:2526", "tcp6"},
+		{"", "[::]:25", "tcp"},
+		{"", ":25", "tcp"},
+		{"", "localhost:25", "tcp"},
+		{"tcp6", ":25", "tcp6"},
+		{"tcp", "127.0.0.1:25", "tcp"},
+	}
+	for _, c := range cases {
+		if got := listenNetwork(c.configured, c.addr); got != c.want {
+			t.Errorf("listenNetwork(%q, %q) = %q, want %q", c.configured, c.addr, got, c.want)
+		}
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	cases := []struct {
+		network string
+		ip      string
+		want    string
+	}{
+		{"tcp", "::", "dual-stack"},
+		{"tcp4", "127.0.0.1", "ipv4"},
+		{"tcp6", "::1", "ipv6"},
+		{"tcp6", "::", "ipv6"},
+	}
+	for _, c := range cases {
+		addr := &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 25}
+		if got := addressFamily(c.network, addr); got != c.want {
+			t.Errorf("addressFamily(%q, %s) = %q, want %q", c.network, c.ip, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+// parseRawPassthrough reads only the header fields the relay itself needs (subject,
+// recipients, X-Create-Draft) and keeps the message for raw_passthrough, so the MIME
+// structure, all headers and DKIM or S/MIME signatures reach Graph unchanged.
+func parseRawPassthrough(msg string) (*parsedMessage, error) {
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		return nil, fmt.Errorf("mail.ReadMessage failed: %w", err)
+	}
+	pm := &parsedMessage{rawMIME: msg}
+	subjectRaw := m.Header.Get("Subject")
+	if pm.subject, err = new(mime.WordDecoder).DecodeHeader(subjectRaw); err != nil {
+		pm.subject = subjectRaw
+	}
+	pm.toAddrs = parseAddressList(m.Header.Get("To"))
+	pm.ccAddrs = parseAddressList(m.Header.Get("Cc"))
+	pm.bccAddrs = parseAddressList(m.Header.Get("Bcc"))
+	pm.createDraft = strings.EqualFold(strings.TrimSpace(m.Header.Get("X-Create-Draft")), "true")
+	pm.autoSubmitted = parseAutoSubmitted(m.Header.Get("Auto-Submitted"))
+	if config.MessageIDDomain != "" && strings.TrimSpace(m.Header.Get("Message-Id")) == "" {
+		pm.messageID = newMessageID()
+	}
+	return pm, nil
+}
+
+// rawMIMEMessage returns the MIME message sent to Graph in raw_passthrough mode.
+// Headers added by the relay (pm.headers, e.g. X-Received, Auto-Submitted for
+// add_auto_submitted and a generated Message-ID for message_id_domain) are
+// prepended, which leaves signatures intact. Graph takes the recipients of a MIME
+// message from its headers, so envelope recipients missing from To/Cc/Bcc are
+// prepended as Bcc.
+func rawMIMEMessage(rcptTo []string, pm *parsedMessage) string {
+	var b strings.Builder
+	for _, h := range pm.headers {
+		b.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+	if pm.autoSubmitted == "" && config.AddAutoSubmitted {
+		b.WriteString("Auto-Submitted: auto-generated\r\n")
+	}
+	if pm.messageID != "" {
+		b.WriteString("Message-ID: " + pm.messageID + "\r\n")
+	}
+	var bcc []string
+	for _, addr := range rcptTo {
+		if !containsFold(pm.toAddrs, addr) && !containsFold(pm.ccAddrs, addr) && !containsFold(pm.bccAddrs, addr) {
+			bcc = append(bcc, addr)
+		}
+	}
+	if len(bcc) > 0 {
+		// One address per folded line keeps long recipient lists within the line limit
+		b.WriteString("Bcc: " + strings.Join(bcc, ",\r\n ") + "\r\n")
+	}
+	b.WriteString(pm.rawMIME)
+	return b.String()
+}
+
+// containsFold reports whether list contains addr, ignoring case
+func containsFold(list []string, addr string) bool {
+	for _, a := range list {
+		if strings.EqualFold(a, addr) {
+			return true
+		}
+	}
+	return false
+}
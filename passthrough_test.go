@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRawPassthrough(t *testing.T) {
+	initTestConfig(false)
+	config.RawPassthrough = true
+	TokenCache.Store("raw@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("raw@example.com")
+
+	var gotPath, gotType, gotBody string
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotType = r.Header.Get("Content-Type")
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	message := "DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=sel; h=from:to:subject; bh=abc=; b=def=\r\n" +
+		"From: raw@example.com\r\nTo: to@example.com\r\nSubject: Signed\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; boundary=sig\r\n\r\n" +
+		"--sig\r\nContent-Type: text/plain\r\n\r\nbody\r\n--sig\r\nContent-Type: application/pkcs7-signature\r\n\r\nMIIB\r\n--sig--\r\n"
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	if resp := authPlain(client, reader, "raw@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Fatalf("expected 235, got: %s", resp)
+	}
+	client.Write([]byte("MAIL FROM:<raw@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("RCPT TO:<hidden@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("DATA\r\n"))
+	readResponse(reader) // 354
+	go client.Write([]byte(message + ".\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected 250, got: %s", resp)
+	}
+
+	if gotPath != "/users/raw@example.com/sendMail" || gotType != "text/plain" {
+		t.Errorf("expected text/plain POST to sendMail, got %q %q", gotType, gotPath)
+	}
+	mimeMsg, err := base64.StdEncoding.DecodeString(gotBody)
+	if err != nil {
+		t.Fatalf("expected a base64 body: %v", err)
+	}
+	// The envelope-only recipient is prepended, the message itself is unchanged
+	if want := "Bcc: hidden@example.com\r\n" + message; string(mimeMsg) != want {
+		t.Errorf("unexpected MIME message:\n%q\nwant:\n%q", mimeMsg, want)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/base64"
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	htmlHiddenRe = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)\s*>`)
+	htmlBreakRe  = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|tr|li|h[1-6]|table|blockquote)\s*>`)
+	htmlTagRe    = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesRe = regexp.MustCompile(`\n{3,}`)
+	trailingSpRe = regexp.MustCompile(`[ \t]+\n`)
+)
+
+// plaintextFallbackName is the file name of the generated plain-text attachment
+const plaintextFallbackName = "message.txt"
+
+// htmlToText renders an HTML body as plain text: scripts and styles are dropped,
+// block ends become line breaks, remaining tags are stripped and entities decoded.
+func htmlToText(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = htmlHiddenRe.ReplaceAllString(s, "")
+	s = htmlBreakRe.ReplaceAllString(s, "\n")
+	s = htmlTagRe.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = trailingSpRe.ReplaceAllString(s, "\n")
+	s = blankLinesRe.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s) + "\n"
+}
+
+// addPlaintextFallback attaches a plain-text rendering of an HTML-only body as
+// message.txt (attach_plaintext_fallback). Graph takes a single body content type,
+// so the text copy can't be sent as an alternative part.
+func addPlaintextFallback(pm *parsedMessage) {
+	if !pm.isHTML || pm.hasText {
+		return
+	}
+	pm.attachments = append(pm.attachments, Attachment{
+		Filename:    plaintextFallbackName,
+		ContentType: "text/plain; charset=utf-8",
+		Content:     base64.StdEncoding.EncodeToString([]byte(htmlToText(pm.body))),
+	})
+}
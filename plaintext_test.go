@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestAddPlaintextFallback_HTMLOnly(t *testing.T) {
+	msg := "Subject: Invoice\r\nContent-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<html><head><style>p{color:red}</style></head><body><h1>Invoice</h1><p>Total: 10&nbsp;&euro;</p>Line<br>break</body></html>\r\n"
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addPlaintextFallback(pm)
+
+	if len(pm.attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(pm.attachments))
+	}
+	att := pm.attachments[0]
+	if att.Filename != "message.txt" || att.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected attachment: %s (%s)", att.Filename, att.ContentType)
+	}
+	text, _ := base64.StdEncoding.DecodeString(att.Content)
+	want := "Invoice\nTotal: 10 €\nLine\nbreak\n"
+	if string(text) != want {
+		t.Errorf("unexpected plain text:\n got: %q\nwant: %q", text, want)
+	}
+	if !pm.isHTML {
+		t.Error("expected the HTML body to be kept")
+	}
+}
+
+func TestAddPlaintextFallback_SkippedWithTextAlternative(t *testing.T) {
+	msg := "Subject: Alt\r\nContent-Type: multipart/alternative; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nplain\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>html</p>\r\n--b--\r\n"
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addPlaintextFallback(pm)
+	if len(pm.attachments) != 0 {
+		t.Errorf("expected no generated attachment when a text part exists, got %d", len(pm.attachments))
+	}
+
+	plain := &parsedMessage{body: "plain only"}
+	addPlaintextFallback(plain)
+	if len(plain.attachments) != 0 {
+		t.Error("expected no generated attachment for a plain-text message")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// messageRates holds the send times of each user's recent messages (sliding windows
+// for max_messages_per_user_per_minute/_per_hour), keyed by lower-cased username
+var messageRates = struct {
+	sync.Mutex
+	sent map[string][]time.Time
+}{sent: make(map[string][]time.Time)}
+
+// rateLimitEnabled reports whether any per-user message rate limit is configured
+func rateLimitEnabled() bool {
+	return config.MaxMessagesPerUserPerMinute > 0 || config.MaxMessagesPerUserPerHour > 0
+}
+
+// rateWindow is the longest configured window; older send times are irrelevant
+func rateWindow() time.Duration {
+	if config.MaxMessagesPerUserPerHour > 0 {
+		return time.Hour
+	}
+	return time.Minute
+}
+
+// allowUserMessage records a message for username and reports whether it is within
+// the per-minute and per-hour limits. Refused messages are not recorded, so a client
+// retrying too early does not extend its own block.
+func allowUserMessage(username string, now time.Time) bool {
+	if !rateLimitEnabled() {
+		return true
+	}
+	key := strings.ToLower(username)
+	messageRates.Lock()
+	defer messageRates.Unlock()
+
+	sent := pruneSendTimes(messageRates.sent[key], now.Add(-rateWindow()))
+	if config.MaxMessagesPerUserPerHour > 0 && len(sent) >= config.MaxMessagesPerUserPerHour {
+		messageRates.sent[key] = sent
+		return false
+	}
+	if config.MaxMessagesPerUserPerMinute > 0 {
+		if len(pruneSendTimes(sent, now.Add(-time.Minute))) >= config.MaxMessagesPerUserPerMinute {
+			messageRates.sent[key] = sent
+			return false
+		}
+	}
+	messageRates.sent[key] = append(sent, now)
+	return true
+}
+
+// pruneSendTimes drops the (chronologically ordered) send times not after cutoff
+func pruneSendTimes(sent []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(sent) && !sent[i].After(cutoff) {
+		i++
+	}
+	return sent[i:]
+}
+
+// StartMessageRateCleanup periodically forgets users without messages in the rate window
+func StartMessageRateCleanup(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				cleanupMessageRates(now)
+			}
+		}
+	}()
+}
+
+// cleanupMessageRates removes users whose send times are all outside the rate window
+func cleanupMessageRates(now time.Time) {
+	messageRates.Lock()
+	defer messageRates.Unlock()
+	cutoff := now.Add(-rateWindow())
+	for key, sent := range messageRates.sent {
+		if sent = pruneSendTimes(sent, cutoff); len(sent) == 0 {
+			delete(messageRates.sent, key)
+		} else {
+			messageRates.sent[key] = sent
+		}
+	}
+}
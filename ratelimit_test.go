@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetMessageRates() {
+	messageRates.Lock()
+	messageRates.sent = make(map[string][]time.Time)
+	messageRates.Unlock()
+}
+
+func TestAllowUserMessage_PerMinute(t *testing.T) {
+	initTestConfig(false)
+	config.MaxMessagesPerUserPerMinute = 2
+	resetMessageRates()
+	defer resetMessageRates()
+
+	t0 := time.Now()
+	if !allowUserMessage("user@example.com", t0) || !allowUserMessage("USER@example.com", t0.Add(10*time.Second)) {
+		t.Fatal("expected the first two messages to be allowed")
+	}
+	if allowUserMessage("user@example.com", t0.Add(20*time.Second)) {
+		t.Error("expected the third message within a minute to be refused")
+	}
+	if !allowUserMessage("other@example.com", t0.Add(20*time.Second)) {
+		t.Error("expected other users to be unaffected")
+	}
+	// Sliding window: the first message leaves the window after 60s, the second after 70s
+	if !allowUserMessage("user@example.com", t0.Add(61*time.Second)) {
+		t.Error("expected a message to be allowed once the oldest left the window")
+	}
+	if allowUserMessage("user@example.com", t0.Add(65*time.Second)) {
+		t.Error("expected the limit to apply again with two messages in the window")
+	}
+}
+
+func TestAllowUserMessage_PerHour(t *testing.T) {
+	initTestConfig(false)
+	config.MaxMessagesPerUserPerMinute = 10
+	config.MaxMessagesPerUserPerHour = 3
+	resetMessageRates()
+	defer resetMessageRates()
+
+	t0 := time.Now()
+	for i := range 3 {
+		if !allowUserMessage("user@example.com", t0.Add(time.Duration(i)*10*time.Minute)) {
+			t.Fatalf("expected message %d to be allowed", i+1)
+		}
+	}
+	if allowUserMessage("user@example.com", t0.Add(30*time.Minute)) {
+		t.Error("expected the fourth message within an hour to be refused")
+	}
+	if !allowUserMessage("user@example.com", t0.Add(time.Hour+time.Second)) {
+		t.Error("expected a message to be allowed after the hour window moved on")
+	}
+
+	// Cleanup forgets users without recent messages
+	cleanupMessageRates(t0.Add(3 * time.Hour))
+	messageRates.Lock()
+	defer messageRates.Unlock()
+	if len(messageRates.sent) != 0 {
+		t.Errorf("expected idle users removed, got %v", messageRates.sent)
+	}
+}
+
+func TestRateLimit_SMTPReply(t *testing.T) {
+	initTestConfig(false)
+	config.MaxMessagesPerUserPerMinute = 1
+	resetMessageRates()
+	defer resetMessageRates()
+	TokenCache.Store("rate@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("rate@example.com")
+
+	sent := 0
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent++
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	if resp := authPlain(client, reader, "rate@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Fatalf("expected 235, got: %s", resp)
+	}
+	send := func() string {
+		client.Write([]byte("MAIL FROM:<rate@example.com>\r\n"))
+		readResponse(reader)
+		client.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+		readResponse(reader)
+		client.Write([]byte("DATA\r\n"))
+		readResponse(reader) // 354
+		go client.Write([]byte("Subject: rate\r\n\r\nbody\r\n.\r\n"))
+		return readResponse(reader)
+	}
+
+	if resp := send(); !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected first message to be sent, got: %s", resp)
+	}
+	if resp := send(); resp != "452 4.5.3 Rate limit exceeded, try again later" {
+		t.Errorf("expected 452 for the second message, got: %s", resp)
+	}
+	if sent != 1 {
+		t.Errorf("expected a single Graph request, got %d", sent)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchReloadSignal reloads the TLS certificate on SIGHUP until ctx is cancelled
+func watchReloadSignal(ctx context.Context) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sighup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sighup:
+				if tlsCerts == nil {
+					logger.Info("SIGHUP received, nothing to reload")
+					continue
+				}
+				if err := tlsCerts.Reload(); err != nil {
+					logger.Error("TLS certificate reload failed, keeping previous certificate", "error", err)
+					continue
+				}
+				logger.Info("TLS certificate reloaded (SIGHUP)", "cert_file", tlsCerts.certFile)
+			}
+		}
+	}()
+}
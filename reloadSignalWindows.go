@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "context"
+
+// watchReloadSignal is a no-op: Windows has no SIGHUP, certificate file changes
+// are still picked up on the next handshake
+func watchReloadSignal(ctx context.Context) {}
@@ -3,8 +3,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,16 +18,24 @@ import (
 	"net"
 	"net/http"
 	"net/mail"
+	"net/netip"
 	"net/url"
+	"os"
+	"regexp"
 	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/singleflight"
 )
 
@@ -31,19 +45,93 @@ var TokenCache sync.Map
 // tokenFetchGroup prevents duplicate concurrent token fetches for same user
 var tokenFetchGroup singleflight.Group
 
+// tenantTokenSems limits in-flight token endpoint requests per tenant ID
+// (chan struct{} semaphores, created on first use)
+var tenantTokenSems sync.Map
+
+// tokenStats counts token cache activity (useful when diagnosing Azure AD throttling)
+var tokenStats struct {
+	hits    atomic.Int64 // served from cache
+	misses  atomic.Int64 // cache miss or expired token
+	fetches atomic.Int64 // actual requests to the token endpoint
+	shared  atomic.Int64 // callers that reused another caller's in-flight fetch
+}
+
+// activeConnections counts open SMTP/LMTP connections (reported by XSTATUS)
+var activeConnections atomic.Int64
+
+// startTime is when the relay started (uptime reported by XSTATUS)
+var startTime = time.Now()
+
 type cachedToken struct {
-	token     string
-	expiresAt time.Time
+	token        string
+	expiresAt    time.Time
+	cachedAt     time.Time // when the token was fetched, for token_max_cache_age
+	refreshToken string    // issued with the offline_access scope, renews token without the password
+	passwordMAC  [32]byte  // HMAC of the password the refresh token was obtained with
+}
+
+// usable reports whether the cached access token may still be served: it has not
+// reached expiresAt and, with token_max_cache_age, was fetched less than that long
+// ago, so revoked credentials are noticed before the token expires
+func (tok cachedToken) usable(now time.Time) bool {
+	if config.TokenMaxCacheAge > 0 && now.Sub(tok.cachedAt) >= time.Duration(config.TokenMaxCacheAge)*time.Second {
+		return false
+	}
+	return now.Before(tok.expiresAt)
+}
+
+// refreshTokenLifetime is how long a cache entry with a refresh token is kept after
+// its access token expired (Azure AD refresh tokens expire after 90 days of inactivity)
+const refreshTokenLifetime = 90 * 24 * time.Hour
+
+// passwordMACKey is a per-process random key for cachedToken.passwordMAC, so
+// passwords are not kept in memory in a form that can be reversed offline
+var passwordMACKey = func() []byte {
+	key := make([]byte, 32)
+	cryptorand.Read(key)
+	return key
+}()
+
+// passwordMAC returns the HMAC-SHA256 of password under passwordMACKey
+func passwordMAC(password string) [32]byte {
+	mac := hmac.New(sha256.New, passwordMACKey)
+	mac.Write([]byte(password))
+	var sum [32]byte
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+// canRefresh reports whether tok has a refresh token obtained with password. The
+// refresh token skips the password check, so a client presenting a different
+// password must go through the password grant.
+func (tok cachedToken) canRefresh(password string) bool {
+	mac := passwordMAC(password)
+	return tok.refreshToken != "" && hmac.Equal(tok.passwordMAC[:], mac[:])
+}
+
+// userAgent identifies the relay in Azure AD sign-in logs and Graph audit logs
+func userAgent() string {
+	if config.UserAgent != "" {
+		return config.UserAgent
+	}
+	return "azureSMTPwithOAuth/" + version
 }
 
+// graphBaseURL is the Microsoft Graph endpoint (overridden in tests)
+var graphBaseURL = "https://graph.microsoft.com/v1.0"
+
 // maxRecipients limits the number of RCPT TO addresses per message (Graph API limit)
 const maxRecipients = 500
 
+// compressRequestThreshold is the JSON body size above which compress_requests gzips Graph requests
+const compressRequestThreshold = 32 * 1024
+
 // Shared HTTP clients with connection pooling for better performance
 var (
-	// graphHTTPClient is used for Microsoft Graph API calls
+	// graphHTTPClient is used for Microsoft Graph API calls; the per-request
+	// timeout is set from graph_timeout_seconds when sending (graphClient)
 	graphHTTPClient = &http.Client{
-		Timeout: 60 * time.Second, // Increased for large attachments
 		Transport: &http.Transport{
 			MaxIdleConns:        100,
 			MaxIdleConnsPerHost: 10,
@@ -69,6 +157,8 @@ type RetryConfig struct {
 	InitialBackoff  time.Duration
 	MaxBackoff      time.Duration
 	RetryableStatus []int
+	Jitter          string // none, equal (default) or full
+	Target          string // what is called, for logs (default "Graph API call")
 }
 
 // getRetryConfig returns retry configuration based on config settings
@@ -78,6 +168,33 @@ func getRetryConfig() RetryConfig {
 		InitialBackoff:  time.Duration(config.RetryInitialDelay) * time.Millisecond,
 		MaxBackoff:      10 * time.Second,
 		RetryableStatus: []int{429, 500, 502, 503, 504},
+		Jitter:          config.RetryJitter,
+	}
+}
+
+// Replaceable in tests: the jitter source and the backoff timer of doWithRetry
+var (
+	retryJitterInt63n = rand.Int63n
+	retryAfter        = time.After
+)
+
+// retryDelay applies the jitter strategy to an exponential backoff step:
+// "none" sleeps exactly backoff, "full" (AWS-style) a random duration in
+// [0, backoff), and "equal" (default) adds 0-25% of backoff on top.
+func retryDelay(backoff time.Duration, jitter string) time.Duration {
+	switch jitter {
+	case "none":
+		return backoff
+	case "full":
+		if backoff <= 0 {
+			return 0
+		}
+		return time.Duration(retryJitterInt63n(int64(backoff)))
+	default:
+		if backoff/4 <= 0 {
+			return backoff
+		}
+		return backoff + time.Duration(retryJitterInt63n(int64(backoff/4)))
 	}
 }
 
@@ -97,6 +214,10 @@ func doWithRetry(ctx context.Context, client *http.Client, req *http.Request, js
 		return nil, fmt.Errorf("retry MaxAttempts must be > 0")
 	}
 
+	target := cfg.Target
+	if target == "" {
+		target = "Graph API call"
+	}
 	var lastErr error
 	var resp *http.Response
 
@@ -106,14 +227,23 @@ func doWithRetry(ctx context.Context, client *http.Client, req *http.Request, js
 			if backoff > cfg.MaxBackoff {
 				backoff = cfg.MaxBackoff
 			}
-			// Add jitter (0-25% of backoff)
-			jitter := time.Duration(rand.Int63n(int64(backoff / 4)))
+			delay := retryDelay(backoff, cfg.Jitter)
+			// Don't wait for a retry the deadline (max_processing_time_seconds) cuts
+			// off anyway: fail now with the last result, so the client gets a timely reply
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+				logger.Debug("Retry budget exhausted, giving up on "+target, "attempt", attempt, "backoff_ms", delay.Milliseconds())
+				return resp, lastErr
+			}
+			if resp != nil {
+				resp.Body.Close()
+				resp = nil
+			}
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
-			case <-time.After(backoff + jitter):
+			case <-retryAfter(delay):
 			}
-			logger.Debug("Retrying Graph API call", "attempt", attempt+1, "backoff_ms", (backoff+jitter).Milliseconds())
+			logger.Debug("Retrying "+target, "attempt", attempt+1, "backoff_ms", delay.Milliseconds())
 		}
 
 		// Create new request for each attempt (body needs fresh reader)
@@ -126,10 +256,11 @@ func doWithRetry(ctx context.Context, client *http.Client, req *http.Request, js
 				reqCopy.Header.Add(key, value)
 			}
 		}
+		injectTraceContext(ctx, reqCopy)
 
 		resp, lastErr = client.Do(reqCopy)
 		if lastErr != nil {
-			logger.Debug("HTTP request failed", "attempt", attempt+1, "error", lastErr)
+			logger.Debug("HTTP request failed", "target", target, "attempt", attempt+1, "error", lastErr)
 			continue // Network error, retry
 		}
 
@@ -137,21 +268,76 @@ func doWithRetry(ctx context.Context, client *http.Client, req *http.Request, js
 			return resp, nil // Success or non-retryable error
 		}
 
-		logger.Debug("Retryable status received", "attempt", attempt+1, "status", resp.StatusCode)
+		logger.Debug("Retryable status received", "target", target, "attempt", attempt+1, "status", resp.StatusCode)
 		lastErr = fmt.Errorf("retryable status: %d", resp.StatusCode)
-
-		// Close body before retry, but keep last response open for caller
-		if attempt < cfg.MaxAttempts-1 {
-			resp.Body.Close()
-			resp = nil
-		}
+		// The body is closed before a retry; the last response stays open for the caller
 	}
 
 	return resp, lastErr
 }
 
+// graphClient returns graphHTTPClient with graph_timeout_seconds as the timeout of
+// each request. The overall send, retries included, is bounded by sendTimeout.
+func graphClient() *http.Client {
+	timeout := config.GraphTimeoutSeconds
+	if timeout <= 0 {
+		timeout = 60
+	}
+	client := *graphHTTPClient
+	client.Timeout = time.Duration(timeout) * time.Second
+	return &client
+}
+
+// sendTimeoutBytesPerSecond is the upload rate assumed when extending the send
+// deadline for attachments (1 extra second per 256KB)
+const sendTimeoutBytesPerSecond = 256 * 1024
+
+// sendTimeout returns the deadline for getting a token and sending pm: send_timeout_seconds,
+// plus time for the attachment payload so large uploads are not cut off, capped by
+// max_processing_time_seconds
+func sendTimeout(pm *parsedMessage) time.Duration {
+	base := config.SendTimeoutSeconds
+	if base <= 0 {
+		base = 60
+	}
+	var attachmentBytes int
+	for _, att := range pm.attachments {
+		attachmentBytes += len(att.Content)
+	}
+	timeout := time.Duration(base)*time.Second + time.Duration(attachmentBytes/sendTimeoutBytesPerSecond)*time.Second
+	if config.MaxProcessingTimeSeconds > 0 {
+		timeout = min(timeout, time.Duration(config.MaxProcessingTimeSeconds)*time.Second)
+	}
+	return timeout
+}
+
+// gzipBytes returns the gzip-compressed form of data
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // handleSMTPConnection handles a single SMTP connection
 func handleSMTPConnection(conn net.Conn) {
+	handleConnection(conn, false)
+}
+
+// handleLMTPConnection handles a single LMTP (RFC 2033) connection
+func handleLMTPConnection(conn net.Conn) {
+	handleConnection(conn, true)
+}
+
+// handleConnection runs the command loop for SMTP or, when lmtp is set, LMTP.
+// LMTP differs only in the greeting command (LHLO) and in the reply to DATA,
+// which carries one line per recipient.
+func handleConnection(conn net.Conn, lmtp bool) {
 	// Panic recovery to prevent service crash
 	defer func() {
 		if r := recover(); r != nil {
@@ -163,26 +349,66 @@ func handleSMTPConnection(conn net.Conn) {
 		conn.Close()
 	}()
 
+	activeConnections.Add(1)
+	defer activeConnections.Add(-1)
+
+	// Connection source, with country/ASN when geoip_db is configured
+	if geo := geoIPAttrs(conn.RemoteAddr()); geo != nil {
+		logger.Info("Connection opened", append([]any{"remote", conn.RemoteAddr().String(), "lmtp", lmtp}, geo...)...)
+	} else {
+		logger.Debug("Connection opened", "remote", conn.RemoteAddr().String(), "lmtp", lmtp)
+	}
+
+	// Fail fast so upstream MTAs queue the message instead of bouncing it later
+	if config.RejectWhenBackendDown && backendDown.Load() {
+		conn.Write([]byte("421 4.3.2 Backend unavailable, try again later\r\n"))
+		logger.Debug("Connection rejected: backend unavailable", "remote", conn.RemoteAddr().String())
+		return
+	}
+
+	// Username holding a per-user connection slot (released when the connection ends)
+	var connUser string
+	defer func() { releaseUserConnection(connUser) }()
+	// How the session authenticated, added to the send logs (authAuditAttrs)
+	var auditAttrs []any
+
 	// Set connection timeout
 	timeout := time.Duration(config.ConnectionTimeout) * time.Second
 	conn.SetDeadline(time.Now().Add(timeout))
+	readTimeout := time.Duration(config.ReadTimeoutSeconds) * time.Second
 
-	reader := bufio.NewReader(conn)
+	// The reader is created before the banner is sent: commands from clients that
+	// don't wait for the 220 (e.g. EHLO in the same packet as the TCP handshake) are
+	// buffered and answered in order after the banner, never interleaved with it.
+	reader := newLineReader(conn)
 	writer := bufio.NewWriter(conn)
-	fmt.Fprintf(writer, "220 SMTP Relay Ready\r\n")
-	writer.Flush()
+	banner := "220 SMTP Relay Ready\r\n"
+	if lmtp {
+		banner = "220 LMTP Relay Ready\r\n"
+	}
+	writer.WriteString(banner)
+	if err := writer.Flush(); err != nil {
+		logger.Debug("Failed to send greeting", "error", err, "remote", conn.RemoteAddr())
+		return
+	}
 
 	var username, password string
+	var heloName string
 	authenticated := false
+	anonymous := false
 	awaitingAuthData := false
+	messageCount := 0 // successfully delivered messages on this connection
 	var mailFrom string
 	var rcptTo []string
+	var rcptDSN map[string]dsnParams // DSN parameters by lower-cased recipient, reset by MAIL FROM
+	var bodyType string              // BODY= of the current MAIL FROM: 7BIT, 8BITMIME or "" (not declared)
+	rcptOverflow := false            // recipient_overflow: reject_transaction refused the transaction, until RSET
 
 	for {
-		// Reset read deadline for each command (60s per command)
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		// Reset read deadline for each command (read_timeout_seconds per command)
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
 
-		line, err := reader.ReadString('\n')
+		line, err := reader.readCommandLine()
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				logger.Debug("Connection timeout", "remote", conn.RemoteAddr())
@@ -217,10 +443,126 @@ func handleSMTPConnection(conn net.Conn) {
 			logger.Debug("Received SMTP command", "command", line)
 		}
 
-		// Handle EHLO/HELO commands
-		if strings.HasPrefix(strings.ToUpper(line), "EHLO") || strings.HasPrefix(strings.ToUpper(line), "HELO") {
-			// Note: STARTTLS removed as it's not implemented
-			fmt.Fprintf(writer, "250-smtpRelay\r\n250 AUTH LOGIN PLAIN\r\n")
+		// Handle EHLO/HELO commands (LHLO in LMTP mode)
+		if lmtp && (strings.HasPrefix(strings.ToUpper(line), "EHLO") || strings.HasPrefix(strings.ToUpper(line), "HELO")) {
+			fmt.Fprintf(writer, "500 5.5.1 Use LHLO\r\n")
+			writer.Flush()
+			continue
+		}
+		if (lmtp && strings.HasPrefix(strings.ToUpper(line), "LHLO")) || strings.HasPrefix(strings.ToUpper(line), "EHLO") || strings.HasPrefix(strings.ToUpper(line), "HELO") {
+			heloName = strings.TrimSpace(line[4:])
+			sizeUser := ""
+			if authenticated {
+				sizeUser = username
+			}
+			caps := ehloCapabilities(isTLSConn(conn), advertisedMaxSize(sizeUser))
+			if isTrustedProxy(conn) {
+				caps = append(caps, "XCLIENT ADDR PORT")
+			}
+			writeMultiline(writer, "250", append([]string{"smtpRelay"}, caps...))
+			writer.Flush()
+			continue
+		}
+
+		// RFC 3207: upgrade the connection, then start over from the greeting
+		if strings.HasPrefix(strings.ToUpper(line), "STARTTLS") {
+			if tlsServerConfig == nil || isTLSConn(conn) {
+				fmt.Fprintf(writer, "502 5.5.1 STARTTLS not available\r\n")
+				writer.Flush()
+				continue
+			}
+			if reader.Buffered() > 0 {
+				// Pipelined plaintext after STARTTLS could be injected into the TLS session
+				fmt.Fprintf(writer, "501 5.5.4 No commands allowed after STARTTLS in the same packet\r\n")
+				writer.Flush()
+				return
+			}
+			fmt.Fprintf(writer, "220 2.0.0 Ready to start TLS\r\n")
+			writer.Flush()
+			tlsConn := tls.Server(conn, tlsServerConfig)
+			conn.SetDeadline(time.Now().Add(readTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				logger.Warn("TLS handshake failed", "error", err, "remote", conn.RemoteAddr())
+				return
+			}
+			conn.SetDeadline(time.Now().Add(timeout))
+			conn = tlsConn
+			reader = newLineReader(conn)
+			writer = bufio.NewWriter(conn)
+			// Discard all state from before the upgrade
+			releaseUserConnection(connUser)
+			connUser = ""
+			heloName, username, password = "", "", ""
+			authenticated, anonymous = false, false
+			auditAttrs = nil
+			mailFrom, rcptTo = "", nil
+			rcptDSN, bodyType = nil, ""
+			rcptOverflow = false
+			messageCount = 0
+			logger.Debug("TLS established", "version", tls.VersionName(tlsConn.ConnectionState().Version), "remote", conn.RemoteAddr())
+			// A client certificate mapped in user_map authenticates the session without AUTH
+			if certUser, certPass, ok := clientCertUser(tlsConn.ConnectionState()); ok {
+				if !acquireUserConnection(certUser) {
+					logger.Warn("Connection rejected: per-user limit reached", "username", certUser, "max", config.MaxConnectionsPerUser, "remote", conn.RemoteAddr())
+					fmt.Fprintf(writer, "421 4.7.0 Too many connections for this user\r\n")
+					writer.Flush()
+					return
+				}
+				connUser = certUser
+				username, password = certUser, certPass
+				authenticated = true
+				auditAttrs = []any{"remote", conn.RemoteAddr().String(), "auth_mode", "client_cert"}
+				logger.Debug("User authenticated by client certificate", append([]any{"username", username, "remote", conn.RemoteAddr().String()}, geoIPAttrs(conn.RemoteAddr())...)...)
+			}
+			continue
+		}
+
+		// Postfix XCLIENT: a trusted proxy passes the address of the client it relays for.
+		// It is answered with the greeting, as on a new connection, and the proxy
+		// starts over with EHLO.
+		if strings.HasPrefix(strings.ToUpper(line), "XCLIENT") {
+			if !isTrustedProxy(conn) {
+				logger.Warn("XCLIENT rejected: not a trusted proxy", "remote", conn.RemoteAddr())
+				fmt.Fprintf(writer, "550 5.7.0 Error: insufficient authorization\r\n")
+				writer.Flush()
+				continue
+			}
+			if authenticated || mailFrom != "" {
+				fmt.Fprintf(writer, "503 5.5.1 Error: XCLIENT not allowed after AUTH or MAIL\r\n")
+				writer.Flush()
+				continue
+			}
+			client, err := parseXClient(line, conn.RemoteAddr())
+			if err != nil {
+				logger.Warn("XCLIENT rejected: invalid attribute", "error", err, "remote", conn.RemoteAddr())
+				fmt.Fprintf(writer, "501 5.5.4 Invalid XCLIENT attribute\r\n")
+				writer.Flush()
+				continue
+			}
+			if client != nil {
+				logger.Info("Client address set by XCLIENT", append([]any{"remote", client.String(), "proxy", peerAddr(conn).String()}, geoIPAttrs(client)...)...)
+				conn = withClientAddr(conn, client)
+			}
+			heloName = ""
+			writer.WriteString(banner)
+			writer.Flush()
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToUpper(line), "AUTH") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || !slices.Contains(authMechanisms(), strings.ToUpper(fields[1])) {
+				logger.Warn("AUTH rejected: mechanism not enabled", "command", strings.Join(fields[:min(len(fields), 2)], " "), "remote", conn.RemoteAddr())
+				fmt.Fprintf(writer, "504 5.5.4 Unrecognized authentication type\r\n")
+				writer.Flush()
+				continue
+			}
+		}
+
+		// RFC 4954: plaintext mechanisms must not be accepted over cleartext when TLS is required
+		if strings.HasPrefix(strings.ToUpper(line), "AUTH") && config.RequireTLSForAuth && !isTLSConn(conn) {
+			logger.Warn("AUTH rejected: encryption required", "remote", conn.RemoteAddr())
+			fmt.Fprintf(writer, "538 5.7.11 Encryption required for requested authentication mechanism\r\n")
 			writer.Flush()
 			continue
 		}
@@ -236,7 +578,7 @@ func handleSMTPConnection(conn net.Conn) {
 				fmt.Fprintf(writer, "334\r\n")
 				writer.Flush()
 				awaitingAuthData = true
-				nextLine, err := reader.ReadString('\n')
+				nextLine, err := reader.readCommandLine()
 				if err != nil {
 					logger.Error("Failed to read AUTH PLAIN data", "error", err)
 					fmt.Fprintf(writer, "421 4.7.0 Connection error during authentication\r\n")
@@ -264,9 +606,13 @@ func handleSMTPConnection(conn net.Conn) {
 			password = parts[2]
 
 			// Validate credentials and authenticate
+			releaseUserConnection(connUser)
+			connUser = ""
+			auditAttrs = authAuditAttrs(conn, username, password)
 			if authErr := authenticateUser(conn, writer, &username, &password); authErr != nil {
 				return
 			}
+			connUser = username
 			authenticated = true
 			continue
 		}
@@ -289,7 +635,7 @@ func handleSMTPConnection(conn net.Conn) {
 				fmt.Fprintf(writer, "334 UGFzc3dvcmQ6\r\n") // 'Password:' base64
 				writer.Flush()
 				awaitingAuthData = true
-				passB64, err := reader.ReadString('\n')
+				passB64, err := reader.readCommandLine()
 				if err != nil {
 					logger.Error("Failed to read password during AUTH", "error", err)
 					fmt.Fprintf(writer, "421 4.7.0 Connection error during authentication\r\n")
@@ -309,7 +655,7 @@ func handleSMTPConnection(conn net.Conn) {
 				fmt.Fprintf(writer, "334 VXNlcm5hbWU6\r\n") // 'Username:' base64
 				writer.Flush()
 				awaitingAuthData = true
-				userB64, err := reader.ReadString('\n')
+				userB64, err := reader.readCommandLine()
 				if err != nil {
 					logger.Error("Failed to read username during AUTH", "error", err)
 					fmt.Fprintf(writer, "421 4.7.0 Connection error during authentication\r\n")
@@ -329,7 +675,7 @@ func handleSMTPConnection(conn net.Conn) {
 				fmt.Fprintf(writer, "334 UGFzc3dvcmQ6\r\n") // 'Password:' base64
 				writer.Flush()
 				awaitingAuthData = true
-				passB64, err := reader.ReadString('\n')
+				passB64, err := reader.readCommandLine()
 				if err != nil {
 					logger.Error("Failed to read password during AUTH", "error", err)
 					fmt.Fprintf(writer, "421 4.7.0 Connection error during authentication\r\n")
@@ -347,20 +693,56 @@ func handleSMTPConnection(conn net.Conn) {
 			}
 
 			// Validate credentials and authenticate
+			releaseUserConnection(connUser)
+			connUser = ""
+			auditAttrs = authAuditAttrs(conn, username, password)
 			if authErr := authenticateUser(conn, writer, &username, &password); authErr != nil {
 				return
 			}
+			connUser = username
 			authenticated = true
 			continue
 		}
 
+		// RFC 5321 7.3: answer EXPN/VRFY politely without disclosing list membership or mailboxes
+		if strings.HasPrefix(strings.ToUpper(line), "EXPN") {
+			fmt.Fprintf(writer, "252 2.1.5 Cannot EXPN list\r\n")
+			writer.Flush()
+			continue
+		}
+		if strings.HasPrefix(strings.ToUpper(line), "VRFY") {
+			fmt.Fprintf(writer, "252 2.1.5 Cannot VRFY user, but will accept message and attempt delivery\r\n")
+			writer.Flush()
+			continue
+		}
+
+		// Non-standard status query; never answered for anonymous sessions
+		if config.EnableXStatus && strings.EqualFold(strings.TrimSpace(line), "XSTATUS") {
+			if !authenticated || anonymous {
+				fmt.Fprintf(writer, "530 5.7.0 Authentication required\r\n")
+			} else {
+				writeMultiline(writer, "211", xstatusLines())
+			}
+			writer.Flush()
+			continue
+		}
+
 		// If not authenticated, check if anonymous access is allowed
 		if !authenticated {
 			if config.AllowAnonymous && config.FallbackSMTPuser != "" && config.FallbackSMTPpass != "" {
 				logger.Warn("Anonymous access - using fallback credentials", "command", line, "remote", conn.RemoteAddr())
+				if !acquireUserConnection(config.FallbackSMTPuser) {
+					logger.Warn("Connection rejected: per-user limit reached", "username", config.FallbackSMTPuser, "max", config.MaxConnectionsPerUser, "remote", conn.RemoteAddr())
+					fmt.Fprintf(writer, "421 4.7.0 Too many connections for this user\r\n")
+					writer.Flush()
+					return
+				}
+				connUser = config.FallbackSMTPuser
 				username = config.FallbackSMTPuser
 				password = config.FallbackSMTPpass
 				authenticated = true
+				anonymous = true
+				auditAttrs = authAuditAttrs(conn, "", "")
 			} else {
 				logger.Error("Authentication required for command", "command", line)
 				fmt.Fprintf(writer, "530 5.7.0 Authentication required\r\n")
@@ -379,6 +761,17 @@ func handleSMTPConnection(conn net.Conn) {
 		if strings.HasPrefix(strings.ToUpper(line), "RSET") {
 			mailFrom = ""
 			rcptTo = nil
+			rcptOverflow = false
+			if config.ResetClearsAuth {
+				// Policy: the next message must authenticate again
+				releaseUserConnection(connUser)
+				connUser = ""
+				username, password = "", ""
+				authenticated = false
+				anonymous = false
+				auditAttrs = nil
+				logger.Debug("RSET cleared authentication", "remote", conn.RemoteAddr())
+			}
 			fmt.Fprintf(writer, "250 2.0.0 Ok\r\n")
 			writer.Flush()
 			continue
@@ -391,13 +784,71 @@ func handleSMTPConnection(conn net.Conn) {
 		}
 
 		// Handle MAIL FROM, RCPT TO, DATA commands
+		if rcptOverflow && transactionCommand(line) {
+			fmt.Fprintf(writer, "503 5.5.1 Transaction rejected: too many recipients, send RSET\r\n")
+			writer.Flush()
+			continue
+		}
 		if strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:") {
+			// Force a reconnect so per-connection and per-user limits are passed again
+			if config.MaxMessagesPerConnection > 0 && messageCount >= config.MaxMessagesPerConnection {
+				logger.Info("Closing connection: message limit reached", "username", username, "max", config.MaxMessagesPerConnection, "remote", conn.RemoteAddr())
+				fmt.Fprintf(writer, "421 4.7.0 Too many messages this session\r\n")
+				writer.Flush()
+				return
+			}
 			mailFrom = extractAddress(line)
+			rcptDSN = nil
+			// Graph cannot send without a from address, so the null sender (bounces) needs a policy
+			if mailFrom == "" && isNullSender(line) {
+				if config.NullSender != "substitute" {
+					logger.Warn("Null sender rejected", "username", username, "remote", conn.RemoteAddr())
+					fmt.Fprintf(writer, "501 5.1.7 Null sender not supported by this relay\r\n")
+					writer.Flush()
+					continue
+				}
+				logger.Info("Null sender replaced by authenticated user", "username", username, "remote", conn.RemoteAddr())
+				mailFrom = username
+			}
 			if mailFrom == "" || !isValidEmail(mailFrom) {
 				fmt.Fprintf(writer, "501 5.1.7 Invalid sender address\r\n")
 				writer.Flush()
 				continue
 			}
+			// RFC 1870: reject up front when the declared size exceeds the user's limit
+			if sizeParam, ok := parseMailParams(line)["SIZE"]; ok {
+				declared, err := strconv.ParseInt(sizeParam, 10, 64)
+				if err != nil || declared < 0 {
+					mailFrom = ""
+					fmt.Fprintf(writer, "501 5.5.4 Invalid SIZE parameter\r\n")
+					writer.Flush()
+					continue
+				}
+				if limit := maxMessageSizeFor(username); declared > limit {
+					mailFrom = ""
+					fmt.Fprintf(writer, "552 5.3.4 Message size exceeds fixed maximum message size (max %d bytes)\r\n", limit)
+					writer.Flush()
+					logger.Warn("Message rejected at MAIL FROM: declared size exceeded", "size", declared, "max", limit, "username", username)
+					continue
+				}
+			}
+			// RFC 6152: BODY=8BITMIME announces 8-bit content, BODY=7BIT promises ASCII
+			bodyType = strings.ToUpper(parseMailParams(line)["BODY"])
+			if bodyType != "" && bodyType != "7BIT" && bodyType != "8BITMIME" {
+				mailFrom = ""
+				fmt.Fprintf(writer, "501 5.5.4 Invalid BODY parameter\r\n")
+				writer.Flush()
+				continue
+			}
+			// RFC 4954 section 5: only a trusted MTA may assert the original submitter
+			if identity := mailAuthIdentity(line); identity != "" {
+				if isTrustedMTA(conn.RemoteAddr()) {
+					logger.Info("Using AUTH= identity asserted by trusted MTA", "envelope_from", mailFrom, "auth", identity, "username", username, "remote", conn.RemoteAddr())
+					mailFrom = identity
+				} else {
+					logger.Debug("Ignoring AUTH= parameter from untrusted client", "auth", identity, "remote", conn.RemoteAddr())
+				}
+			}
 			fmt.Fprintf(writer, "250 2.1.0 Ok\r\n")
 			writer.Flush()
 			continue
@@ -410,11 +861,48 @@ func handleSMTPConnection(conn net.Conn) {
 				writer.Flush()
 				continue
 			}
+			if !isRecipientDomainAllowed(addr) {
+				logger.Warn("Recipient rejected: domain not allowed", "rcpt", addr, "remote", conn.RemoteAddr())
+				fmt.Fprintf(writer, "550 5.7.1 Relaying denied for this recipient\r\n")
+				writer.Flush()
+				continue
+			}
+			// A repeated address would make Graph deliver the message twice; LMTP
+			// must answer once per accepted RCPT, so it keeps duplicates
+			if !lmtp && !config.AllowDuplicateRecipients && slices.ContainsFunc(rcptTo, func(r string) bool { return strings.EqualFold(r, addr) }) {
+				logger.Debug("Duplicate recipient ignored", "rcpt", addr, "remote", conn.RemoteAddr())
+				fmt.Fprintf(writer, "250 2.1.5 Ok (duplicate ignored)\r\n")
+				writer.Flush()
+				continue
+			}
 			if len(rcptTo) >= maxRecipients {
+				// reject_extra refuses only this recipient (the client may send to the
+				// accepted ones and retry the rest); reject_transaction fails the message
+				if config.RecipientOverflow == "reject_transaction" {
+					logger.Warn("Transaction rejected: too many recipients", "max", maxRecipients, "username", username, "remote", conn.RemoteAddr())
+					rcptOverflow = true
+					fmt.Fprintf(writer, "550 5.5.3 Too many recipients\r\n")
+					writer.Flush()
+					continue
+				}
 				fmt.Fprintf(writer, "452 4.5.3 Too many recipients\r\n")
 				writer.Flush()
 				continue
 			}
+			// RFC 3461 NOTIFY/ORCPT are recorded for the send logs, not acted upon
+			dsn, err := parseDSNParams(line)
+			if err != nil {
+				logger.Debug("Recipient rejected: invalid DSN parameter", "rcpt", addr, "error", err, "remote", conn.RemoteAddr())
+				fmt.Fprintf(writer, "501 5.5.4 Invalid DSN parameter\r\n")
+				writer.Flush()
+				continue
+			}
+			if dsn != (dsnParams{}) {
+				if rcptDSN == nil {
+					rcptDSN = make(map[string]dsnParams)
+				}
+				rcptDSN[strings.ToLower(addr)] = dsn
+			}
 			rcptTo = append(rcptTo, addr)
 			fmt.Fprintf(writer, "250 2.1.5 Ok\r\n")
 			writer.Flush()
@@ -422,8 +910,8 @@ func handleSMTPConnection(conn net.Conn) {
 		}
 
 		if strings.HasPrefix(strings.ToUpper(line), "DATA") {
-			// Validate we have recipients before accepting DATA
-			if len(rcptTo) == 0 {
+			// Validate we have recipients before accepting DATA (unless they come from the headers)
+			if len(rcptTo) == 0 && (lmtp || !config.DeriveRecipientsFromHeaders) {
 				fmt.Fprintf(writer, "503 5.5.1 No recipients specified\r\n")
 				writer.Flush()
 				continue
@@ -432,92 +920,297 @@ func handleSMTPConnection(conn net.Conn) {
 			fmt.Fprintf(writer, "354 End data with <CR><LF>.<CR><LF>\r\n")
 			writer.Flush()
 
-			var messageSize int64
+			var messageSize, headerSize int64
+			maxSize := maxMessageSizeFor(username)
 			var dataBuffer strings.Builder
-			messageTooLarge := false
+			inHeaders := true // until the blank line separating headers from body
+			messageRejected := false
+			atLineStart := true // false while reading the continuation of an over-long line
+			var dataDeadline time.Time
+			if config.DataTotalTimeoutSeconds > 0 {
+				dataDeadline = time.Now().Add(time.Duration(config.DataTotalTimeoutSeconds) * time.Second)
+			}
 
 			for {
-				// Reset deadline for DATA reading
-				conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+				// Reset deadline for DATA reading, capped by data_total_timeout_seconds
+				lineDeadline := time.Now().Add(readTimeout)
+				if !dataDeadline.IsZero() && dataDeadline.Before(lineDeadline) {
+					lineDeadline = dataDeadline
+				}
+				conn.SetReadDeadline(lineDeadline)
 
-				dataLine, err := reader.ReadString('\n')
+				dataLine, truncated, err := reader.readDataLine(config.MaxDataLineLength)
 				if err != nil {
-					logger.Error("Client read error during DATA", "error", err)
+					// Timeout or the client went away before the terminating dot: the
+					// partial message is discarded, give the client a definitive answer
+					logger.Warn("DATA incomplete, message discarded", "error", err, "bytes", messageSize, "username", username, "remote", conn.RemoteAddr())
+					fmt.Fprintf(writer, "421 4.4.2 Timeout during DATA\r\n")
+					writer.Flush()
 					return
 				}
-				if strings.TrimSpace(dataLine) == "." {
+				lineStart := atLineStart
+				atLineStart = !truncated
+				if lineStart && strings.TrimSpace(dataLine) == "." {
 					break
 				}
 
 				// RFC 5321 §4.5.2: dot-destuffing — remove leading dot from escaped lines
-				if strings.HasPrefix(dataLine, "..") {
+				if lineStart && strings.HasPrefix(dataLine, "..") {
 					dataLine = dataLine[1:]
 				}
 
+				if truncated {
+					if config.DataLineOverflow != "wrap" {
+						writeDataReply(writer, lmtp, rcptTo, "500 5.5.1", fmt.Sprintf("Line too long (max %d bytes)", config.MaxDataLineLength))
+						logger.Warn("Message rejected: DATA line too long", "max", config.MaxDataLineLength, "remote", conn.RemoteAddr())
+						drainData(reader, atLineStart)
+						mailFrom = ""
+						rcptTo = nil
+						messageRejected = true
+						break
+					}
+					// Wrap: terminate this chunk, the remainder becomes the next line. A CRLF
+					// split by the limit stays together instead of adding a line break.
+					if strings.HasSuffix(dataLine, "\r") && reader.skipSplitLF() {
+						dataLine += "\n"
+						atLineStart = true
+					} else {
+						dataLine += "\r\n"
+					}
+				}
+
+				if inHeaders {
+					if lineStart && strings.TrimRight(dataLine, "\r\n") == "" {
+						inHeaders = false
+					} else {
+						headerSize += int64(len(dataLine))
+					}
+				}
+				if inHeaders && config.MaxHeaderBytes > 0 && headerSize > config.MaxHeaderBytes {
+					writeDataReply(writer, lmtp, rcptTo, "552 5.3.4", fmt.Sprintf("Message header too large (max %d bytes)", config.MaxHeaderBytes))
+					logger.Warn("Message rejected: header size exceeded", "size", headerSize, "max", config.MaxHeaderBytes, "remote", conn.RemoteAddr())
+					drainData(reader, atLineStart)
+					mailFrom = ""
+					rcptTo = nil
+					messageRejected = true
+					break
+				}
+
 				messageSize += int64(len(dataLine))
-				if messageSize > config.MaxMessageSize {
-					fmt.Fprintf(writer, "552 5.3.4 Message too large (max %d bytes)\r\n", config.MaxMessageSize)
-					writer.Flush()
-					logger.Warn("Message rejected: size exceeded", "size", messageSize, "max", config.MaxMessageSize)
+				if messageSize > maxSize {
+					writeDataReply(writer, lmtp, rcptTo, "552 5.3.4", fmt.Sprintf("Message too large (max %d bytes)", maxSize))
+					logger.Warn("Message rejected: size exceeded", "size", messageSize, "max", maxSize, "username", username)
 					// Drain remaining data to keep connection in sync
-					for {
-						drainLine, err := reader.ReadString('\n')
-						if err != nil || strings.TrimSpace(drainLine) == "." {
-							break
-						}
-					}
+					drainData(reader, atLineStart)
 					// Reset for next message attempt
 					mailFrom = ""
 					rcptTo = nil
-					messageTooLarge = true
+					messageRejected = true
 					break
 				}
 				dataBuffer.WriteString(dataLine)
 			}
 
-			if messageTooLarge {
+			if messageRejected {
 				continue
 			}
 
 			// Reconstruct message and normalize line endings for MIME parsing
-			msg := dataBuffer.String()
-			msg = strings.ReplaceAll(msg, "\r\n", "\n")
-			msg = strings.ReplaceAll(msg, "\r", "\n")
-			msg = strings.ReplaceAll(msg, "\n", "\r\n")
+			msg := normalizeLineEndings(dataBuffer.String())
+			// The DATA stream is 8-bit clean either way: bytes reach the MIME parser
+			// unchanged and each part is decoded by its own Content-Type charset
+			if bodyType != "8BITMIME" && hasEightBitData(msg) {
+				logger.Debug("8-bit data without BODY=8BITMIME, passing through unchanged", "body", bodyType, "username", username)
+			}
 
-			// Parse subject, body, CC, BCC, and attachments
-			subject, body, isHTML, attachments, ccAddrs, bccAddrs, parseErr := parseSubjectBodyAndAttachments(msg)
+			// Root span for this message; token fetch and Graph send are children
+			spanCtx, span := tracer.Start(context.Background(), "smtp.message", trace.WithAttributes(
+				attribute.String("smtp.username", username),
+				attribute.Int("smtp.recipients", len(rcptTo)),
+				attribute.Int64("smtp.message_size", messageSize),
+				attribute.String("smtp.body", bodyType),
+			))
+
+			// Parse subject, body, CC, BCC, and attachments; raw_passthrough only reads the headers
+			parse := parseSubjectBodyAndAttachments
+			if config.RawPassthrough {
+				parse = parseRawPassthrough
+			}
+			pm, parseErr := parse(msg)
 			if parseErr != nil {
-				fmt.Fprintf(writer, "550 5.6.0 Message format error\r\n")
-				writer.Flush()
+				endSpan(span, parseErr)
+				writeDataReply(writer, lmtp, rcptTo, "550 5.6.0", "Message format error")
 				logger.Error("MIME parsing failed", "error", parseErr)
 				return
 			}
 
+			if len(rcptTo) == 0 {
+				// derive_recipients_from_headers: no RCPT TO was given
+				rcpts, code, text := headerRecipients(pm)
+				if rcpts == nil {
+					endSpan(span, fmt.Errorf("no envelope recipients: %s", text))
+					writeDataReply(writer, lmtp, rcptTo, code, text)
+					logger.Warn("Message rejected: recipients from headers", "reason", text, "username", username, "remote", conn.RemoteAddr())
+					mailFrom = ""
+					continue
+				}
+				logger.Info("No RCPT TO, using recipients from message headers", "rcptTo", strings.Join(rcpts, ","), "username", username)
+				rcptTo = rcpts
+			}
+
+			if addr := disallowedHeaderRecipient(pm); addr != "" {
+				endSpan(span, fmt.Errorf("header recipient %q outside allowed domains", addr))
+				writeDataReply(writer, lmtp, rcptTo, "550 5.7.1", "Relaying denied for this recipient")
+				logger.Warn("Message rejected: header recipient domain not allowed", "rcpt", addr, "username", username, "remote", conn.RemoteAddr())
+				mailFrom = ""
+				rcptTo = nil
+				continue
+			}
+
+			if filename := blockedAttachment(pm); filename != "" {
+				endSpan(span, fmt.Errorf("blocked attachment %q", filename))
+				writeDataReply(writer, lmtp, rcptTo, "550 5.7.1", "Attachment type not allowed: "+replyText(filename))
+				logger.Warn("Message rejected: blocked attachment", "filename", filename, "username", username, "remote", conn.RemoteAddr())
+				mailFrom = ""
+				rcptTo = nil
+				continue
+			}
+
+			if config.RejectEmptyBody && isEmptyMessage(pm) {
+				endSpan(span, fmt.Errorf("empty message"))
+				writeDataReply(writer, lmtp, rcptTo, "554 5.6.0", "Empty message")
+				logger.Warn("Message rejected: empty body", "subject", pm.subject, "username", username, "remote", conn.RemoteAddr())
+				mailFrom = ""
+				rcptTo = nil
+				continue
+			}
+
+			if config.AttachPlaintextFallback && pm.rawMIME == "" {
+				addPlaintextFallback(pm)
+			}
+			if config.AddReceivedHeader {
+				pm.headers = append([]messageHeader{{
+					Name:  "X-Received",
+					Value: receivedHeader(heloName, conn.RemoteAddr(), username, anonymous, lmtp, time.Now()),
+				}}, pm.headers...)
+			}
+			// Attachments grow by a third as base64 in the JSON request; refuse here
+			// instead of letting Graph fail the oversized request
+			if size, limit := estimateGraphPayloadSize(rcptTo, pm), maxGraphPayloadSize(); size > limit {
+				endSpan(span, fmt.Errorf("graph payload too large: %d bytes", size))
+				writeDataReply(writer, lmtp, rcptTo, "552 5.3.4", fmt.Sprintf("Message too large for Graph API after base64 encoding of attachments (%d bytes, max %d)", size, limit))
+				logger.Warn("Message rejected: Graph payload too large", "size", size, "max", limit, "attachments", len(pm.attachments), "username", username)
+				mailFrom = ""
+				rcptTo = nil
+				continue
+			}
+
+			// Headers over the forwarding limits: Graph rejects the whole message when it
+			// gets too many, so drop the excess or, with forwarded_header_overflow: reject,
+			// refuse the message when max_forwarded_headers/_bytes is exceeded
+			if forwarded := forwardedHeaders(pm); pm.rawMIME == "" && len(forwarded.dropped) > 0 {
+				if forwarded.overLimit && config.ForwardedHeaderOverflow == "reject" {
+					endSpan(span, fmt.Errorf("forwarded headers over limit"))
+					writeDataReply(writer, lmtp, rcptTo, "552 5.3.4", "Too many or too large message headers")
+					logger.Warn("Message rejected: forwarded headers over limit", "headers", strings.Join(forwarded.dropped, ","), "max_headers", config.MaxForwardedHeaders, "max_bytes", config.MaxForwardedHeaderBytes, "username", username)
+					mailFrom = ""
+					rcptTo = nil
+					continue
+				}
+				logger.Warn("Forwarded headers over limit, dropped", "headers", strings.Join(forwarded.dropped, ","), "max_internet_message_headers", maxInternetMessageHeaders(), "max_headers", config.MaxForwardedHeaders, "max_bytes", config.MaxForwardedHeaderBytes, "username", username)
+			}
+
+			// dedup_window_seconds: acknowledge an identical submission without sending
+			// it again. Drafts are exempt, their reply has to carry the new draft's id.
+			releaseDedup := func() {}
+			if dedupEnabled() && !pm.createDraft {
+				release, ok := claimMessage(messageFingerprint(username, mailFrom, rcptTo, pm, msg), time.Now())
+				if !ok {
+					endSpan(span, nil)
+					writeDataReply(writer, lmtp, rcptTo, "250 2.0.0", "Ok (duplicate suppressed)")
+					logger.Warn("Duplicate message suppressed", append([]any{"username", username, "mailFrom", mailFrom, "subject", pm.subject, "window_seconds", config.DedupWindowSeconds}, recipientAttrs(rcptTo, pm)...)...)
+					mailFrom = ""
+					rcptTo = nil
+					continue
+				}
+				releaseDedup = release
+			}
+
+			if !allowUserMessage(username, time.Now()) {
+				releaseDedup()
+				endSpan(span, fmt.Errorf("rate limit exceeded"))
+				writeDataReply(writer, lmtp, rcptTo, "452 4.5.3", "Rate limit exceeded, try again later")
+				logger.Warn("Message rejected: rate limit exceeded", "username", username, "per_minute", config.MaxMessagesPerUserPerMinute, "per_hour", config.MaxMessagesPerUserPerHour, "remote", conn.RemoteAddr())
+				mailFrom = ""
+				rcptTo = nil
+				continue
+			}
+
 			// Get OAuth2 token and send via Graph API
-			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+			ctx, cancel := context.WithTimeout(spanCtx, sendTimeout(pm))
 			token, err := getCachedOAuth2Token(ctx, username, password)
 			if err != nil {
+				releaseDedup()
+				endSpan(span, err)
 				cancel()
-				fmt.Fprintf(writer, "451 4.7.0 Temporary authentication failure\r\n")
-				writer.Flush()
+				code, text := tokenErrorReply(err)
+				writeDataReply(writer, lmtp, rcptTo, code, text)
 				logger.Error("Failed to get OAuth2 token", "error", err, "username", username)
+				notifyWebhook(newDeliveryEvent(username, mailFrom, rcptTo, pm, err))
 				return
 			}
 
-			if err := sendMailGraphAPI(ctx, token, username, mailFrom, rcptTo, ccAddrs, bccAddrs, subject, body, isHTML, attachments); err != nil {
+			logAttrs := slices.Concat(auditAttrs, recipientAttrs(rcptTo, pm), dsnAttrs(rcptTo, rcptDSN))
+
+			// async_accept: the token proved the credentials, so accept now and let a
+			// background goroutine deliver. Drafts stay synchronous, the reply carries their id.
+			if config.AsyncAccept && !pm.createDraft {
+				if release, ok := tryAcquireAsyncSendSlot(); ok {
+					endSpan(span, nil)
+					cancel()
+					sendAsync(spanCtx, release, token, username, mailFrom, rcptTo, pm, msg, logAttrs)
+					writeDataReply(writer, lmtp, rcptTo, "250 2.0.0", renderSuccessMessage(config.SuccessMessage, "", username))
+					logger.Info("E-mail accepted for background delivery", append([]any{"username", username, "mailFrom", mailFrom, "subject", pm.subject}, logAttrs...)...)
+					messageCount++
+					mailFrom = ""
+					rcptTo = nil
+					continue
+				}
+				logger.Warn("Background send limit reached, sending synchronously", "max", config.MaxAsyncSends, "username", username)
+			}
+
+			messageID, err := sendMessage(ctx, token, username, mailFrom, rcptTo, pm)
+			if err != nil {
+				releaseDedup()
+				endSpan(span, err)
 				cancel()
-				fmt.Fprintf(writer, "550 5.7.0 Delivery failed\r\n")
-				writer.Flush()
-				logger.Error("Failed to send email via Graph API", "error", err, "username", username, "mailFrom", mailFrom, "rcptTo", rcptTo)
+				code, text := sendErrorReply(err)
+				writeDataReply(writer, lmtp, rcptTo, code, text)
+				logger.Error("Failed to send email via Graph API", append([]any{"error", err, "username", username, "mailFrom", mailFrom}, logAttrs...)...)
+				// Keep a copy of permanent failures and of temporary ones (451) that already
+				// used up the retries or the send deadline
+				storeDeadLetter(msg, deadLetterInfo{
+					Timestamp: time.Now(), User: username, From: mailFrom, Recipients: rcptTo, Subject: pm.subject, Error: err.Error(),
+				})
+				notifyWebhook(newDeliveryEvent(username, mailFrom, rcptTo, pm, err))
 				return
 			}
+			endSpan(span, nil)
 			cancel()
 
-			fmt.Fprintf(writer, "250 2.0.0 Ok: queued as graphapi\r\n")
-			writer.Flush()
+			event := newDeliveryEvent(username, mailFrom, rcptTo, pm, nil)
+			if pm.createDraft {
+				writeDataReply(writer, lmtp, rcptTo, "250 2.0.0", "Ok: draft created "+messageID)
+				logger.Info("Draft created", append([]any{"username", username, "mailFrom", mailFrom, "subject", pm.subject, "id", messageID}, logAttrs...)...)
+				event.Status = "draft_created"
+				event.GraphMessageID = messageID
+			} else {
+				writeDataReply(writer, lmtp, rcptTo, "250 2.0.0", renderSuccessMessage(config.SuccessMessage, messageID, username))
+				logger.Info("E-mail sent successfully", append([]any{"username", username, "mailFrom", mailFrom, "subject", pm.subject}, logAttrs...)...)
+			}
+			notifyWebhook(event)
+			messageCount++
 			// Reset for next message
-			logger.Info("E-mail sent successfully", "username", username, "mailFrom", mailFrom, "rcptTo", rcptTo, "subject", subject)
 			mailFrom = ""
 			rcptTo = nil
 			continue
@@ -529,39 +1222,488 @@ func handleSMTPConnection(conn net.Conn) {
 	}
 }
 
-// authenticateUser validates credentials (using fallback if empty) and performs OAuth2 token check.
-// Returns nil on success. On failure, writes the SMTP error response and returns an error.
-func authenticateUser(conn net.Conn, writer *bufio.Writer, username, password *string) error {
-	if *username == "" || *password == "" {
-		if config.FallbackSMTPuser == "" || config.FallbackSMTPpass == "" {
-			fmt.Fprintf(writer, "535 5.7.8 Authentication credentials invalid\r\n")
-			writer.Flush()
-			logger.Error("Authentication failed: no credentials provided")
-			return fmt.Errorf("no credentials")
+// defaultSuccessMessage is the text of the 250 reply after a message was sent
+const defaultSuccessMessage = "Ok: queued as {id}"
+
+// successPlaceholderRe matches {placeholder} tokens in success_message
+var successPlaceholderRe = regexp.MustCompile(`\{[^{}]*\}`)
+
+// validateSuccessMessage checks that success_message fits on one reply line and
+// only uses known placeholders
+func validateSuccessMessage(tmpl string) error {
+	for _, r := range tmpl {
+		if r < 0x20 || r > 0x7e {
+			return fmt.Errorf("only printable ASCII characters are allowed")
 		}
-		logger.Warn("Using fallback credentials - per-user auditing bypassed",
-			"client_ip", conn.RemoteAddr())
-		*username = config.FallbackSMTPuser
-		*password = config.FallbackSMTPpass
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	_, err := getCachedOAuth2Token(ctx, *username, *password)
-	cancel()
-	if err != nil {
-		logger.Error("OAuth2 token retrieval failed", "error", err)
-		fmt.Fprintf(writer, "535 5.7.8 Authentication failed\r\n")
-		writer.Flush()
-		return err
+	for _, p := range successPlaceholderRe.FindAllString(tmpl, -1) {
+		if p != "{id}" && p != "{user}" {
+			return fmt.Errorf("unknown placeholder %s (expected {id} or {user})", p)
+		}
 	}
-	fmt.Fprintf(writer, "235 2.7.0 Authentication successful\r\n")
-	writer.Flush()
-	logger.Debug("User authenticated", "username", *username)
 	return nil
 }
 
-// isValidEmail performs basic email validation
-func isValidEmail(email string) bool {
+// renderSuccessMessage fills success_message: {id} is the Graph message id when
+// Graph returns one ("graphapi" for sendMail, which does not), {user} the sending mailbox
+func renderSuccessMessage(tmpl, id, user string) string {
+	if tmpl == "" {
+		tmpl = defaultSuccessMessage
+	}
+	if id == "" {
+		id = "graphapi"
+	}
+	return strings.NewReplacer("{id}", id, "{user}", user).Replace(tmpl)
+}
+
+// relayHostname names this relay in trace headers
+var relayHostname = func() string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
+	}
+	return "smtpRelay"
+}()
+
+// receivedHeader builds the value of the trace header documenting this hop (RFC 5321
+// section 4.4 Received syntax), including the client IP and the Graph mailbox used.
+func receivedHeader(helo string, remote net.Addr, user string, anonymous, lmtp bool, now time.Time) string {
+	if helo == "" {
+		helo = "unknown"
+	}
+	clientIP := remote.String()
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	protocol := "ESMTPA"
+	switch {
+	case lmtp:
+		protocol = "LMTP"
+	case anonymous:
+		protocol = "ESMTP"
+	}
+	return fmt.Sprintf("from %s ([%s]) by %s with %s (user %s); %s",
+		helo, clientIP, relayHostname, protocol, user, now.Format(time.RFC1123Z))
+}
+
+// writeDataReply writes the reply to the end of DATA. LMTP expects one reply per
+// accepted recipient; the Graph send is per message, so every recipient gets the
+// same code.
+func writeDataReply(writer *bufio.Writer, lmtp bool, rcptTo []string, code, text string) {
+	if !lmtp {
+		fmt.Fprintf(writer, "%s %s\r\n", code, text)
+	} else {
+		for _, rcpt := range rcptTo {
+			fmt.Fprintf(writer, "%s <%s> %s\r\n", code, rcpt, text)
+		}
+	}
+	writer.Flush()
+}
+
+// normalizeLineEndings converts bare CR and LF line endings to CRLF for MIME
+// parsing. The bodies of entities declaring a base64, 8bit or binary
+// Content-Transfer-Encoding are left untouched, both for the message itself and for
+// the parts of a multipart message, so CR/LF bytes inside them reach Graph unmodified.
+func normalizeLineEndings(msg string) string {
+	return normalizeEntity(msg, 0)
+}
+
+// normalizeCRLF converts bare CR and LF line endings to CRLF
+func normalizeCRLF(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// normalizeEntity normalizes a message or MIME part (headers and body) for
+// normalizeLineEndings; multipart bodies are normalized part by part
+func normalizeEntity(msg string, depth int) string {
+	// Locate the blank line ending the headers (CRLF or bare LF terminated); a part
+	// may have no headers at all and start with the blank line
+	headerEnd, sepLen := strings.Index(msg, "\r\n\r\n"), 4
+	if i := strings.Index(msg, "\n\n"); i >= 0 && (headerEnd < 0 || i < headerEnd) {
+		headerEnd, sepLen = i, 2
+	}
+	if strings.HasPrefix(msg, "\r\n") {
+		headerEnd, sepLen = 0, 2
+	} else if strings.HasPrefix(msg, "\n") {
+		headerEnd, sepLen = 0, 1
+	}
+	if headerEnd < 0 || depth > maxMultipartDepth() {
+		return normalizeCRLF(msg)
+	}
+	headers := normalizeCRLF(msg[:headerEnd])
+	body := msg[headerEnd+sepLen:]
+	if headerEnd == 0 {
+		headers, body = "", msg[sepLen:]
+	}
+	m, err := mail.ReadMessage(strings.NewReader(headers + "\r\n\r\n"))
+	if err != nil {
+		return normalizeCRLF(msg)
+	}
+	sep := "\r\n\r\n"
+	if headers == "" {
+		sep = "\r\n"
+	}
+	switch strings.ToLower(strings.TrimSpace(m.Header.Get("Content-Transfer-Encoding"))) {
+	case "base64", "8bit", "binary":
+		return headers + sep + body
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		return headers + sep + normalizeMultipartBody(body, params["boundary"], depth+1)
+	}
+	return headers + sep + normalizeCRLF(body)
+}
+
+// normalizeMultipartBody normalizes the preamble, delimiter lines and epilogue of a
+// multipart body and each part through normalizeEntity. The line break before a
+// delimiter belongs to the delimiter (RFC 2046 §5.1.1), not to the preceding part.
+func normalizeMultipartBody(body, boundary string, depth int) string {
+	delimiter := "--" + boundary
+	var b strings.Builder
+	inPart := false
+	for {
+		i := indexDelimiterLine(body, delimiter)
+		if i < 0 {
+			if inPart {
+				// Missing close delimiter: the rest belongs to the last part
+				b.WriteString(normalizeEntity(body, depth))
+			} else {
+				b.WriteString(normalizeCRLF(body))
+			}
+			return b.String()
+		}
+		content := body[:i]
+		lineBreak := ""
+		if strings.HasSuffix(content, "\n") || strings.HasSuffix(content, "\r") {
+			content = strings.TrimSuffix(strings.TrimSuffix(content, "\n"), "\r")
+			lineBreak = "\r\n"
+		}
+		if inPart {
+			b.WriteString(normalizeEntity(content, depth))
+		} else {
+			b.WriteString(normalizeCRLF(content))
+		}
+		b.WriteString(lineBreak)
+
+		// The delimiter line itself, up to and including its line break
+		line := body[i:]
+		if j := strings.IndexAny(line, "\r\n"); j >= 0 {
+			j++
+			if line[j-1] == '\r' && j < len(line) && line[j] == '\n' {
+				j++
+			}
+			line = line[:j]
+		}
+		body = body[i+len(line):]
+		b.WriteString(normalizeCRLF(line))
+		if strings.HasPrefix(line, delimiter+"--") {
+			// Close delimiter: the rest is the epilogue
+			b.WriteString(normalizeCRLF(body))
+			return b.String()
+		}
+		inPart = true
+	}
+}
+
+// indexDelimiterLine returns the index of the first line of body that starts with
+// delimiter followed by "--", whitespace or the end of the line, or -1
+func indexDelimiterLine(body, delimiter string) int {
+	for offset := 0; ; {
+		i := strings.Index(body[offset:], delimiter)
+		if i < 0 {
+			return -1
+		}
+		i += offset
+		atLineStart := i == 0 || body[i-1] == '\n' || body[i-1] == '\r'
+		rest := body[i+len(delimiter):]
+		if atLineStart && (rest == "" || strings.HasPrefix(rest, "--") || strings.ContainsRune("\r\n \t", rune(rest[0]))) {
+			return i
+		}
+		offset = i + len(delimiter)
+	}
+}
+
+// lineReader reads SMTP lines ending in CRLF, a bare LF or a bare CR. Command lines
+// accept all three, so old scripts piping sendmail-style (LF) and clients ending lines
+// with CR only work like CRLF clients. DATA lines end at a bare CR only for clients
+// whose commands did: elsewhere a CR in the message is content.
+type lineReader struct {
+	*bufio.Reader
+	afterCR bool // the last line ended with a CR that had no buffered byte after it
+	crLines bool // the last command line ended with a bare CR
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	return &lineReader{Reader: bufio.NewReader(r)}
+}
+
+// readCommandLine reads one command line including its line ending
+func (r *lineReader) readCommandLine() (string, error) {
+	line, _, err := r.readLine(0, true)
+	return line, err
+}
+
+// readDataLine reads one DATA line including its line ending. When limit > 0 and the
+// line is longer than limit bytes, only the first limit bytes are returned with
+// truncated=true; the remainder stays in the reader for the next call. This bounds
+// memory use for pathological single-line payloads.
+func (r *lineReader) readDataLine(limit int) (line string, truncated bool, err error) {
+	// The LF of a split CRLF decides whether the DATA command ended in a bare CR
+	if err := r.skipPendingLF(); err != nil {
+		return "", false, err
+	}
+	return r.readLine(limit, r.crLines)
+}
+
+// skipSplitLF consumes the LF of a CRLF whose CR was the last byte of a truncated DATA
+// line and reports whether there was one
+func (r *lineReader) skipSplitLF() bool {
+	next, err := r.Peek(1)
+	if err != nil || next[0] != '\n' {
+		return false
+	}
+	r.Discard(1)
+	return true
+}
+
+// skipPendingLF skips the LF completing a CRLF whose CR ended the last line (afterCR);
+// the line then ended in CRLF after all, so crLines is cleared
+func (r *lineReader) skipPendingLF() error {
+	if !r.afterCR {
+		return nil
+	}
+	r.afterCR = false
+	next, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+	if next[0] == '\n' {
+		r.Discard(1)
+		r.crLines = false
+	}
+	return nil
+}
+
+// readLine reads a line ending at LF (CRLF included) or, with crEnds, at a bare CR.
+// A CR at the end of the buffered input ends the line without waiting for more, so a
+// CR-only client gets its reply; an LF arriving later completes a CRLF and is skipped.
+func (r *lineReader) readLine(limit int, crEnds bool) (line string, truncated bool, err error) {
+	if err := r.skipPendingLF(); err != nil {
+		return "", false, err
+	}
+	var buf []byte
+	for limit <= 0 || len(buf) < limit {
+		// Block until at least one byte is available, then consume what is buffered
+		if _, err := r.Peek(1); err != nil {
+			return string(buf), false, err
+		}
+		n := r.Buffered()
+		if limit > 0 {
+			n = min(n, limit-len(buf))
+		}
+		chunk, _ := r.Peek(n)
+		end := bytes.IndexByte(chunk, '\n')
+		if crEnds {
+			r.crLines = false
+			if i := bytes.IndexByte(chunk, '\r'); i >= 0 && (end < 0 || i+1 < end) {
+				// A CR not directly followed by LF ends the line
+				switch {
+				case i+1 < len(chunk):
+					end, r.crLines = i, true
+				case len(chunk) < r.Buffered():
+					// The CR is the last byte within limit: truncated, any LF follows in the next chunk
+					end = -1
+				default:
+					end, r.crLines, r.afterCR = i, true, true
+				}
+			}
+		}
+		if end >= 0 {
+			buf = append(buf, chunk[:end+1]...)
+			r.Discard(end + 1)
+			return string(buf), false, nil
+		}
+		buf = append(buf, chunk...)
+		r.Discard(n)
+	}
+	return string(buf), true, nil
+}
+
+// drainData discards the rest of a DATA payload up to the terminating "." line
+// to keep the connection in sync after a rejection. atLineStart must be false when
+// the last line read was truncated.
+func drainData(reader *lineReader, atLineStart bool) {
+	for {
+		line, truncated, err := reader.readDataLine(4096)
+		if err != nil {
+			return
+		}
+		if atLineStart && strings.TrimSpace(line) == "." {
+			return
+		}
+		atLineStart = !truncated
+	}
+}
+
+// isTLSConn reports whether the connection is encrypted
+func isTLSConn(conn net.Conn) bool {
+	if x, ok := conn.(*xclientConn); ok {
+		conn = x.Conn
+	}
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
+
+// ehloCapabilities returns the ESMTP extensions advertised in the EHLO response.
+// STARTTLS is offered on cleartext connections when a certificate is configured.
+// With require_tls_for_auth, AUTH is only advertised on encrypted connections.
+func ehloCapabilities(tlsActive bool, maxSize int64) []string {
+	caps := []string{fmt.Sprintf("SIZE %d", maxSize), "8BITMIME"}
+	if tlsServerConfig != nil && !tlsActive {
+		caps = append(caps, "STARTTLS")
+	}
+	if config.EnableXStatus {
+		caps = append(caps, "XSTATUS")
+	}
+	if tlsActive || !config.RequireTLSForAuth {
+		caps = append(caps, "AUTH "+strings.Join(authMechanisms(), " "))
+	}
+	return caps
+}
+
+// supportedAuthMechanisms lists the SMTP AUTH mechanisms implemented by the relay
+var supportedAuthMechanisms = []string{"LOGIN", "PLAIN"}
+
+// authMechanisms returns the enabled AUTH mechanisms (auth_mechanisms, default all supported)
+func authMechanisms() []string {
+	if len(config.AuthMechanisms) == 0 {
+		return supportedAuthMechanisms
+	}
+	return config.AuthMechanisms
+}
+
+// xstatusLines returns the XSTATUS reply: version, open connections, cached tokens and uptime
+func xstatusLines() []string {
+	cached := 0
+	TokenCache.Range(func(_, _ any) bool {
+		cached++
+		return true
+	})
+	return []string{
+		"azureSMTPwithOAuth " + version,
+		fmt.Sprintf("active_connections %d", activeConnections.Load()),
+		fmt.Sprintf("token_cache_size %d", cached),
+		"uptime " + time.Since(startTime).Truncate(time.Second).String(),
+	}
+}
+
+// writeMultiline writes a (possibly multi-line) SMTP reply: "250-first", ..., "250 last"
+func writeMultiline(writer *bufio.Writer, code string, lines []string) {
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(writer, "%s%s%s\r\n", code, sep, l)
+	}
+}
+
+// authAuditAttrs returns the audit attributes for the send logs of a session
+// authenticating with the given credentials (before authenticateUser substitutes the
+// fallback ones): the client address and auth_mode, password or fallback. With
+// log_fallback_client_username, a username supplied without password is kept as
+// client_username, so the fallback path still leaves a trail of who the client claimed to be.
+func authAuditAttrs(conn net.Conn, username, password string) []any {
+	attrs := []any{"remote", conn.RemoteAddr().String()}
+	if username != "" && password != "" {
+		return append(attrs, "auth_mode", "password")
+	}
+	attrs = append(attrs, "auth_mode", "fallback")
+	if config.LogFallbackUsername && username != "" {
+		attrs = append(attrs, "client_username", username)
+	}
+	return attrs
+}
+
+// authenticateUser validates credentials (using fallback if empty) and performs OAuth2 token check.
+// Returns nil on success. On failure, writes the SMTP error response and returns an error.
+func authenticateUser(conn net.Conn, writer *bufio.Writer, username, password *string) error {
+	if *username == "" || *password == "" {
+		if config.FallbackSMTPuser == "" || config.FallbackSMTPpass == "" {
+			fmt.Fprintf(writer, "535 5.7.8 Authentication credentials invalid\r\n")
+			writer.Flush()
+			logger.Error("Authentication failed: no credentials provided")
+			return fmt.Errorf("no credentials")
+		}
+		logger.Warn("Using fallback credentials - per-user auditing bypassed",
+			"client_ip", conn.RemoteAddr())
+		*username = config.FallbackSMTPuser
+		*password = config.FallbackSMTPpass
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	_, err := getCachedOAuth2Token(ctx, *username, *password)
+	cancel()
+	if err != nil {
+		logger.Error("OAuth2 token retrieval failed", append([]any{"error", err, "username", *username, "remote", conn.RemoteAddr().String()}, geoIPAttrs(conn.RemoteAddr())...)...)
+		fmt.Fprintf(writer, "%s\r\n", authErrorReply(err))
+		writer.Flush()
+		return err
+	}
+	if !acquireUserConnection(*username) {
+		logger.Warn("Connection rejected: per-user limit reached", "username", *username, "max", config.MaxConnectionsPerUser, "remote", conn.RemoteAddr())
+		fmt.Fprintf(writer, "421 4.7.0 Too many connections for this user\r\n")
+		writer.Flush()
+		return fmt.Errorf("too many connections for user")
+	}
+	fmt.Fprintf(writer, "235 2.7.0 Authentication successful\r\n")
+	writer.Flush()
+	logger.Debug("User authenticated", append([]any{"username", *username, "remote", conn.RemoteAddr().String()}, geoIPAttrs(conn.RemoteAddr())...)...)
+	return nil
+}
+
+// userConnections tracks active authenticated connections per username
+var userConnections = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// acquireUserConnection reserves a per-user connection slot.
+// Returns false if the user is already at max_connections_per_user (0 = unlimited).
+func acquireUserConnection(username string) bool {
+	if config.MaxConnectionsPerUser <= 0 {
+		return true
+	}
+	key := strings.ToLower(username)
+	userConnections.Lock()
+	defer userConnections.Unlock()
+	if userConnections.counts[key] >= config.MaxConnectionsPerUser {
+		return false
+	}
+	userConnections.counts[key]++
+	return true
+}
+
+// releaseUserConnection frees a slot reserved by acquireUserConnection
+func releaseUserConnection(username string) {
+	if username == "" {
+		return
+	}
+	key := strings.ToLower(username)
+	userConnections.Lock()
+	defer userConnections.Unlock()
+	if n, ok := userConnections.counts[key]; ok {
+		if n <= 1 {
+			delete(userConnections.counts, key)
+		} else {
+			userConnections.counts[key] = n - 1
+		}
+	}
+}
+
+// isValidEmail performs basic email validation
+func isValidEmail(email string) bool {
 	if len(email) > 254 || len(email) == 0 {
 		return false
 	}
@@ -581,12 +1723,219 @@ func isValidEmail(email string) bool {
 	return true
 }
 
+// isRecipientDomainAllowed checks the recipient domain against allowed_recipient_domains.
+// An empty allowlist permits any domain.
+func isRecipientDomainAllowed(addr string) bool {
+	if len(config.AllowedRecipientDomains) == 0 {
+		return true
+	}
+	domain := strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+	for _, d := range config.AllowedRecipientDomains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// headerRecipients returns the To, Cc and Bcc header addresses as envelope recipients
+// (derive_recipients_from_headers), applying the same checks as RCPT TO. On failure
+// the recipients are nil and code/text hold the SMTP reply.
+func headerRecipients(pm *parsedMessage) (rcpts []string, code, text string) {
+	seen := make(map[string]bool)
+	for _, addr := range slices.Concat(pm.toAddrs, pm.ccAddrs, pm.bccAddrs) {
+		if seen[strings.ToLower(addr)] {
+			continue
+		}
+		seen[strings.ToLower(addr)] = true
+		if !isValidEmail(addr) {
+			return nil, "553 5.1.3", "Invalid recipient address " + addr
+		}
+		if !isRecipientDomainAllowed(addr) {
+			return nil, "550 5.7.1", "Relaying denied for recipient " + addr
+		}
+		rcpts = append(rcpts, addr)
+	}
+	if len(rcpts) == 0 {
+		return nil, "554 5.5.1", "No recipients specified"
+	}
+	if len(rcpts) > maxRecipients {
+		return nil, "550 5.5.3", "Too many recipients"
+	}
+	return rcpts, "", ""
+}
+
+// disallowedHeaderRecipient returns the first header address Graph would deliver to that
+// is outside allowed_recipient_domains, or "". Graph adds the Cc and Bcc headers to the
+// recipients, and with raw_passthrough the To header as well.
+func disallowedHeaderRecipient(pm *parsedMessage) string {
+	addrs := slices.Concat(pm.ccAddrs, pm.bccAddrs)
+	if pm.rawMIME != "" {
+		addrs = append(addrs, pm.toAddrs...)
+	}
+	for _, addr := range addrs {
+		if !isRecipientDomainAllowed(addr) {
+			return addr
+		}
+	}
+	return ""
+}
+
+// transactionCommand reports whether line is MAIL FROM, RCPT TO or DATA, the commands
+// refused after recipient_overflow: reject_transaction failed the transaction
+func transactionCommand(line string) bool {
+	upper := strings.ToUpper(line)
+	return strings.HasPrefix(upper, "MAIL FROM:") || strings.HasPrefix(upper, "RCPT TO:") || strings.HasPrefix(upper, "DATA")
+}
+
+// parseMailParams returns the ESMTP parameters following the address of a MAIL FROM
+// or RCPT TO command (e.g. SIZE=1024 BODY=8BITMIME), keyed by upper-case name
+func parseMailParams(line string) map[string]string {
+	var rest string
+	if end := strings.Index(line, ">"); end != -1 {
+		rest = line[end+1:]
+	} else if parts := strings.SplitN(line, ":", 2); len(parts) == 2 {
+		if fields := strings.Fields(parts[1]); len(fields) > 1 {
+			rest = strings.Join(fields[1:], " ")
+		}
+	}
+	params := make(map[string]string)
+	for _, field := range strings.Fields(rest) {
+		key, value, _ := strings.Cut(field, "=")
+		params[strings.ToUpper(key)] = value
+	}
+	return params
+}
+
+// hasEightBitData reports whether s contains bytes outside 7-bit ASCII
+func hasEightBitData(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// isNullSender reports whether a MAIL FROM command carries the null reverse-path <> (or "< >")
+func isNullSender(line string) bool {
+	_, rest, ok := strings.Cut(line, ":")
+	rest = strings.TrimSpace(rest)
+	if !ok || !strings.HasPrefix(rest, "<") {
+		return false
+	}
+	end := strings.Index(rest, ">")
+	return end != -1 && strings.TrimSpace(rest[1:end]) == ""
+}
+
+// mailAuthIdentity returns the address from the AUTH= parameter of a MAIL FROM
+// command (RFC 4954, xtext-encoded), or "" when absent, <> or not a valid address
+func mailAuthIdentity(line string) string {
+	value, ok := parseMailParams(line)["AUTH"]
+	if !ok {
+		return ""
+	}
+	identity, err := decodeXtext(value)
+	if err != nil {
+		return ""
+	}
+	identity = strings.TrimSuffix(strings.TrimPrefix(identity, "<"), ">")
+	if identity == "" || !isValidEmail(identity) {
+		return ""
+	}
+	return identity
+}
+
+// decodeXtext decodes RFC 3461 xtext ("+XX" hex escapes)
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("truncated xtext escape")
+		}
+		v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid xtext escape %q", s[i:i+3])
+		}
+		b.WriteByte(byte(v))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// parsePrefix parses a CIDR (192.0.2.0/24) or a single IP address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// isTrustedMTA reports whether the client address is within trusted_mta_cidrs
+func isTrustedMTA(remote net.Addr) bool {
+	return addrInCIDRs(remote, config.TrustedMTACIDRs)
+}
+
+// addrInCIDRs reports whether remote is a TCP address within one of cidrs
+func addrInCIDRs(remote net.Addr, cidrs []string) bool {
+	if len(cidrs) == 0 {
+		return false
+	}
+	tcpAddr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, cidr := range cidrs {
+		if prefix, err := parsePrefix(cidr); err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxMessageSizeFor returns the message size limit of a user: the user_map
+// override when set, otherwise max_message_size
+func maxMessageSizeFor(username string) int64 {
+	if settings, ok := config.UserMap[strings.ToLower(username)]; ok && settings.MaxMessageSize > 0 {
+		return settings.MaxMessageSize
+	}
+	return config.MaxMessageSize
+}
+
+// advertisedMaxSize is the SIZE announced in EHLO. Before AUTH the user is unknown,
+// so the largest limit of any user is announced (clients must not be refused up
+// front) and the actual per-user limit is enforced at MAIL FROM and DATA.
+func advertisedMaxSize(username string) int64 {
+	if username != "" {
+		return maxMessageSizeFor(username)
+	}
+	size := config.MaxMessageSize
+	for _, settings := range config.UserMap {
+		size = max(size, settings.MaxMessageSize)
+	}
+	return size
+}
+
 // extractAddress extracts the email address from SMTP command line
 func extractAddress(line string) string {
 	start := strings.Index(line, "<")
 	end := strings.Index(line, ">")
 	if start != -1 && end != -1 && end > start {
-		return line[start+1 : end]
+		// Tolerate whitespace inside the brackets: "< >" is the null sender like "<>"
+		return strings.TrimSpace(line[start+1 : end])
 	}
 	// fallback: try after colon
 	parts := strings.SplitN(line, ":", 2)
@@ -607,10 +1956,69 @@ type Attachment struct {
 	Filename    string
 	ContentType string
 	Content     string // base64-encoded
-	IsInline    bool   // true for inline images (Content-Disposition: inline)
+	IsInline    bool   // true for inline images (Content-Disposition: inline, or referenced by cid: from HTML)
 	ContentID   string // Content-ID header value (without angle brackets)
 }
 
+// attachmentDecodeFailureMode returns the attachment_decode_failure mode;
+// strict_attachments is the older spelling of "fail"
+func attachmentDecodeFailureMode() string {
+	if config.AttachmentDecodeFailure != "" {
+		return config.AttachmentDecodeFailure
+	}
+	if config.StrictAttachments {
+		return "fail"
+	}
+	return "skip"
+}
+
+// blockedAttachment returns the name of the first attachment whose extension is in
+// blocked_attachment_extensions, or "" when all attachments are allowed. Trailing
+// dots and spaces are ignored, as Windows does when saving the file.
+func blockedAttachment(pm *parsedMessage) string {
+	if len(config.BlockedAttachmentExtensions) == 0 {
+		return ""
+	}
+	for _, att := range pm.attachments {
+		name := strings.ToLower(strings.TrimRight(att.Filename, ". \t"))
+		for _, ext := range config.BlockedAttachmentExtensions {
+			if strings.HasSuffix(name, ext) {
+				return att.Filename
+			}
+		}
+	}
+	return ""
+}
+
+// replyText makes client-supplied text safe for an SMTP reply line: anything but
+// printable ASCII (CR/LF included) becomes '?'
+func replyText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// sniffAttachmentContentType reports whether sniff_attachment_content_type is enabled (default true)
+func sniffAttachmentContentType() bool {
+	return config.SniffAttachmentContentType == nil || *config.SniffAttachmentContentType
+}
+
+// placeholderAttachment is sent in place of an attachment that could not be decoded
+func placeholderAttachment(filename string) Attachment {
+	if filename == "" {
+		filename = "attachment"
+	}
+	text := fmt.Sprintf("The attachment %q could not be decoded and was removed by the mail relay.\r\n", filename)
+	return Attachment{
+		Filename:    filename + ".txt",
+		ContentType: "text/plain; charset=utf-8",
+		Content:     base64.StdEncoding.EncodeToString([]byte(text)),
+	}
+}
+
 // parsedContent holds the accumulated results of recursive multipart parsing
 type parsedContent struct {
 	textBody    string
@@ -619,14 +2027,38 @@ type parsedContent struct {
 	partCount   int
 }
 
+// reportPartNames names the machine-readable parts of multipart/report messages
+// (RFC 6522). They are kept as attachments so a relayed DSN stays complete,
+// instead of overwriting the human-readable body.
+var reportPartNames = map[string]string{
+	"message/delivery-status":          "delivery-status.txt",
+	"message/disposition-notification": "disposition-notification.txt",
+	"message/feedback-report":          "feedback-report.txt",
+	"message/rfc822":                   "original-message.eml",
+	"text/rfc822-headers":              "original-headers.txt",
+}
+
+// defaultMaxMultipartDepth is the max_multipart_depth default
+const defaultMaxMultipartDepth = 10
+
+// maxMultipartDepth returns max_multipart_depth, or the default when unset
+func maxMultipartDepth() int {
+	if config.MaxMultipartDepth <= 0 {
+		return defaultMaxMultipartDepth
+	}
+	return config.MaxMultipartDepth
+}
+
 // processMultipart recursively parses a multipart reader and accumulates
 // body text, HTML, and attachments into the parsedContent struct.
-func processMultipart(mr *multipart.Reader, result *parsedContent, depth int) error {
+// depth is the nesting level of mr (0 = the message body); report is set when mr
+// is a multipart/report (DSN/MDN) or nested inside one.
+func processMultipart(mr *multipart.Reader, result *parsedContent, depth int, report bool) error {
 	const maxParts = 100 // Prevent infinite loops from malformed multipart
-	const maxDepth = 10  // Prevent deeply nested multipart abuse
 
-	if depth > maxDepth {
-		logger.Warn("Multipart nesting depth exceeded", "max", maxDepth)
+	// Deeply nested multipart abuse: parts below the limit are ignored, not parsed
+	if maxDepth := maxMultipartDepth(); depth > maxDepth {
+		logger.Warn("Multipart nesting depth exceeded, ignoring nested parts", "max", maxDepth, "depth", depth)
 		return nil
 	}
 
@@ -656,7 +2088,7 @@ func processMultipart(mr *multipart.Reader, result *parsedContent, depth int) er
 			innerBoundary := partParams["boundary"]
 			if innerBoundary != "" {
 				innerReader := multipart.NewReader(p, innerBoundary)
-				if err := processMultipart(innerReader, result, depth+1); err != nil {
+				if err := processMultipart(innerReader, result, depth+1, report || partMediaType == "multipart/report"); err != nil {
 					return err
 				}
 				continue
@@ -671,12 +2103,18 @@ func processMultipart(mr *multipart.Reader, result *parsedContent, depth int) er
 			contentID = strings.TrimSuffix(contentID, ">")
 		}
 
-		isAttachment := strings.HasPrefix(disposition, "attachment")
-		isInline := strings.HasPrefix(disposition, "inline") &&
-			contentID != "" &&
-			!strings.HasPrefix(partMediaType, "text/")
+		// A part is an attachment if its disposition is "attachment", or "inline" on a
+		// non-text part (an image or file). Text parts without "attachment" are body,
+		// even with a filename. Inline parts with a Content-ID are referenced from HTML.
+		dispositionType := strings.ToLower(strings.TrimSpace(strings.SplitN(disposition, ";", 2)[0]))
+		isText := partMediaType == "" || strings.HasPrefix(partMediaType, "text/")
+		isAttachment := dispositionType == "attachment" || (dispositionType == "inline" && !isText)
+		isInline := dispositionType == "inline" && !isText && contentID != ""
+
+		reportName, isReportPart := reportPartNames[partMediaType]
+		isReportPart = isReportPart && report
 
-		if isAttachment || isInline {
+		if isAttachment || isReportPart {
 			filename := p.FileName()
 			// Try to extract filename from Content-Type if still empty
 			if filename == "" {
@@ -687,10 +2125,13 @@ func processMultipart(mr *multipart.Reader, result *parsedContent, depth int) er
 					}
 				}
 			}
-			// Generate a default filename for inline images without one
-			if filename == "" && isInline {
+			// Generate a default filename for parts with a Content-ID and report parts without one
+			if filename == "" && contentID != "" {
 				filename = contentID
 			}
+			if filename == "" && isReportPart {
+				filename = reportName
+			}
 			ctype := partCT
 			if ctype == "" {
 				ctype = "application/octet-stream"
@@ -698,25 +2139,37 @@ func processMultipart(mr *multipart.Reader, result *parsedContent, depth int) er
 			attCTE := strings.ToLower(p.Header.Get("Content-Transfer-Encoding"))
 			dataContent, decErr := decodeMessage(attCTE, p)
 			if decErr != nil {
-				if config.StrictAttachments {
+				switch attachmentDecodeFailureMode() {
+				case "fail":
 					return fmt.Errorf("failed to decode attachment %q: %w", filename, decErr)
+				case "placeholder":
+					logger.Warn("Failed to decode attachment, sending placeholder", "filename", filename, "error", decErr)
+					result.attachments = append(result.attachments, placeholderAttachment(filename))
+				default:
+					logger.Warn("Failed to decode attachment, skipping", "filename", filename, "error", decErr)
 				}
-				logger.Warn("Failed to decode attachment, skipping", "filename", filename, "error", decErr)
 				continue
 			}
 			if filename == "" || ctype == "" || len(dataContent) == 0 {
 				logger.Warn("Invalid attachment detected, skipping", "filename", filename, "contentType", ctype, "dataLength", len(dataContent))
 				continue
 			}
+			// Untyped or generic attachments get the type detected from their content
+			if (partMediaType == "" || partMediaType == "application/octet-stream") && sniffAttachmentContentType() {
+				if detected := http.DetectContentType(dataContent); detected != "application/octet-stream" {
+					logger.Debug("Attachment content type detected", "filename", filename, "declared", partCT, "detected", detected)
+					ctype = detected
+				}
+			}
 			att := Attachment{
 				Filename:    filename,
 				ContentType: ctype,
 				Content:     base64.StdEncoding.EncodeToString(dataContent),
 			}
-			if isInline {
-				att.IsInline = true
-				att.ContentID = contentID
-			}
+			// The Content-ID is kept regardless of disposition, so an attachment the HTML
+			// body references by cid: can still be made inline (markReferencedInline)
+			att.ContentID = contentID
+			att.IsInline = isInline
 			result.attachments = append(result.attachments, att)
 		} else {
 			// Body part (text/plain or text/html)
@@ -726,9 +2179,12 @@ func processMultipart(mr *multipart.Reader, result *parsedContent, depth int) er
 				logger.Warn("Failed to decode body part", "error", decErr)
 				continue
 			}
+			// In a report, the first human-readable part is the body
 			if strings.Contains(strings.ToLower(partCT), "html") {
-				result.htmlBody = string(dataContent)
-			} else {
+				if !report || result.htmlBody == "" {
+					result.htmlBody = string(dataContent)
+				}
+			} else if !report || result.textBody == "" {
 				result.textBody = string(dataContent)
 			}
 		}
@@ -736,6 +2192,22 @@ func processMultipart(mr *multipart.Reader, result *parsedContent, depth int) er
 	return nil
 }
 
+// recipientAttrs returns log attributes for the recipients of a message: rcptTo
+// (the envelope, which Graph delivers to) and the to/cc/bcc header addresses, each
+// as a comma-separated string that is easy to grep and split. Empty categories are omitted.
+func recipientAttrs(rcptTo []string, pm *parsedMessage) []any {
+	attrs := []any{"rcptTo", strings.Join(rcptTo, ",")}
+	for _, c := range []struct {
+		key   string
+		addrs []string
+	}{{"to", pm.toAddrs}, {"cc", pm.ccAddrs}, {"bcc", pm.bccAddrs}} {
+		if len(c.addrs) > 0 {
+			attrs = append(attrs, c.key, strings.Join(c.addrs, ","))
+		}
+	}
+	return attrs
+}
+
 // parseAddressList parses a comma-separated list of email addresses from a header value
 func parseAddressList(header string) []string {
 	if header == "" {
@@ -752,27 +2224,259 @@ func parseAddressList(header string) []string {
 	return result
 }
 
+// parseDisplayNames returns the display names found in the given address list
+// headers, keyed by lower-cased address (e.g. "Jane Doe" <jane@example.com>)
+func parseDisplayNames(headers ...string) map[string]string {
+	names := make(map[string]string)
+	for _, header := range headers {
+		if header == "" {
+			continue
+		}
+		addrs, err := mail.ParseAddressList(header)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if name := strings.TrimSpace(a.Name); name != "" {
+				names[strings.ToLower(a.Address)] = name
+			}
+		}
+	}
+	return names
+}
+
+// graphRecipient builds a Graph recipient, with the display name from the message headers when known
+func graphRecipient(addr string, pm *parsedMessage) map[string]map[string]string {
+	emailAddress := map[string]string{"address": addr}
+	if name := pm.displayNames[strings.ToLower(addr)]; name != "" {
+		emailAddress["name"] = name
+	}
+	return map[string]map[string]string{"emailAddress": emailAddress}
+}
+
+// parsedMessage holds the fields extracted from a raw SMTP message
+type parsedMessage struct {
+	subject       string
+	body          string
+	isHTML        bool
+	hasText       bool // a text/plain alternative existed (dropped in favor of HTML)
+	attachments   []Attachment
+	toAddrs       []string
+	displayNames  map[string]string // lower-cased address -> display name from To/Cc/Bcc
+	ccAddrs       []string
+	bccAddrs      []string
+	categories    []string        // Outlook categories from the X-Categories header
+	createDraft   bool            // X-Create-Draft: true - save to Drafts instead of sending
+	sensitivity   int             // Sensitivity header as MAPI PR_SENSITIVITY (0 = normal)
+	autoSubmitted string          // Auto-Submitted header value (RFC 3834), "" when absent or "no"
+	listHeaders   []messageHeader // List-* headers (RFC 2369, 2919, 8058) for forward_list_headers
+	messageID     string          // Message-ID sent as internetMessageId (message_id_domain only)
+	headers       []messageHeader
+	rawMIME       string // raw_passthrough: the message as received, sent to Graph as MIME
+}
+
+// messageHeader is a custom header sent to Graph in internetMessageHeaders
+type messageHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// parseCategories splits a comma-separated X-Categories header value
+func parseCategories(header string) []string {
+	var categories []string
+	for _, c := range strings.Split(header, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			categories = append(categories, c)
+		}
+	}
+	return categories
+}
+
+// sensitivityValues maps Sensitivity header values (RFC 2156) to MAPI PR_SENSITIVITY
+var sensitivityValues = map[string]int{
+	"personal":             1,
+	"private":              2,
+	"company-confidential": 3,
+}
+
+// sensitivityProperty is the Graph extended property id of PR_SENSITIVITY. Graph
+// has no sensitivity field on messages and only accepts X- headers in
+// internetMessageHeaders, so the header is forwarded as this MAPI property.
+const sensitivityProperty = "Integer 0x0036"
+
+// parseSensitivity returns the PR_SENSITIVITY value of a Sensitivity header, 0 for
+// a missing, "Normal" or unknown value
+func parseSensitivity(header string) int {
+	header = strings.ToLower(strings.TrimSpace(header))
+	if header == "" || header == "normal" {
+		return 0
+	}
+	v, ok := sensitivityValues[header]
+	if !ok {
+		logger.Debug("Unknown Sensitivity header value, ignored", "value", header)
+	}
+	return v
+}
+
+// parseAutoSubmitted returns the Auto-Submitted value (RFC 3834) lower-cased, or ""
+// when the header is missing or "no" (sent by a human)
+func parseAutoSubmitted(header string) string {
+	value := strings.ToLower(strings.TrimSpace(strings.SplitN(header, ";", 2)[0]))
+	if value == "no" {
+		return ""
+	}
+	return value
+}
+
+// isValidMessageIDDomain reports whether domain can be the right-hand side of a
+// generated Message-ID: dot-separated labels of letters, digits and hyphens
+func isValidMessageIDDomain(domain string) bool {
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// newMessageID returns a Message-ID (RFC 5322) with a random left-hand side in the
+// message_id_domain, e.g. <3f2a...@relay.example.com>
+func newMessageID() string {
+	b := make([]byte, 16)
+	cryptorand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + config.MessageIDDomain + ">"
+}
+
+// isEmptyMessage reports whether pm has neither body text (whitespace aside) nor
+// attachments, for reject_empty_body. raw_passthrough messages are not parsed and
+// never count as empty.
+func isEmptyMessage(pm *parsedMessage) bool {
+	return pm.rawMIME == "" && strings.TrimSpace(pm.body) == "" && len(pm.attachments) == 0
+}
+
+// isAutoSubmitted reports whether pm is automated mail: it carries Auto-Submitted,
+// or add_auto_submitted marks every message as auto-generated
+func isAutoSubmitted(pm *parsedMessage) bool {
+	return pm.autoSubmitted != "" || config.AddAutoSubmitted
+}
+
+// autoResponseSuppress asks Exchange and Outlook not to send auto-replies (out of
+// office, read receipts) to automated mail. Graph only accepts X- headers in
+// internetMessageHeaders, so Auto-Submitted itself cannot be forwarded.
+var autoResponseSuppress = messageHeader{Name: "X-Auto-Response-Suppress", Value: "All"}
+
+// internetHeadersProperty is the Graph extended property id prefix of a named property
+// in the PS_INTERNET_HEADERS set; Exchange writes such properties into the sent message
+// as headers. Graph only accepts X- headers in internetMessageHeaders, so List-*
+// headers are forwarded this way.
+const internetHeadersProperty = "String {00020386-0000-0000-C000-000000000046} Name "
+
+// parseListHeaders returns the List-* headers of a message, sorted by name
+func parseListHeaders(h mail.Header) []messageHeader {
+	var headers []messageHeader
+	for name, values := range h {
+		if !strings.HasPrefix(strings.ToLower(name), "list-") || len(values) == 0 {
+			continue
+		}
+		headers = append(headers, messageHeader{Name: name, Value: values[0]})
+	}
+	slices.SortFunc(headers, func(a, b messageHeader) int { return strings.Compare(a.Name, b.Name) })
+	return headers
+}
+
+// dropMalformedHeaderLines removes the lines of the header block (up to the first
+// blank line) that are neither "Name: value" fields nor continuation lines, for
+// lenient_header_parsing. It returns the repaired message and the dropped lines.
+func dropMalformedHeaderLines(msg string) (string, []string) {
+	var b strings.Builder
+	var dropped []string
+	keptField := false // a continuation line belongs to the last kept field
+	rest := msg
+	for rest != "" {
+		line, next, found := strings.Cut(rest, "\n")
+		if found {
+			line += "\n"
+		}
+		content := strings.TrimRight(line, "\r\n")
+		if content == "" {
+			break // end of headers, the rest is the body
+		}
+		name, _, hasColon := strings.Cut(content, ":")
+		switch {
+		case content[0] == ' ' || content[0] == '\t':
+			if !keptField {
+				dropped = append(dropped, content)
+				rest = next
+				continue
+			}
+		case hasColon && isValidHeaderName(name):
+			keptField = true
+		default:
+			dropped = append(dropped, content)
+			keptField = false
+			rest = next
+			continue
+		}
+		b.WriteString(line)
+		rest = next
+	}
+	b.WriteString(rest)
+	return b.String(), dropped
+}
+
 // parseSubjectBodyAndAttachments parses the subject, body, CC, BCC, and attachments from a raw SMTP message
-func parseSubjectBodyAndAttachments(msg string) (subject, body string, isHTML bool, attachments []Attachment, ccAddrs, bccAddrs []string, err error) {
+func parseSubjectBodyAndAttachments(msg string) (*parsedMessage, error) {
 	// Ensure message ends with a newline for robust parsing
 	if !strings.HasSuffix(msg, "\n") {
 		msg += "\n"
 	}
-	r := strings.NewReader(msg)
-	m, err := mail.ReadMessage(r)
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil && config.LenientHeaderParsing {
+		if repaired, dropped := dropMalformedHeaderLines(msg); len(dropped) > 0 {
+			logger.Warn("Ignoring malformed header lines (lenient_header_parsing)", "lines", dropped)
+			m, err = mail.ReadMessage(strings.NewReader(repaired))
+		}
+	}
 	if err != nil {
-		return "", "", false, nil, nil, nil, fmt.Errorf("mail.ReadMessage failed: %w", err)
+		return nil, fmt.Errorf("mail.ReadMessage failed: %w", err)
 	}
+	pm := &parsedMessage{}
 	wd := new(mime.WordDecoder)
 	subjectRaw := m.Header.Get("Subject")
-	subject, err = wd.DecodeHeader(subjectRaw)
+	pm.subject, err = wd.DecodeHeader(subjectRaw)
 	if err != nil {
-		subject = subjectRaw // fallback to raw if decode fails
+		pm.subject = subjectRaw // fallback to raw if decode fails
+	}
+
+	// Parse To, CC and BCC headers
+	pm.toAddrs = parseAddressList(m.Header.Get("To"))
+	pm.ccAddrs = parseAddressList(m.Header.Get("Cc"))
+	pm.bccAddrs = parseAddressList(m.Header.Get("Bcc"))
+	pm.displayNames = parseDisplayNames(m.Header.Get("To"), m.Header.Get("Cc"), m.Header.Get("Bcc"))
+
+	if categoriesRaw := m.Header.Get("X-Categories"); categoriesRaw != "" {
+		if decoded, decErr := wd.DecodeHeader(categoriesRaw); decErr == nil {
+			categoriesRaw = decoded
+		}
+		pm.categories = parseCategories(categoriesRaw)
 	}
 
-	// Parse CC and BCC headers
-	ccAddrs = parseAddressList(m.Header.Get("Cc"))
-	bccAddrs = parseAddressList(m.Header.Get("Bcc"))
+	pm.createDraft = strings.EqualFold(strings.TrimSpace(m.Header.Get("X-Create-Draft")), "true")
+	pm.sensitivity = parseSensitivity(m.Header.Get("Sensitivity"))
+	pm.autoSubmitted = parseAutoSubmitted(m.Header.Get("Auto-Submitted"))
+	if config.ForwardListHeaders {
+		pm.listHeaders = parseListHeaders(m.Header)
+	}
+	if config.MessageIDDomain != "" {
+		if pm.messageID = strings.TrimSpace(m.Header.Get("Message-Id")); pm.messageID == "" {
+			pm.messageID = newMessageID()
+		}
+	}
 
 	ct := m.Header.Get("Content-Type")
 	cte := strings.ToLower(m.Header.Get("Content-Transfer-Encoding"))
@@ -781,37 +2485,122 @@ func parseSubjectBodyAndAttachments(msg string) (subject, body string, isHTML bo
 	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
 		mr := multipart.NewReader(m.Body, params["boundary"])
 		result := &parsedContent{}
-		if err := processMultipart(mr, result, 0); err != nil {
-			return "", "", false, nil, nil, nil, fmt.Errorf("multipart parsing failed: %w", err)
+		if err := processMultipart(mr, result, 0, mediaType == "multipart/report"); err != nil {
+			return nil, fmt.Errorf("multipart parsing failed: %w", err)
 		}
 		// Prefer HTML body over plain text
 		if result.htmlBody != "" {
-			body = result.htmlBody
-			isHTML = true
+			pm.body = result.htmlBody
+			pm.isHTML = true
+			pm.hasText = result.textBody != ""
 		} else {
-			body = result.textBody
+			pm.body = result.textBody
+		}
+		pm.attachments = result.attachments
+		if pm.isHTML {
+			markReferencedInline(pm.body, pm.attachments)
+			pm.body = checkCIDReferences(pm.body, pm.attachments)
 		}
-		return subject, body, isHTML, result.attachments, ccAddrs, bccAddrs, nil
+		return pm, nil
 	}
 	// Not multipart: fallback to old logic
 	if strings.Contains(strings.ToLower(ct), "html") {
-		isHTML = true
+		pm.isHTML = true
 	}
 	dataContent, decErr := decodeMessage(cte, m.Body)
 	if decErr != nil {
-		return "", "", false, nil, nil, nil, fmt.Errorf("failed to decode message body: %w", decErr)
+		return nil, fmt.Errorf("failed to decode message body: %w", decErr)
+	}
+	pm.body = string(dataContent)
+	if pm.isHTML {
+		pm.body = checkCIDReferences(pm.body, nil)
 	}
 
-	return subject, string(dataContent), isHTML, nil, ccAddrs, bccAddrs, nil
+	return pm, nil
 }
 
+var (
+	// cidRefRe matches a cid: URL (RFC 2392) in an HTML attribute value
+	cidRefRe = regexp.MustCompile(`(?i)\bcid:([^"'\s>)]+)`)
+	// cidImgRe matches an <img> tag whose src is a cid: URL
+	cidImgRe = regexp.MustCompile(`(?is)<img\b[^>]*?\bsrc\s*=\s*["']?cid:([^"'\s>]+)[^>]*>`)
+)
+
+// markReferencedInline marks attachments whose Content-ID is referenced by a cid: URL
+// in the HTML body as inline. Some clients send images the body displays with
+// Content-Disposition: attachment; like Outlook, the relay shows them in place.
+func markReferencedInline(html string, attachments []Attachment) {
+	refs := make(map[string]bool)
+	for _, m := range cidRefRe.FindAllStringSubmatch(html, -1) {
+		ref := m[1]
+		if unescaped, err := url.PathUnescape(ref); err == nil {
+			ref = unescaped
+		}
+		refs[strings.ToLower(ref)] = true
+	}
+	for i := range attachments {
+		if att := &attachments[i]; !att.IsInline && att.ContentID != "" && refs[strings.ToLower(att.ContentID)] {
+			logger.Debug("Attachment referenced from HTML body, sending it inline", "filename", att.Filename, "contentId", att.ContentID)
+			att.IsInline = true
+		}
+	}
+}
+
+// checkCIDReferences logs cid: references in an HTML body that match no inline
+// attachment's Content-ID. With strip_dangling_cid_images, <img> tags with such
+// a reference are removed from the returned body.
+func checkCIDReferences(html string, attachments []Attachment) string {
+	if !strings.Contains(strings.ToLower(html), "cid:") {
+		return html
+	}
+	contentIDs := make(map[string]bool)
+	for _, att := range attachments {
+		if att.IsInline && att.ContentID != "" {
+			contentIDs[strings.ToLower(att.ContentID)] = true
+		}
+	}
+	isDangling := func(ref string) bool {
+		if unescaped, err := url.PathUnescape(ref); err == nil {
+			ref = unescaped
+		}
+		return !contentIDs[strings.ToLower(ref)]
+	}
+
+	var dangling []string
+	for _, m := range cidRefRe.FindAllStringSubmatch(html, -1) {
+		if isDangling(m[1]) && !slices.Contains(dangling, m[1]) {
+			dangling = append(dangling, m[1])
+		}
+	}
+	if len(dangling) == 0 {
+		return html
+	}
+	if !config.StripDanglingCIDImages {
+		logger.Warn("HTML body references inline images that are not attached", "cids", dangling)
+		return html
+	}
+	logger.Warn("Removing HTML images that reference missing inline attachments", "cids", dangling)
+	return cidImgRe.ReplaceAllStringFunc(html, func(tag string) string {
+		if isDangling(cidImgRe.FindStringSubmatch(tag)[1]) {
+			return ""
+		}
+		return tag
+	})
+}
+
+// decodeMessage decodes a body by its Content-Transfer-Encoding. The value is
+// matched case-insensitively and without surrounding whitespace (left over from
+// header folding); unknown encodings are passed through undecoded.
 func decodeMessage(c string, r io.Reader) (content []byte, err error) {
-	switch c {
+	switch cte := strings.ToLower(strings.TrimSpace(c)); cte {
 	case "base64":
 		content, err = io.ReadAll(base64.NewDecoder(base64.StdEncoding, r))
 	case "quoted-printable":
 		content, err = io.ReadAll(quotedprintable.NewReader(r))
+	case "", "7bit", "8bit", "binary":
+		content, err = io.ReadAll(r)
 	default:
+		logger.Debug("Unknown Content-Transfer-Encoding, content not decoded", "encoding", cte)
 		content, err = io.ReadAll(r)
 	}
 	if err != nil {
@@ -820,21 +2609,124 @@ func decodeMessage(c string, r io.Reader) (content []byte, err error) {
 	return content, nil
 }
 
-// sendMailGraphAPI sends the email via Microsoft Graph API /sendMail with retry logic
-func sendMailGraphAPI(ctx context.Context, token, sender, mailFrom string, rcptTo, ccAddrs, bccAddrs []string, subject, body string, isHTML bool, attachments []Attachment) error {
-	graphURL := "https://graph.microsoft.com/v1.0/users/" + url.PathEscape(sender) + "/sendMail"
+// isStrippedHeader reports whether strip_headers keeps the header out of the Graph payload
+func isStrippedHeader(name string) bool {
+	for _, h := range config.StripHeaders {
+		if strings.EqualFold(strings.TrimSpace(h), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxHeaderValueLength caps a forwarded header value (RFC 5322 line length limit)
+const maxHeaderValueLength = 998
+
+// isValidHeaderName reports whether name is a valid RFC 5322 field name
+// (printable ASCII without spaces or colons)
+func isValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeHeaderValue prepares a value for internetMessageHeaders: CR, LF and other
+// control characters become spaces (so a crafted value cannot inject headers), runs
+// of whitespace are collapsed and the result is truncated to maxHeaderValueLength
+func sanitizeHeaderValue(value string) string {
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == '\t' || r < 0x20 || r == 0x7f
+	}), " ")
+	if len(value) > maxHeaderValueLength {
+		value = strings.ToValidUTF8(value[:maxHeaderValueLength], "")
+	}
+	return value
+}
+
+// defaultMaxInternetMessageHeaders is the default max_internet_message_headers, the
+// number of internetMessageHeaders Graph accepts on a message (more fail with 400)
+const defaultMaxInternetMessageHeaders = 5
+
+// maxInternetMessageHeaders returns max_internet_message_headers, or the default when unset
+func maxInternetMessageHeaders() int {
+	if config.MaxInternetMessageHeaders <= 0 {
+		return defaultMaxInternetMessageHeaders
+	}
+	return config.MaxInternetMessageHeaders
+}
+
+// forwardedHeaderSet holds the headers of a message that reach Graph
+type forwardedHeaderSet struct {
+	headers    []messageHeader // sent in internetMessageHeaders
+	properties []messageHeader // sent as PS_INTERNET_HEADERS named properties (List-*)
+	dropped    []string        // names of the headers dropped by the limits
+	overLimit  bool            // max_forwarded_headers or max_forwarded_header_bytes dropped headers
+}
+
+// forwardedHeaders returns the headers buildGraphMessage forwards: strip_headers and
+// invalid names are left out and values are sanitized. The limits are applied in
+// order, relay headers (internetMessageHeaders) before the List-* headers:
+// max_internet_message_headers only counts internetMessageHeaders, while
+// max_forwarded_headers and max_forwarded_header_bytes (name plus value) count both.
+func forwardedHeaders(pm *parsedMessage) forwardedHeaderSet {
+	var set forwardedHeaderSet
+	var count, size int
+	accept := func(h messageHeader, graphLimited bool) (messageHeader, bool) {
+		if isStrippedHeader(h.Name) || !isValidHeaderName(h.Name) {
+			return h, false
+		}
+		h.Value = sanitizeHeaderValue(h.Value)
+		switch {
+		case graphLimited && len(set.headers) >= maxInternetMessageHeaders():
+		case config.MaxForwardedHeaders > 0 && count >= config.MaxForwardedHeaders,
+			config.MaxForwardedHeaderBytes > 0 && size+len(h.Name)+len(h.Value) > config.MaxForwardedHeaderBytes:
+			set.overLimit = true
+		default:
+			count++
+			size += len(h.Name) + len(h.Value)
+			return h, true
+		}
+		set.dropped = append(set.dropped, h.Name)
+		return h, false
+	}
+
+	msgHeaders := pm.headers
+	if isAutoSubmitted(pm) {
+		msgHeaders = append(slices.Clone(msgHeaders), autoResponseSuppress)
+	}
+	for _, h := range msgHeaders {
+		if h, ok := accept(h, true); ok {
+			set.headers = append(set.headers, h)
+		}
+	}
+	for _, h := range pm.listHeaders {
+		if h, ok := accept(h, false); ok {
+			set.properties = append(set.properties, h)
+		}
+	}
+	return set
+}
+
+// buildGraphMessage builds the Graph API message resource for the given envelope and parsed content
+func buildGraphMessage(mailFrom string, rcptTo []string, pm *parsedMessage) map[string]interface{} {
 	contentType := "text"
-	if isHTML {
+	if pm.isHTML {
 		contentType = "html"
 	}
 
 	// Build a set of CC and BCC addresses to exclude from To recipients
 	ccSet := make(map[string]bool)
-	for _, addr := range ccAddrs {
+	for _, addr := range pm.ccAddrs {
 		ccSet[strings.ToLower(addr)] = true
 	}
 	bccSet := make(map[string]bool)
-	for _, addr := range bccAddrs {
+	for _, addr := range pm.bccAddrs {
 		bccSet[strings.ToLower(addr)] = true
 	}
 
@@ -844,24 +2736,18 @@ func sendMailGraphAPI(ctx context.Context, token, sender, mailFrom string, rcptT
 		if ccSet[strings.ToLower(addr)] || bccSet[strings.ToLower(addr)] {
 			continue
 		}
-		toRecipients = append(toRecipients, map[string]map[string]string{
-			"emailAddress": {"address": addr},
-		})
+		toRecipients = append(toRecipients, graphRecipient(addr, pm))
 	}
 	var ccRecipients []map[string]map[string]string
-	for _, addr := range ccAddrs {
-		ccRecipients = append(ccRecipients, map[string]map[string]string{
-			"emailAddress": {"address": addr},
-		})
+	for _, addr := range pm.ccAddrs {
+		ccRecipients = append(ccRecipients, graphRecipient(addr, pm))
 	}
 	var bccRecipients []map[string]map[string]string
-	for _, addr := range bccAddrs {
-		bccRecipients = append(bccRecipients, map[string]map[string]string{
-			"emailAddress": {"address": addr},
-		})
+	for _, addr := range pm.bccAddrs {
+		bccRecipients = append(bccRecipients, graphRecipient(addr, pm))
 	}
 	var graphAttachments []map[string]interface{}
-	for _, att := range attachments {
+	for _, att := range pm.attachments {
 		graphAtt := map[string]interface{}{
 			"@odata.type":  "#microsoft.graph.fileAttachment",
 			"name":         att.Filename,
@@ -870,6 +2756,8 @@ func sendMailGraphAPI(ctx context.Context, token, sender, mailFrom string, rcptT
 		}
 		if att.IsInline {
 			graphAtt["isInline"] = true
+		}
+		if att.ContentID != "" {
 			graphAtt["contentId"] = att.ContentID
 		}
 		graphAttachments = append(graphAttachments, graphAtt)
@@ -878,10 +2766,10 @@ func sendMailGraphAPI(ctx context.Context, token, sender, mailFrom string, rcptT
 		graphAttachments = make([]map[string]interface{}, 0)
 	}
 	message := map[string]interface{}{
-		"subject": subject,
+		"subject": pm.subject,
 		"body": map[string]string{
 			"contentType": contentType,
-			"content":     body,
+			"content":     pm.body,
 		},
 		"toRecipients": toRecipients,
 		"from": map[string]map[string]string{
@@ -895,41 +2783,189 @@ func sendMailGraphAPI(ctx context.Context, token, sender, mailFrom string, rcptT
 	if len(bccRecipients) > 0 {
 		message["bccRecipients"] = bccRecipients
 	}
-	msg := map[string]interface{}{
-		"message":         message,
-		"saveToSentItems": config.SaveToSent,
+	// Categories are applied to the sender's copy of the message, so they only
+	// have a visible effect when save_to_sent stores that copy in Sent Items.
+	if len(pm.categories) > 0 {
+		message["categories"] = pm.categories
+	}
+	forwarded := forwardedHeaders(pm)
+	var properties []map[string]string
+	if pm.sensitivity > 0 {
+		properties = append(properties, map[string]string{"id": sensitivityProperty, "value": strconv.Itoa(pm.sensitivity)})
+	}
+	for _, h := range forwarded.properties {
+		properties = append(properties, map[string]string{"id": internetHeadersProperty + h.Name, "value": h.Value})
+	}
+	if len(properties) > 0 {
+		message["singleValueExtendedProperties"] = properties
 	}
+	// Message-ID is not an X- header, so Graph only takes it as internetMessageId
+	if pm.messageID != "" {
+		message["internetMessageId"] = pm.messageID
+	}
+	if len(forwarded.headers) > 0 {
+		message["internetMessageHeaders"] = forwarded.headers
+	}
+	return message
+}
+
+// defaultMaxGraphPayloadSize is the default max_graph_payload_size (Exchange Online message size limit)
+const defaultMaxGraphPayloadSize = 35 * 1024 * 1024
 
-	jsonBody, err := json.Marshal(msg)
+// maxGraphPayloadSize returns max_graph_payload_size, or the default when unset
+func maxGraphPayloadSize() int64 {
+	if config.MaxGraphPayloadSize <= 0 {
+		return defaultMaxGraphPayloadSize
+	}
+	return config.MaxGraphPayloadSize
+}
+
+// estimateGraphPayloadSize returns an upper estimate of the Graph JSON request size:
+// the body, the base64 attachment content and a fixed allowance per field for JSON
+// syntax. It is computed before the request is marshaled.
+func estimateGraphPayloadSize(rcptTo []string, pm *parsedMessage) int64 {
+	const jsonOverhead = 128 // keys, quotes and braces of one recipient, attachment or header
+	if pm.rawMIME != "" {
+		return int64(base64.StdEncoding.EncodedLen(len(rawMIMEMessage(rcptTo, pm))))
+	}
+	size := int64(4*jsonOverhead + len(pm.subject) + len(pm.body))
+	for _, addr := range rcptTo {
+		size += int64(len(addr) + jsonOverhead)
+	}
+	for _, att := range pm.attachments {
+		size += int64(len(att.Content) + len(att.Filename) + len(att.ContentType) + len(att.ContentID) + jsonOverhead)
+	}
+	for _, h := range pm.headers {
+		size += int64(len(h.Name) + len(h.Value) + jsonOverhead)
+	}
+	return size
+}
+
+// graphMailboxPath returns the Graph path of the sending mailbox. With use_me_endpoint
+// it is /me, the token's own user, which avoids UPN vs. email address mismatches.
+func graphMailboxPath(sender string) string {
+	if config.UseMeEndpoint {
+		return "/me"
+	}
+	return "/users/" + url.PathEscape(sender)
+}
+
+// sendMessage delivers an accepted message; protocol tests replace it to run full
+// SMTP conversations without a Graph endpoint
+var sendMessage = sendMailGraphAPI
+
+// sendMailGraphAPI sends the email via Microsoft Graph API /sendMail with retry logic.
+// When the message asks for a draft (X-Create-Draft), it is created in the sender's
+// Drafts folder via /messages instead and the draft id is returned.
+func sendMailGraphAPI(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (messageID string, err error) {
+	ctx, span := tracer.Start(ctx, "graph.sendMail", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
+	release, err := acquireGraphRequestSlot(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal email message: %w", err)
+		return "", err
+	}
+	defer release()
+
+	graphURL := graphBaseURL + graphMailboxPath(sender) + "/sendMail"
+	if pm.createDraft {
+		graphURL = graphBaseURL + graphMailboxPath(sender) + "/messages"
+		span.SetAttributes(attribute.Bool("graph.draft", true))
+	}
+
+	var jsonBody []byte
+	contentType := "application/json"
+	if pm.rawMIME != "" {
+		// raw_passthrough: both endpoints accept a base64 MIME message as text/plain
+		jsonBody = []byte(base64.StdEncoding.EncodeToString([]byte(rawMIMEMessage(rcptTo, pm))))
+		contentType = "text/plain"
+		span.SetAttributes(attribute.Bool("graph.mime", true))
+		if config.DebugGraphIO {
+			logger.Debug("Graph API request", "method", "POST", "url", graphURL, "bytes", len(jsonBody), "body", "<MIME message elided>")
+		}
+	} else {
+		message := buildGraphMessage(mailFrom, rcptTo, pm)
+		// Send on Behalf: Outlook shows "sender on behalf of from" only when both are set
+		if config.SetSenderOnBehalf && !strings.EqualFold(sender, mailFrom) {
+			message["sender"] = map[string]map[string]string{
+				"emailAddress": {"address": sender},
+			}
+		}
+		var payload interface{} = map[string]interface{}{
+			"message":         message,
+			"saveToSentItems": config.SaveToSent,
+		}
+		if pm.createDraft {
+			payload = message
+		}
+		if jsonBody, err = json.Marshal(payload); err != nil {
+			return "", fmt.Errorf("failed to marshal email message: %w", err)
+		}
+		logGraphRequest("POST", graphURL, jsonBody)
+	}
+
+	// Compressed once: doWithRetry sends the same (gzipped) bytes on every attempt
+	compressed := false
+	if config.CompressRequests && len(jsonBody) > compressRequestThreshold {
+		if gz, err := gzipBytes(jsonBody); err != nil {
+			logger.Warn("Failed to compress Graph request, sending uncompressed", "error", err)
+		} else {
+			logger.Debug("Compressed Graph request", "bytes", len(jsonBody), "compressed", len(gz))
+			jsonBody = gz
+			compressed = true
+		}
 	}
 
 	request, err := http.NewRequestWithContext(ctx, "POST", graphURL, bytes.NewReader(jsonBody))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 	request.Header.Set("Authorization", "Bearer "+token)
-	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("User-Agent", userAgent())
+	if compressed {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
 
 	// Use retry logic for Graph API calls
-	resp, err := doWithRetry(ctx, graphHTTPClient, request, jsonBody, getRetryConfig())
+	resp, err := doWithRetry(ctx, graphClient(), request, jsonBody, getRetryConfig())
+	logGraphResponse(resp)
 	if err != nil {
 		if resp != nil {
+			// Retries exhausted on a retryable status: keep the status for the caller
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+			err = fmt.Errorf("%w (%w)", err, newGraphError(resp))
 			resp.Body.Close()
 		}
-		return fmt.Errorf("Graph API call failed after retries: %w", err)
+		return "", fmt.Errorf("Graph API call failed after retries: %w", err)
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	// /sendMail answers 202 (accepted, delivered asynchronously); /messages answers
+	// 201 with the created draft; /send and some proxies answer 200 or 204
+	switch code := resp.StatusCode; {
+	case code == http.StatusAccepted:
+		logger.Debug("Graph API accepted message for delivery", "status", code)
+	case code == http.StatusOK || code == http.StatusCreated || code == http.StatusNoContent:
+		logger.Debug("Graph API request succeeded", "status", code)
+	case code >= 200 && code < 300:
+		// Treated as success: failing it would make the client resend a message Graph took
+		logger.Warn("Unexpected Graph API success status, treating as delivered", "status", code)
+	default:
+		return "", newGraphError(resp)
+	}
 
-	if resp.StatusCode >= 300 {
-		b, readErr := io.ReadAll(resp.Body)
-		if readErr != nil {
-			return fmt.Errorf("Graph API error (status %d, failed to read body: %v)", resp.StatusCode, readErr)
+	if pm.createDraft {
+		var draft struct {
+			ID string `json:"id"`
 		}
-		return fmt.Errorf("Graph API error (status %d): %s", resp.StatusCode, string(b))
+		if err := json.NewDecoder(resp.Body).Decode(&draft); err != nil {
+			return "", fmt.Errorf("failed to decode draft response: %w", err)
+		}
+		return draft.ID, nil
 	}
-	return nil
+	return "", nil
 }
 
 // decodeBase64WithError decodes base64 and returns error instead of empty string
@@ -947,38 +2983,72 @@ func decodeBase64WithError(s string) (string, error) {
 
 // getCachedOAuth2Token returns a cached token or fetches a new one if expired
 // Uses singleflight to prevent duplicate concurrent fetches for the same user
-func getCachedOAuth2Token(ctx context.Context, username, password string) (string, error) {
+func getCachedOAuth2Token(ctx context.Context, username, password string) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "oauth2.token")
+	defer func() { endSpan(span, err) }()
+
 	// Check cache first
 	if val, ok := TokenCache.Load(username); ok {
 		tok := val.(cachedToken)
-		if time.Now().Before(tok.expiresAt) {
+		if tok.usable(time.Now()) {
+			span.SetAttributes(attribute.Bool("oauth2.cache_hit", true))
+			tokenStats.hits.Add(1)
 			logger.Debug("Using cached OAuth2 token", "username", username, "expires_at", tok.expiresAt)
 			return tok.token, nil
 		}
 	}
+	tokenStats.misses.Add(1)
+	span.SetAttributes(attribute.Bool("oauth2.cache_hit", false))
 
 	// Use singleflight to deduplicate concurrent fetches for same user
-	result, err, _ := tokenFetchGroup.Do(username, func() (interface{}, error) {
+	result, err, shared := tokenFetchGroup.Do(username, func() (interface{}, error) {
 		// Double-check cache (another goroutine may have populated it)
+		var prev cachedToken
 		if val, ok := TokenCache.Load(username); ok {
-			tok := val.(cachedToken)
-			if time.Now().Before(tok.expiresAt) {
-				return tok.token, nil
+			prev = val.(cachedToken)
+			if prev.usable(time.Now()) {
+				return prev.token, nil
 			}
 		}
 
-		token, expiresIn, err := getOAuth2TokenWithExpiry(ctx, username, password)
+		release, err := acquireTenantTokenSlot(ctx, config.OAuth2Config.TenantID)
+		if err != nil {
+			return "", err
+		}
+		tokenStats.fetches.Add(1)
+		var tok oauth2Token
+		if prev.canRefresh(password) {
+			if tok, err = refreshOAuth2Token(ctx, username, prev.refreshToken); err != nil {
+				logger.Warn("OAuth2 refresh token grant failed, using password grant", "username", username, "error", err)
+			} else if tok.refreshToken == "" {
+				tok.refreshToken = prev.refreshToken
+			}
+		}
+		if tok.accessToken == "" {
+			tok, err = passwordOAuth2Token(ctx, username, password)
+		}
+		release()
 		if err != nil {
 			return "", err
 		}
 
-		TokenCache.Store(username, cachedToken{
-			token:     token,
-			expiresAt: time.Now().Add(time.Duration(max(expiresIn-60, 30)) * time.Second), // refresh 1 min before expiry, minimum 30s cache
-		})
-		logger.Debug("New OAuth2 token cached", "username", username, "expires_in", expiresIn)
-		return token, nil
+		entry := cachedToken{
+			token:        tok.accessToken,
+			expiresAt:    time.Now().Add(tokenCacheTTL(tok.expiresIn)),
+			cachedAt:     time.Now(),
+			refreshToken: tok.refreshToken,
+		}
+		if entry.refreshToken != "" {
+			entry.passwordMAC = passwordMAC(password)
+		}
+		TokenCache.Store(username, entry)
+		logger.Debug("New OAuth2 token cached", "username", username, "expires_in", tok.expiresIn, "refresh_token", tok.refreshToken != "")
+		return tok.accessToken, nil
 	})
+	if shared {
+		tokenStats.shared.Add(1)
+		logger.Debug("OAuth2 token fetch shared with concurrent request", "username", username)
+	}
 
 	if err != nil {
 		return "", err
@@ -986,70 +3056,195 @@ func getCachedOAuth2Token(ctx context.Context, username, password string) (strin
 	return result.(string), nil
 }
 
+var (
+	graphRequestSemMu sync.Mutex
+	graphRequestSem   chan struct{} // sized by max_concurrent_graph_requests
+)
+
+// acquireGraphRequestSlot waits for one of max_concurrent_graph_requests slots, so a
+// burst of connections doesn't hit Graph (and exhaust the idle connection pool) all
+// at once. Waiting ends with ctx; the returned function frees the slot.
+func acquireGraphRequestSlot(ctx context.Context) (func(), error) {
+	graphRequestSemMu.Lock()
+	limit := max(config.MaxConcurrentGraphRequests, 1)
+	if cap(graphRequestSem) != limit {
+		graphRequestSem = make(chan struct{}, limit)
+	}
+	sem := graphRequestSem
+	graphRequestSemMu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	default:
+	}
+	logger.Debug("Graph request queued: concurrency limit reached", "max", cap(sem))
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for Graph request slot: %w", ctx.Err())
+	}
+}
+
+// acquireTenantTokenSlot waits for a free token request slot of the tenant so bursts
+// of fetches for different users don't trip Azure AD throttling. Waiting ends with
+// ctx; the returned function frees the slot.
+func acquireTenantTokenSlot(ctx context.Context, tenant string) (func(), error) {
+	val, _ := tenantTokenSems.LoadOrStore(tenant, make(chan struct{}, max(config.MaxTokenRequestsPerTenant, 1)))
+	sem := val.(chan struct{})
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	default:
+	}
+	logger.Debug("Token request queued: tenant limit reached", "tenant", tenant, "max", cap(sem))
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for token request slot: %w", ctx.Err())
+	}
+}
+
+// tokenCacheTTL returns how long a token valid for expiresIn seconds is served from
+// cache: token_refresh_skew_seconds less than its lifetime, with a 30s minimum to
+// avoid refetch storms, but never beyond the lifetime itself.
+func tokenCacheTTL(expiresIn int) time.Duration {
+	ttl := min(max(expiresIn-config.TokenRefreshSkewSeconds, 30), expiresIn)
+	return time.Duration(ttl) * time.Second
+}
+
+// defaultTokenEndpoint is the Azure AD v2.0 token endpoint, {tenant} is replaced by tenant_id
+const defaultTokenEndpoint = "https://login.microsoftonline.com/{tenant}/oauth2/v2.0/token"
+
+// tokenEndpointURL returns the token endpoint (token_endpoint or the Azure AD default) for the configured tenant
+func tokenEndpointURL() string {
+	endpoint := config.OAuth2Config.TokenEndpoint
+	if endpoint == "" {
+		endpoint = defaultTokenEndpoint
+	}
+	return strings.ReplaceAll(endpoint, "{tenant}", config.OAuth2Config.TenantID)
+}
+
+// oauth2Token is a successful token endpoint response
+type oauth2Token struct {
+	accessToken  string
+	refreshToken string // only issued when the scopes include offline_access
+	expiresIn    int    // seconds
+}
+
 // getOAuth2TokenWithExpiry returns token and expiry (in seconds)
 func getOAuth2TokenWithExpiry(ctx context.Context, username, password string) (string, int, error) {
+	tok, err := passwordOAuth2Token(ctx, username, password)
+	return tok.accessToken, tok.expiresIn, err
+}
+
+// passwordOAuth2Token requests a token with the password (ROPC) grant
+func passwordOAuth2Token(ctx context.Context, username, password string) (oauth2Token, error) {
+	params := url.Values{}
+	params.Set("username", username)
+	params.Set("password", password)
+	params.Set("grant_type", "password")
+	return requestOAuth2Token(ctx, username, params)
+}
+
+// refreshOAuth2Token renews a token with the refresh_token grant, without the password
+func refreshOAuth2Token(ctx context.Context, username, refreshToken string) (oauth2Token, error) {
+	params := url.Values{}
+	params.Set("refresh_token", refreshToken)
+	params.Set("grant_type", "refresh_token")
+	return requestOAuth2Token(ctx, username, params)
+}
+
+// requestOAuth2Token posts a grant (params) with the client credentials and scopes to
+// the token endpoint
+func requestOAuth2Token(ctx context.Context, username string, params url.Values) (oauth2Token, error) {
 	// Add timeout to context if not already present
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	tokenURL := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", config.OAuth2Config.TenantID)
+	tokenURL := tokenEndpointURL()
 
-	params := url.Values{}
 	params.Set("client_id", config.OAuth2Config.ClientID)
 	params.Set("scope", strings.Join(config.OAuth2Config.Scopes, " "))
-	params.Set("username", username)
-	params.Set("password", password)
-	params.Set("grant_type", "password")
 	params.Set("client_secret", config.OAuth2Config.ClientSecret)
 
 	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(params.Encode()))
 	if err != nil {
-		return "", 0, fmt.Errorf("failed to create token request: %w", err)
+		return oauth2Token{}, fmt.Errorf("failed to create token request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent())
+	injectTraceContext(ctx, req)
 
 	resp, err := authHTTPClient.Do(req)
 	if err != nil {
-		return "", 0, fmt.Errorf("token request failed: %w", err)
+		return oauth2Token{}, fmt.Errorf("token request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	var result struct {
-		AccessToken string `json:"access_token"`
-		ExpiresIn   int    `json:"expires_in"`
-		Error       string `json:"error"`
-		ErrorDesc   string `json:"error_description"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		Error        string `json:"error"`
+		ErrorDesc    string `json:"error_description"`
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", 0, fmt.Errorf("failed to read token response: %w", err)
+		return oauth2Token{}, fmt.Errorf("failed to read token response: %w", err)
 	}
 
 	if err := json.Unmarshal(body, &result); err != nil {
-		return "", 0, fmt.Errorf("failed to parse token response: %w", err)
+		return oauth2Token{}, fmt.Errorf("failed to parse token response: %w", err)
 	}
 
 	// Check for OAuth error
 	if result.Error != "" {
-		return "", 0, fmt.Errorf("OAuth2 error: %s - %s", result.Error, result.ErrorDesc)
+		oauthErr := &OAuthError{StatusCode: resp.StatusCode, Code: result.Error, Description: result.ErrorDesc}
+		if hint := oauthErr.Hint(); hint != "" {
+			logger.Error("Azure AD policy blocks password (ROPC) sign-in for this account", "username", username, "code", oauthErr.AADSTSCode(), "hint", hint)
+		}
+		return oauth2Token{}, oauthErr
 	}
 
 	// Check if access token is present
 	if result.AccessToken == "" {
-		return "", 0, fmt.Errorf("no access token in response (status %d)", resp.StatusCode)
+		return oauth2Token{}, fmt.Errorf("no access token in response (status %d)", resp.StatusCode)
 	}
 
-	logger.Debug("OAuth2 token retrieved", "username", username, "expires_in", result.ExpiresIn)
-	return result.AccessToken, result.ExpiresIn, nil
+	logger.Debug("OAuth2 token retrieved", "username", username, "grant_type", params.Get("grant_type"), "expires_in", result.ExpiresIn)
+	return oauth2Token{accessToken: result.AccessToken, refreshToken: result.RefreshToken, expiresIn: result.ExpiresIn}, nil
+}
+
+// PrefetchFallbackToken fetches and caches a token for fallback_smtp_user
+// (prefetch_token_on_start), so the first message does not wait for Azure AD and
+// credential problems show up in the log at startup. Failures are only logged.
+func PrefetchFallbackToken(ctx context.Context) {
+	if config.FallbackSMTPuser == "" || config.FallbackSMTPpass == "" {
+		logger.Warn("prefetch_token_on_start is enabled but fallback_smtp_user/fallback_smtp_pass are not set, skipping")
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := getCachedOAuth2Token(ctx, config.FallbackSMTPuser, config.FallbackSMTPpass); err != nil {
+		logger.Warn("Token prefetch failed, check oauth2_config and fallback credentials", "error", err, "username", config.FallbackSMTPuser)
+		return
+	}
+	logger.Info("Token prefetched", "username", config.FallbackSMTPuser, "duration_ms", time.Since(start).Milliseconds())
 }
 
 // StartTokenCacheCleanup starts a background goroutine to clean expired tokens.
+// Token cache statistics are logged on each tick when there was activity.
 // The goroutine stops when the provided context is cancelled.
 func StartTokenCacheCleanup(ctx context.Context, interval time.Duration) {
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
+		var lastHits, lastMisses int64
 
 		for {
 			select {
@@ -1061,7 +3256,11 @@ func StartTokenCacheCleanup(ctx context.Context, interval time.Duration) {
 
 				TokenCache.Range(func(key, value interface{}) bool {
 					tok := value.(cachedToken)
-					if now.After(tok.expiresAt) {
+					expiresAt := tok.expiresAt
+					if tok.refreshToken != "" {
+						expiresAt = expiresAt.Add(refreshTokenLifetime)
+					}
+					if now.After(expiresAt) {
 						TokenCache.Delete(key)
 						deleted++
 					}
@@ -1071,6 +3270,16 @@ func StartTokenCacheCleanup(ctx context.Context, interval time.Duration) {
 				if deleted > 0 {
 					logger.Debug("Token cache cleanup completed", "deleted", deleted)
 				}
+
+				hits, misses := tokenStats.hits.Load(), tokenStats.misses.Load()
+				if hits != lastHits || misses != lastMisses {
+					logger.Info("Token cache statistics",
+						"hits", hits,
+						"misses", misses,
+						"fetches", tokenStats.fetches.Load(),
+						"shared_fetches", tokenStats.shared.Load())
+					lastHits, lastMisses = hits, misses
+				}
 			}
 		}
 	}()
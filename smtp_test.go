@@ -3,26 +3,40 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log/slog"
 	"mime/multipart"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // initTestConfig sets up global config and logger for SMTP handler tests
 func initTestConfig(allowAnonymous bool) {
 	config = &tConfig{
-		ListenAddr:        "127.0.0.1:2526",
-		FallbackSMTPuser:  "fallback@example.com",
-		FallbackSMTPpass:  "fallbackpass",
-		AllowAnonymous:    allowAnonymous,
-		MaxMessageSize:    25 * 1024 * 1024,
-		MaxConnections:    100,
-		ConnectionTimeout: 300,
-		RetryAttempts:     3,
-		RetryInitialDelay: 500,
+		ListenAddr:         "127.0.0.1:2526",
+		FallbackSMTPuser:   "fallback@example.com",
+		FallbackSMTPpass:   "fallbackpass",
+		AllowAnonymous:     allowAnonymous,
+		MaxMessageSize:     25 * 1024 * 1024,
+		MaxConnections:     100,
+		ConnectionTimeout:  300,
+		ReadTimeoutSeconds: 60,
+		RetryAttempts:      3,
+		RetryInitialDelay:  500,
 		OAuth2Config: tOAuth2Config{
 			ClientID:     "test-client-id",
 			ClientSecret: "test-secret",
@@ -39,13 +53,23 @@ func readResponse(reader *bufio.Reader) string {
 	return strings.TrimRight(line, "\r\n")
 }
 
+// readMultiline reads a complete (possibly multi-line) SMTP reply
+func readMultiline(reader *bufio.Reader) []string {
+	var lines []string
+	for {
+		line := readResponse(reader)
+		lines = append(lines, line)
+		if len(line) < 4 || line[3] != '-' {
+			return lines
+		}
+	}
+}
+
 func TestAnonymousAccess_Allowed(t *testing.T) {
 	initTestConfig(true)
 
 	client, server := net.Pipe()
-	defer client.Close()
-
-	go handleSMTPConnection(server)
+	defer startHandler(client, server, handleSMTPConnection)()
 
 	reader := bufio.NewReader(client)
 
@@ -57,8 +81,7 @@ func TestAnonymousAccess_Allowed(t *testing.T) {
 
 	// Send EHLO
 	client.Write([]byte("EHLO test\r\n"))
-	resp = readResponse(reader) // 250-smtpRelay
-	readResponse(reader)        // 250 AUTH LOGIN PLAIN
+	readMultiline(reader) // 250-smtpRelay, 250-SIZE, 250 AUTH LOGIN PLAIN
 
 	// Send MAIL FROM without authenticating
 	client.Write([]byte("MAIL FROM:<sender@example.com>\r\n"))
@@ -85,9 +108,7 @@ func TestAnonymousAccess_Denied(t *testing.T) {
 	initTestConfig(false)
 
 	client, server := net.Pipe()
-	defer client.Close()
-
-	go handleSMTPConnection(server)
+	defer startHandler(client, server, handleSMTPConnection)()
 
 	reader := bufio.NewReader(client)
 
@@ -99,8 +120,7 @@ func TestAnonymousAccess_Denied(t *testing.T) {
 
 	// Send EHLO
 	client.Write([]byte("EHLO test\r\n"))
-	readResponse(reader) // 250-smtpRelay
-	readResponse(reader) // 250 AUTH LOGIN PLAIN
+	readMultiline(reader) // 250-smtpRelay, 250-SIZE, 250 AUTH LOGIN PLAIN
 
 	// Send MAIL FROM without authenticating - should be rejected
 	client.Write([]byte("MAIL FROM:<sender@example.com>\r\n"))
@@ -120,9 +140,7 @@ func TestAnonymousAccess_DeniedWhenNoFallbackCredentials(t *testing.T) {
 	config.FallbackSMTPpass = ""
 
 	client, server := net.Pipe()
-	defer client.Close()
-
-	go handleSMTPConnection(server)
+	defer startHandler(client, server, handleSMTPConnection)()
 
 	reader := bufio.NewReader(client)
 
@@ -131,8 +149,7 @@ func TestAnonymousAccess_DeniedWhenNoFallbackCredentials(t *testing.T) {
 
 	// Send EHLO
 	client.Write([]byte("EHLO test\r\n"))
-	readResponse(reader) // 250-smtpRelay
-	readResponse(reader) // 250 AUTH LOGIN PLAIN
+	readMultiline(reader) // 250-smtpRelay, 250-SIZE, 250 AUTH LOGIN PLAIN
 
 	// Should be rejected even with allow_anonymous since no fallback creds
 	client.Write([]byte("MAIL FROM:<sender@example.com>\r\n"))
@@ -145,321 +162,2034 @@ func TestAnonymousAccess_DeniedWhenNoFallbackCredentials(t *testing.T) {
 	readResponse(reader)
 }
 
-func TestDecodeMessage_Base64(t *testing.T) {
-	input := base64.StdEncoding.EncodeToString([]byte("hello world"))
-	decoded, err := decodeMessage("base64", strings.NewReader(input))
-	if err != nil {
-		t.Fatalf("decodeMessage base64 failed: %v", err)
+func TestAllowedRecipientDomains_MixedRecipients(t *testing.T) {
+	initTestConfig(true)
+	config.AllowedRecipientDomains = []string{"example.com", "corp.example.org"}
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+
+	client.Write([]byte("MAIL FROM:<sender@example.com>\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected 250 for MAIL FROM, got: %s", resp)
 	}
-	if string(decoded) != "hello world" {
-		t.Errorf("expected 'hello world', got '%s'", string(decoded))
+
+	cases := []struct {
+		rcpt string
+		want string
+	}{
+		{"user@example.com", "250"},
+		{"outsider@gmail.com", "550 5.7.1"},
+		{"Boss@CORP.Example.org", "250"},
+		{"user@sub.example.com", "550 5.7.1"},
+	}
+	for _, c := range cases {
+		client.Write([]byte("RCPT TO:<" + c.rcpt + ">\r\n"))
+		resp := readResponse(reader)
+		if !strings.HasPrefix(resp, c.want) {
+			t.Errorf("RCPT TO %s: expected %s, got: %s", c.rcpt, c.want, resp)
+		}
 	}
+
+	client.Write([]byte("QUIT\r\n"))
+	readResponse(reader)
 }
 
-func TestDecodeMessage_QuotedPrintable(t *testing.T) {
-	input := "hello=20world=21"
-	decoded, err := decodeMessage("quoted-printable", strings.NewReader(input))
-	if err != nil {
-		t.Fatalf("decodeMessage quoted-printable failed: %v", err)
+func TestAllowedRecipientDomains_HeaderRecipients(t *testing.T) {
+	initTestConfig(true)
+	config.AllowedRecipientDomains = []string{"example.com"}
+	TokenCache.Store(config.FallbackSMTPuser, cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete(config.FallbackSMTPuser)
+	sends := 0
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		sends++
+		return "", nil
+	}
+	defer func() { sendMessage = prevSend }()
+
+	message := func(headers string) []conversationStep {
+		return []conversationStep{
+			{"MAIL FROM:<sender@example.com>\r\n", "250 2.1.0 Ok"},
+			{"RCPT TO:<ok@example.com>\r\n", "250 2.1.5 Ok"},
+			{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+			{headers + "Subject: test\r\n\r\nbody\r\n.\r\n", "550 5.7.1 Relaying denied for this recipient"},
+		}
 	}
-	if string(decoded) != "hello world!" {
-		t.Errorf("expected 'hello world!', got '%s'", string(decoded))
+	// The envelope recipient is allowed, but Graph would also deliver to the Cc/Bcc
+	runConversation(t, message("To: ok@example.com\r\nCc: anyone@outside.org\r\n"))
+	runConversation(t, message("Bcc: anyone@outside.org\r\n"))
+	// raw_passthrough: Graph takes every recipient from the headers, To included
+	config.RawPassthrough = true
+	runConversation(t, message("To: anyone@outside.org\r\n"))
+	if sends != 0 {
+		t.Errorf("expected no message to reach Graph, got %d sends", sends)
 	}
 }
 
-func TestDecodeMessage_Default(t *testing.T) {
-	input := "plain text"
-	decoded, err := decodeMessage("", strings.NewReader(input))
-	if err != nil {
-		t.Fatalf("decodeMessage default failed: %v", err)
-	}
-	if string(decoded) != input {
-		t.Errorf("expected '%s', got '%s'", input, string(decoded))
+// authPlain performs AUTH PLAIN with inline credentials and returns the server response
+func authPlain(client net.Conn, reader *bufio.Reader, user, pass string) string {
+	creds := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + pass))
+	client.Write([]byte("AUTH PLAIN " + creds + "\r\n"))
+	return readResponse(reader)
+}
+
+// conversationStep is one client line and the expected reply (the last line of a
+// multi-line reply); an empty want expects the server to close the connection
+type conversationStep struct {
+	send, want string
+}
+
+// startHandler runs handler on server in the background. The returned stop closes client
+// and waits until the handler returned, so a session never outlives its test and races
+// the globals (config, logger, stubs) that the next test sets up.
+func startHandler(client, server net.Conn, handler func(net.Conn)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler(server)
+	}()
+	return func() {
+		client.Close()
+		<-done
 	}
 }
 
-func TestParseSubjectBodyAndAttachments_Simple(t *testing.T) {
-	raw := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Hello\r\n\r\nThis is the body."
-	subject, body, isHTML, attachments, _, _, err := parseSubjectBodyAndAttachments(raw)
-	if err != nil {
-		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+// runConversation drives handleSMTPConnection through steps, starting after the greeting
+func runConversation(t *testing.T, steps []conversationStep) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+	reader := bufio.NewReader(client)
+	if resp := readResponse(reader); resp != "220 SMTP Relay Ready" {
+		t.Fatalf("expected greeting, got: %s", resp)
+	}
+	for _, step := range steps {
+		go client.Write([]byte(step.send))
+		lines := readMultiline(reader)
+		if got := lines[len(lines)-1]; got != step.want {
+			t.Fatalf("after %q: expected %q, got %q", strings.TrimSpace(step.send), step.want, got)
+		}
 	}
-	if subject != "Hello" {
-		t.Errorf("expected subject 'Hello', got '%s'", subject)
+}
+
+func TestSMTPConversation(t *testing.T) {
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant","error_description":"AADSTS50126: Error validating credentials due to invalid username or password."}`))
+	}))
+	defer idp.Close()
+	prevClient := authHTTPClient
+	authHTTPClient = idp.Client()
+	defer func() { authHTTPClient = prevClient }()
+	TokenCache.Store("conv@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("conv@example.com")
+
+	var sent []string
+	sendErr := error(nil)
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		sent = append(sent, sender+" "+mailFrom+" "+strings.Join(rcptTo, ",")+" "+pm.subject)
+		return "", sendErr
+	}
+	defer func() { sendMessage = prevSend }()
+
+	plain := func(user, pass string) string {
+		return "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00"+user+"\x00"+pass)) + "\r\n"
+	}
+	message := []conversationStep{
+		{"MAIL FROM:<conv@example.com>\r\n", "250 2.1.0 Ok"},
+		{"RCPT TO:<to@example.com>\r\n", "250 2.1.5 Ok"},
+		{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+	}
+	tests := []struct {
+		name     string
+		sendErr  error
+		steps    []conversationStep
+		wantSent int
+	}{
+		{"happy path", nil, slices.Concat(
+			[]conversationStep{{"EHLO client\r\n", "250 AUTH LOGIN PLAIN"}, {plain("conv@example.com", "pass"), "235 2.7.0 Authentication successful"}},
+			message,
+			[]conversationStep{{"Subject: Hello\r\n\r\nbody\r\n.\r\n", "250 2.0.0 Ok: queued as graphapi"}, {"QUIT\r\n", "221 2.0.0 Bye"}},
+		), 1},
+		{"auth failure", nil, []conversationStep{
+			{"EHLO client\r\n", "250 AUTH LOGIN PLAIN"},
+			{plain("wrong@example.com", "bad"), "535 5.7.8 Authentication failed"},
+		}, 0},
+		{"authentication required", nil, []conversationStep{
+			{"EHLO client\r\n", "250 AUTH LOGIN PLAIN"},
+			{"MAIL FROM:<conv@example.com>\r\n", "530 5.7.0 Authentication required"},
+			{"RCPT TO:<to@example.com>\r\n", "530 5.7.0 Authentication required"},
+		}, 0},
+		{"temporary send failure", &GraphError{StatusCode: 503, Message: "unavailable"}, slices.Concat(
+			[]conversationStep{{"EHLO client\r\n", "250 AUTH LOGIN PLAIN"}, {plain("conv@example.com", "pass"), "235 2.7.0 Authentication successful"}},
+			message,
+			[]conversationStep{{"Subject: Hello\r\n\r\nbody\r\n.\r\n", "451 4.3.0 Temporary delivery failure, try again later"}},
+		), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initTestConfig(false)
+			config.OAuth2Config.TokenEndpoint = idp.URL + "/{tenant}/token"
+			sent, sendErr = nil, tt.sendErr
+			runConversation(t, tt.steps)
+			if len(sent) != tt.wantSent {
+				t.Errorf("expected %d sends, got %v", tt.wantSent, sent)
+			}
+			if tt.wantSent > 0 && sent[0] != "conv@example.com conv@example.com to@example.com Hello" {
+				t.Errorf("unexpected send %q", sent[0])
+			}
+		})
 	}
-	// Accept both with and without trailing newline
-	expectedBody := "This is the body."
-	if strings.TrimRight(body, "\r\n") != expectedBody {
-		t.Errorf("expected body '%s', got '%s'", expectedBody, body)
+}
+
+func TestRecipientOverflow(t *testing.T) {
+	initTestConfig(false)
+	TokenCache.Store("many@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("many@example.com")
+	var sentTo []string
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		sentTo = rcptTo
+		return "", nil
+	}
+	defer func() { sendMessage = prevSend }()
+
+	// conversation fills the recipient limit, sends one recipient too many and continues with after
+	conversation := func(overflowReply string, after ...conversationStep) []conversationStep {
+		steps := []conversationStep{
+			{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00many@example.com\x00pass")) + "\r\n", "235 2.7.0 Authentication successful"},
+			{"MAIL FROM:<many@example.com>\r\n", "250 2.1.0 Ok"},
+		}
+		for i := range maxRecipients {
+			steps = append(steps, conversationStep{fmt.Sprintf("RCPT TO:<r%d@example.com>\r\n", i), "250 2.1.5 Ok"})
+		}
+		steps = append(steps, conversationStep{"RCPT TO:<extra@example.com>\r\n", overflowReply})
+		return append(steps, after...)
 	}
-	if isHTML {
-		t.Errorf("expected isHTML false, got true")
+
+	// reject_extra (default): only the extra recipient is refused, the message goes to the others
+	runConversation(t, conversation("452 4.5.3 Too many recipients",
+		conversationStep{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+		conversationStep{"Subject: many\r\n\r\nbody\r\n.\r\n", "250 2.0.0 Ok: queued as graphapi"},
+		conversationStep{"QUIT\r\n", "221 2.0.0 Bye"},
+	))
+	if len(sentTo) != maxRecipients {
+		t.Errorf("expected the message sent to %d recipients, got %d", maxRecipients, len(sentTo))
 	}
-	if len(attachments) != 0 {
-		t.Errorf("expected 0 attachments, got %d", len(attachments))
+
+	// reject_transaction: the transaction fails and only RSET allows a new one
+	config.RecipientOverflow = "reject_transaction"
+	sentTo = nil
+	runConversation(t, conversation("550 5.5.3 Too many recipients",
+		conversationStep{"RCPT TO:<more@example.com>\r\n", "503 5.5.1 Transaction rejected: too many recipients, send RSET"},
+		conversationStep{"DATA\r\n", "503 5.5.1 Transaction rejected: too many recipients, send RSET"},
+		conversationStep{"MAIL FROM:<many@example.com>\r\n", "503 5.5.1 Transaction rejected: too many recipients, send RSET"},
+		conversationStep{"RSET\r\n", "250 2.0.0 Ok"},
+		conversationStep{"MAIL FROM:<many@example.com>\r\n", "250 2.1.0 Ok"},
+		conversationStep{"RCPT TO:<one@example.com>\r\n", "250 2.1.5 Ok"},
+		conversationStep{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+		conversationStep{"Subject: one\r\n\r\nbody\r\n.\r\n", "250 2.0.0 Ok: queued as graphapi"},
+		conversationStep{"QUIT\r\n", "221 2.0.0 Bye"},
+	))
+	if !slices.Equal(sentTo, []string{"one@example.com"}) {
+		t.Errorf("expected only the message after RSET sent, got %d recipients", len(sentTo))
 	}
 }
 
-func TestParseSubjectBodyAndAttachments_SimpleHTML(t *testing.T) {
-	raw := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Hello\r\nContent-Type: text/html\r\n\r\n<html><body>Hi!</body></html>"
-	subject, body, isHTML, attachments, _, _, err := parseSubjectBodyAndAttachments(raw)
-	if err != nil {
-		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+func TestSMTPConversation_LineEndings(t *testing.T) {
+	TokenCache.Store("conv@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("conv@example.com")
+	var sent []*parsedMessage
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		sent = append(sent, pm)
+		return "", nil
+	}
+	defer func() { sendMessage = prevSend }()
+
+	b64 := base64.StdEncoding.EncodeToString
+	steps := []conversationStep{
+		{"EHLO client\r\n", "250 AUTH LOGIN PLAIN"},
+		{"AUTH LOGIN\r\n", "334 VXNlcm5hbWU6"},
+		{b64([]byte("conv@example.com")) + "\r\n", "334 UGFzc3dvcmQ6"},
+		{b64([]byte("pass")) + "\r\n", "235 2.7.0 Authentication successful"},
+		{"MAIL FROM:<conv@example.com>\r\n", "250 2.1.0 Ok"},
+		{"RCPT TO:<to@example.com>\r\n", "250 2.1.5 Ok"},
+		{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+		{"Subject: Hello\r\n\r\nline1\r\n..dot\r\n.\r\n", "250 2.0.0 Ok: queued as graphapi"},
+		{"NOOP\r\n", "250 2.0.0 Ok"},
+		{"QUIT\r\n", "221 2.0.0 Bye"},
+	}
+	for _, tt := range []struct{ name, eol string }{{"CRLF", "\r\n"}, {"LF", "\n"}, {"CR", "\r"}} {
+		t.Run(tt.name, func(t *testing.T) {
+			initTestConfig(false)
+			sent = nil
+			var converted []conversationStep
+			for _, step := range steps {
+				converted = append(converted, conversationStep{strings.ReplaceAll(step.send, "\r\n", tt.eol), step.want})
+			}
+			runConversation(t, converted)
+			if len(sent) != 1 {
+				t.Fatalf("expected 1 send, got %d", len(sent))
+			}
+			if pm := sent[0]; pm.subject != "Hello" || pm.body != "line1\r\n.dot\r\n" {
+				t.Errorf("expected subject and dot-unstuffed body, got %q, %q", pm.subject, pm.body)
+			}
+		})
 	}
-	if subject != "Hello" {
-		t.Errorf("expected subject 'Hello', got '%s'", subject)
+
+	// A CRLF split across reads: the LF arriving after a CR-terminated line is skipped
+	reader := newLineReader(io.MultiReader(strings.NewReader("NOOP\r"), strings.NewReader("\nQUIT\r\n")))
+	for _, want := range []string{"NOOP\r", "QUIT\r\n"} {
+		if line, err := reader.readCommandLine(); err != nil || line != want {
+			t.Errorf("readCommandLine() = %q, %v; want %q", line, err, want)
+		}
 	}
-	expectedBody := "<html><body>Hi!</body></html>"
-	if strings.TrimRight(body, "\r\n") != expectedBody {
-		t.Errorf("expected body '%s', got '%s'", expectedBody, body)
+
+	// The same split on DATA: the client uses CRLF, so a CR in the message is content
+	reader = newLineReader(io.MultiReader(strings.NewReader("DATA\r"), strings.NewReader("\na\r..b\r\n")))
+	if line, err := reader.readCommandLine(); err != nil || line != "DATA\r" {
+		t.Fatalf("readCommandLine() = %q, %v; want %q", line, err, "DATA\r")
 	}
-	if !isHTML {
-		t.Errorf("expected isHTML true, got false")
+	if line, _, err := reader.readDataLine(0); err != nil || line != "a\r..b\r\n" {
+		t.Errorf("readDataLine() = %q, %v; want %q", line, err, "a\r..b\r\n")
 	}
-	if len(attachments) != 0 {
-		t.Errorf("expected 0 attachments, got %d", len(attachments))
+	// DATA\r and \n in separate writes: the LF is not taken for the first message line
+	initTestConfig(false)
+	sent = nil
+	split := append([]conversationStep{}, steps[:6]...)
+	split = append(split,
+		conversationStep{"DATA\r", "354 End data with <CR><LF>.<CR><LF>"},
+		conversationStep{"\nSubject: Split\r\n\r\nline1\r\n..dot\r\n.\r\n", "250 2.0.0 Ok: queued as graphapi"},
+	)
+	runConversation(t, split)
+	if len(sent) != 1 || sent[0].subject != "Split" || sent[0].body != "line1\r\n.dot\r\n" {
+		t.Errorf("expected the split DATA command to start a regular message, got %v", sent)
 	}
 }
 
-func TestParseSubjectBodyAndAttachments_MultipartWithAttachment(t *testing.T) {
-	var buf bytes.Buffer
-	w := multipart.NewWriter(&buf)
-	boundary := w.Boundary()
-	// Body part
-	bodyPart, _ := w.CreatePart(map[string][]string{
-		"Content-Type":              {"text/plain"},
-		"Content-Transfer-Encoding": {"7bit"},
-	})
-	bodyPart.Write([]byte("This is the body."))
-	// Attachment part
-	attPart, _ := w.CreatePart(map[string][]string{
-		"Content-Type":              {"text/plain; name=\"file.txt\""},
-		"Content-Disposition":       {"attachment; filename=\"file.txt\""},
-		"Content-Transfer-Encoding": {"base64"},
-	})
-	attContent := base64.StdEncoding.EncodeToString([]byte("file content"))
-	attPart.Write([]byte(attContent))
-	w.Close()
-	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Multipart\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
-	subject, body, isHTML, attachments, _, _, err := parseSubjectBodyAndAttachments(msg)
+func TestEarlyEHLO_BeforeBanner(t *testing.T) {
+	initTestConfig(true)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+		t.Fatalf("listen failed: %v", err)
 	}
-	if subject != "Multipart" {
-		t.Errorf("expected subject 'Multipart', got '%s'", subject)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		handleSMTPConnection(conn)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
 	}
-	if strings.TrimRight(body, "\r\n") != "This is the body." {
-		t.Errorf("expected body 'This is the body.', got '%s'", body)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// EHLO and NOOP in one packet, sent without waiting for the banner
+	client.Write([]byte("EHLO impatient\r\nNOOP\r\n"))
+	reader := bufio.NewReader(client)
+
+	if resp := readResponse(reader); resp != "220 SMTP Relay Ready" {
+		t.Fatalf("expected 220 banner first, got: %s", resp)
 	}
-	if isHTML {
-		t.Errorf("expected isHTML false, got true")
+	lines := readMultiline(reader)
+	if lines[0] != "250-smtpRelay" || lines[len(lines)-1] != "250 AUTH LOGIN PLAIN" {
+		t.Errorf("expected complete EHLO response, got: %v", lines)
 	}
-	if len(attachments) != 1 {
-		t.Errorf("expected 1 attachment, got %d", len(attachments))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Errorf("expected 250 for pipelined NOOP, got: %s", resp)
 	}
-	if attachments[0].Filename != "file.txt" {
-		t.Errorf("expected attachment filename 'file.txt', got '%s'", attachments[0].Filename)
+	client.Write([]byte("QUIT\r\n"))
+	readResponse(reader)
+}
+
+func TestReadTimeout_Configurable(t *testing.T) {
+	initTestConfig(true)
+	config.ReadTimeoutSeconds = 1
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+
+	// Stay idle past read_timeout_seconds
+	start := time.Now()
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "421 4.4.2") {
+		t.Fatalf("expected 421 timeout, got: %s", resp)
 	}
-	decoded, _ := base64.StdEncoding.DecodeString(attachments[0].Content)
-	if string(decoded) != "file content" {
-		t.Errorf("expected attachment content 'file content', got '%s'", string(decoded))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected timeout after about 1s, took %v", elapsed)
 	}
 }
 
-func TestParseSubjectBodyAndAttachments_MultipartHTMLBody(t *testing.T) {
-	var buf bytes.Buffer
-	w := multipart.NewWriter(&buf)
-	boundary := w.Boundary()
-	// HTML body part
-	bodyPart, _ := w.CreatePart(map[string][]string{
-		"Content-Type":              {"text/html"},
-		"Content-Transfer-Encoding": {"7bit"},
-	})
-	bodyPart.Write([]byte("<b>HTML Body</b>"))
-	w.Close()
-	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: HTMLMultipart\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
-	subject, body, isHTML, attachments, _, _, err := parseSubjectBodyAndAttachments(msg)
-	if err != nil {
-		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+func TestMaxConnectionsPerUser(t *testing.T) {
+	initTestConfig(false)
+	config.MaxConnectionsPerUser = 1
+	TokenCache.Store("busy@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("busy@example.com")
+
+	client1, server1 := net.Pipe()
+	defer startHandler(client1, server1, handleSMTPConnection)()
+
+	reader1 := bufio.NewReader(client1)
+	readResponse(reader1) // 220 greeting
+	if resp := authPlain(client1, reader1, "busy@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Fatalf("expected 235 for first connection, got: %s", resp)
 	}
-	if subject != "HTMLMultipart" {
-		t.Errorf("expected subject 'HTMLMultipart', got '%s'", subject)
+
+	client2, server2 := net.Pipe()
+	defer startHandler(client2, server2, handleSMTPConnection)()
+
+	reader2 := bufio.NewReader(client2)
+	readResponse(reader2) // 220 greeting
+	if resp := authPlain(client2, reader2, "busy@example.com", "pass"); !strings.HasPrefix(resp, "421 4.7.0") {
+		t.Fatalf("expected 421 for second connection of same user, got: %s", resp)
 	}
-	if strings.TrimRight(body, "\r\n") != "<b>HTML Body</b>" {
-		t.Errorf("expected body '<b>HTML Body</b>', got '%s'", body)
+
+	// Closing the first connection frees the slot
+	client1.Write([]byte("QUIT\r\n"))
+	readResponse(reader1)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		userConnections.Lock()
+		n := userConnections.counts["busy@example.com"]
+		userConnections.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	if !isHTML {
-		t.Errorf("expected isHTML true, got false")
+
+	client3, server3 := net.Pipe()
+	defer startHandler(client3, server3, handleSMTPConnection)()
+
+	reader3 := bufio.NewReader(client3)
+	readResponse(reader3) // 220 greeting
+	if resp := authPlain(client3, reader3, "busy@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Errorf("expected 235 after slot was released, got: %s", resp)
 	}
-	if len(attachments) != 0 {
-		t.Errorf("expected 0 attachments, got %d", len(attachments))
+	client3.Write([]byte("QUIT\r\n"))
+	readResponse(reader3)
+}
+
+func TestRSET_ResetClearsAuth(t *testing.T) {
+	TokenCache.Store("rset@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("rset@example.com")
+
+	for _, clears := range []bool{false, true} {
+		initTestConfig(false)
+		config.ResetClearsAuth = clears
+
+		client, server := net.Pipe()
+		stop := startHandler(client, server, handleSMTPConnection)
+		reader := bufio.NewReader(client)
+		readResponse(reader) // 220 greeting
+		if resp := authPlain(client, reader, "rset@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+			t.Fatalf("expected 235, got: %s", resp)
+		}
+
+		client.Write([]byte("RSET\r\n"))
+		if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+			t.Fatalf("expected 250 for RSET, got: %s", resp)
+		}
+
+		client.Write([]byte("MAIL FROM:<rset@example.com>\r\n"))
+		resp := readResponse(reader)
+		if clears && !strings.HasPrefix(resp, "530") {
+			t.Errorf("reset_clears_auth=true: expected 530 after RSET, got: %s", resp)
+		}
+		if !clears && !strings.HasPrefix(resp, "250") {
+			t.Errorf("reset_clears_auth=false: expected 250 after RSET, got: %s", resp)
+		}
+		client.Write([]byte("QUIT\r\n"))
+		readResponse(reader)
+		stop()
 	}
 }
 
-func TestParseSubjectBodyAndAttachments_MultipartNoBody(t *testing.T) {
-	var buf bytes.Buffer
-	w := multipart.NewWriter(&buf)
-	boundary := w.Boundary()
-	// Only attachment, no body part
-	attPart, _ := w.CreatePart(map[string][]string{
-		"Content-Type":              {"application/octet-stream; name=\"file.bin\""},
-		"Content-Disposition":       {"attachment; filename=\"file.bin\""},
-		"Content-Transfer-Encoding": {"base64"},
-	})
-	attContent := base64.StdEncoding.EncodeToString([]byte("binarydata"))
-	attPart.Write([]byte(attContent))
-	w.Close()
-	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: OnlyAttachment\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
-	subject, body, isHTML, attachments, _, _, err := parseSubjectBodyAndAttachments(msg)
-	if err != nil {
-		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+func TestUserMap_MaxMessageSize(t *testing.T) {
+	initTestConfig(false)
+	config.MaxMessageSize = 1000
+	config.UserMap = map[string]tUserSettings{"newsletter@example.com": {MaxMessageSize: 5000}}
+	for _, user := range []string{"newsletter@example.com", "user@example.com"} {
+		TokenCache.Store(user, cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+		defer TokenCache.Delete(user)
+	}
+
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	// Before AUTH the largest limit is advertised; lookups ignore case
+	if got := advertisedMaxSize(""); got != 5000 {
+		t.Errorf("expected SIZE 5000 before AUTH, got %d", got)
 	}
-	if subject != "OnlyAttachment" {
-		t.Errorf("expected subject 'OnlyAttachment', got '%s'", subject)
+	if got := maxMessageSizeFor("Newsletter@Example.com"); got != 5000 {
+		t.Errorf("expected case-insensitive user_map lookup, got %d", got)
 	}
-	if body != "" {
-		t.Errorf("expected empty body, got '%s'", body)
+
+	session := func(user string) (net.Conn, *bufio.Reader, func()) {
+		client, server := net.Pipe()
+		stop := startHandler(client, server, handleSMTPConnection)
+		reader := bufio.NewReader(client)
+		readResponse(reader) // 220 greeting
+		if resp := authPlain(client, reader, user, "pass"); !strings.HasPrefix(resp, "235") {
+			t.Fatalf("expected 235 for %s, got: %s", user, resp)
+		}
+		return client, reader, stop
 	}
-	if isHTML {
-		t.Errorf("expected isHTML false, got true")
+
+	// Raised limit: EHLO after AUTH reflects it, MAIL FROM SIZE within it is accepted
+	client, reader, stop := session("newsletter@example.com")
+	client.Write([]byte("EHLO test\r\n"))
+	if lines := readMultiline(reader); !slices.Contains(lines, "250-SIZE 5000") {
+		t.Errorf("expected SIZE 5000 for newsletter user, got %v", lines)
 	}
-	if len(attachments) != 1 {
-		t.Errorf("expected 1 attachment, got %d", len(attachments))
+	client.Write([]byte("MAIL FROM:<newsletter@example.com> SIZE=4000\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Errorf("expected 250 for SIZE within raised limit, got: %s", resp)
+	}
+	client.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("DATA\r\n"))
+	readResponse(reader) // 354
+	// 2000 bytes: over the global limit but within the user's
+	go client.Write([]byte("Subject: big\r\n\r\n" + strings.Repeat("x", 2000) + "\r\n.\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Errorf("expected DATA within raised limit to be sent, got: %s", resp)
+	}
+	stop()
+
+	// Default user: declared and actual size are checked against the global limit
+	client, reader, stop = session("user@example.com")
+	client.Write([]byte("MAIL FROM:<user@example.com> SIZE=4000\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "552") {
+		t.Errorf("expected 552 for SIZE above the user's limit, got: %s", resp)
 	}
-	if attachments[0].Filename != "file.bin" {
-		t.Errorf("expected attachment filename 'file.bin', got '%s'", attachments[0].Filename)
+	client.Write([]byte("MAIL FROM:<user@example.com> SIZE=abc\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "501") {
+		t.Errorf("expected 501 for invalid SIZE, got: %s", resp)
 	}
-	decoded, _ := base64.StdEncoding.DecodeString(attachments[0].Content)
-	if string(decoded) != "binarydata" {
-		t.Errorf("expected attachment content 'binarydata', got '%s'", string(decoded))
+	client.Write([]byte("MAIL FROM:<user@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("DATA\r\n"))
+	readResponse(reader) // 354
+	go client.Write([]byte("Subject: big\r\n\r\n" + strings.Repeat("x", 2000) + "\r\n.\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "552") {
+		t.Errorf("expected 552 for DATA above the global limit, got: %s", resp)
 	}
+	stop()
 }
 
-func TestParseSubjectBodyAndAttachments_EncodedSubject(t *testing.T) {
-	raw := "From: test@example.com\r\nTo: you@example.com\r\nSubject: =?UTF-8?B?SGVsbG8g8J+agA==?=\r\n\r\nBody"
-	subject, body, _, _, _, _, err := parseSubjectBodyAndAttachments(raw)
-	if err != nil {
-		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+func TestParseMailParams(t *testing.T) {
+	params := parseMailParams("MAIL FROM:<a@example.com> size=1024 BODY=8BITMIME SMTPUTF8")
+	if params["SIZE"] != "1024" || params["BODY"] != "8BITMIME" {
+		t.Errorf("unexpected params: %v", params)
+	}
+	if _, ok := params["SMTPUTF8"]; !ok {
+		t.Error("expected valueless SMTPUTF8 parameter")
 	}
-	if subject != "Hello 🚀" {
-		t.Errorf("expected subject 'Hello 🚀', got '%s'", subject)
+	if params := parseMailParams("MAIL FROM: a@example.com SIZE=5"); params["SIZE"] != "5" {
+		t.Errorf("expected SIZE without angle brackets, got %v", params)
 	}
-	if strings.TrimRight(body, "\r\n") != "Body" {
-		t.Errorf("expected body 'Body', got '%s'", body)
+	if params := parseMailParams("MAIL FROM:<a@example.com>"); len(params) != 0 {
+		t.Errorf("expected no params, got %v", params)
 	}
 }
 
-func TestParseSubjectBodyAndAttachments_NestedMultipartMixedAlternative(t *testing.T) {
-	// Build inner multipart/alternative with text and HTML
-	var innerBuf bytes.Buffer
-	innerWriter := multipart.NewWriter(&innerBuf)
-	innerBoundary := innerWriter.Boundary()
-	textPart, _ := innerWriter.CreatePart(map[string][]string{
-		"Content-Type":              {"text/plain; charset=utf-8"},
-		"Content-Transfer-Encoding": {"7bit"},
-	})
-	textPart.Write([]byte("Plain body"))
-	htmlPart, _ := innerWriter.CreatePart(map[string][]string{
-		"Content-Type":              {"text/html; charset=utf-8"},
-		"Content-Transfer-Encoding": {"7bit"},
-	})
-	htmlPart.Write([]byte("<b>HTML body</b>"))
-	innerWriter.Close()
+func TestMaxDataLineLength_Reject(t *testing.T) {
+	initTestConfig(true)
+	config.MaxDataLineLength = 1000
+	config.DataLineOverflow = "reject"
 
-	// Build outer multipart/mixed with the inner alternative + attachment
-	var outerBuf bytes.Buffer
-	outerWriter := multipart.NewWriter(&outerBuf)
-	outerBoundary := outerWriter.Boundary()
-	altPart, _ := outerWriter.CreatePart(map[string][]string{
-		"Content-Type": {"multipart/alternative; boundary=\"" + innerBoundary + "\""},
-	})
-	altPart.Write(innerBuf.Bytes())
-	attPart, _ := outerWriter.CreatePart(map[string][]string{
-		"Content-Type":              {"application/pdf; name=\"doc.pdf\""},
-		"Content-Disposition":       {"attachment; filename=\"doc.pdf\""},
-		"Content-Transfer-Encoding": {"base64"},
-	})
-	attPart.Write([]byte(base64.StdEncoding.EncodeToString([]byte("pdf content"))))
-	outerWriter.Close()
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
 
-	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Nested\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + outerBoundary + "\"\r\n\r\n" + outerBuf.String()
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
 
-	subject, body, isHTML, attachments, _, _, err := parseSubjectBodyAndAttachments(msg)
-	if err != nil {
-		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	client.Write([]byte("MAIL FROM:<sender@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("RCPT TO:<recipient@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("DATA\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "354") {
+		t.Fatalf("expected 354 for DATA, got: %s", resp)
+	}
+
+	// Write asynchronously: the server replies before the client finishes sending
+	payload := "Subject: Long line\r\n\r\n" + strings.Repeat("A", 5000) + "\r\nshort line\r\n.\r\n"
+	go client.Write([]byte(payload))
+
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "500") {
+		t.Fatalf("expected 500 for over-long DATA line, got: %s", resp)
 	}
-	if subject != "Nested" {
-		t.Errorf("expected subject 'Nested', got '%s'", subject)
+
+	// Connection stays in sync after the rejection
+	client.Write([]byte("NOOP\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Errorf("expected 250 for NOOP after rejected DATA, got: %s", resp)
 	}
-	if strings.TrimRight(body, "\r\n") != "<b>HTML body</b>" {
-		t.Errorf("expected HTML body '<b>HTML body</b>', got '%s'", body)
+	client.Write([]byte("QUIT\r\n"))
+	readResponse(reader)
+}
+
+// lmtpSend delivers a two-recipient message over LMTP and returns the DATA replies
+func lmtpSend(t *testing.T, graphStatus int) []string {
+	t.Helper()
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(graphStatus)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+	TokenCache.Store("lmtp@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("lmtp@example.com")
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleLMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "220") {
+		t.Fatalf("expected 220 greeting, got: %s", resp)
 	}
-	if !isHTML {
-		t.Errorf("expected isHTML true, got false")
+	client.Write([]byte("LHLO test\r\n"))
+	if lines := readMultiline(reader); !strings.HasPrefix(lines[0], "250") {
+		t.Fatalf("expected 250 for LHLO, got: %v", lines)
 	}
-	if len(attachments) != 1 {
-		t.Fatalf("expected 1 attachment, got %d", len(attachments))
+	if resp := authPlain(client, reader, "lmtp@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Fatalf("expected 235, got: %s", resp)
 	}
-	if attachments[0].Filename != "doc.pdf" {
-		t.Errorf("expected attachment filename 'doc.pdf', got '%s'", attachments[0].Filename)
+	client.Write([]byte("MAIL FROM:<lmtp@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("RCPT TO:<one@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("RCPT TO:<two@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("DATA\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "354") {
+		t.Fatalf("expected 354 for DATA, got: %s", resp)
+	}
+	client.Write([]byte("Subject: LMTP\r\n\r\nHello\r\n.\r\n"))
+	return []string{readResponse(reader), readResponse(reader)}
+}
+
+func TestLMTP_DataRepliesPerRecipient(t *testing.T) {
+	initTestConfig(false)
+	config.RetryAttempts = 1
+
+	replies := lmtpSend(t, http.StatusAccepted)
+	want := []string{
+		"250 2.0.0 <one@example.com> Ok: queued as graphapi",
+		"250 2.0.0 <two@example.com> Ok: queued as graphapi",
+	}
+	for i := range want {
+		if replies[i] != want[i] {
+			t.Errorf("reply %d: expected %q, got %q", i, want[i], replies[i])
+		}
+	}
+
+	replies = lmtpSend(t, http.StatusBadRequest)
+	for i, r := range replies {
+		if !strings.HasPrefix(r, "550 5.7.0 <") {
+			t.Errorf("reply %d: expected per-recipient 550 on failed send, got %q", i, r)
+		}
+	}
+}
+
+func TestLMTP_RejectsEHLO(t *testing.T) {
+	initTestConfig(true)
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleLMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+
+	client.Write([]byte("EHLO test\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "500") {
+		t.Errorf("expected 500 for EHLO on LMTP listener, got: %s", resp)
+	}
+	client.Write([]byte("QUIT\r\n"))
+	readResponse(reader)
+}
+
+func TestMaxHeaderBytes_Reject(t *testing.T) {
+	initTestConfig(true)
+	config.MaxHeaderBytes = 4096
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+
+	client.Write([]byte("MAIL FROM:<sender@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("RCPT TO:<recipient@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("DATA\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "354") {
+		t.Fatalf("expected 354 for DATA, got: %s", resp)
+	}
+
+	// Thousands of folded X-header lines, then a tiny body
+	var headers strings.Builder
+	headers.WriteString("Subject: Header flood\r\nX-Flood: start\r\n")
+	for i := 0; i < 2000; i++ {
+		headers.WriteString("\tcontinued header value\r\n")
+	}
+	payload := headers.String() + "\r\nbody\r\n.\r\n"
+	go client.Write([]byte(payload))
+
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "552") {
+		t.Fatalf("expected 552 for oversized header block, got: %s", resp)
+	}
+
+	client.Write([]byte("NOOP\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Errorf("expected 250 for NOOP after rejected DATA, got: %s", resp)
+	}
+	client.Write([]byte("QUIT\r\n"))
+	readResponse(reader)
+}
+
+func TestMaxDataLineLength_WrapSplitCRLF(t *testing.T) {
+	initTestConfig(true)
+	config.MaxDataLineLength = 16
+	config.DataLineOverflow = "wrap"
+	TokenCache.Store(config.FallbackSMTPuser, cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete(config.FallbackSMTPuser)
+	var body string
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		body = pm.body
+		return "", nil
+	}
+	defer func() { sendMessage = prevSend }()
+
+	// The limit falls between CR and LF of the first body line; the wrapped
+	// line still ends in a single CRLF
+	runConversation(t, []conversationStep{
+		{"MAIL FROM:<sender@example.com>\r\n", "250 2.1.0 Ok"},
+		{"RCPT TO:<recipient@example.com>\r\n", "250 2.1.5 Ok"},
+		{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+		{"Subject: wrap\r\n\r\n123456789012345\r\nnext\r\n" + strings.Repeat("C", 20) + "\r\n.\r\n", "250 2.0.0 Ok: queued as graphapi"},
+	})
+	if want := "123456789012345\r\nnext\r\n" + strings.Repeat("C", 16) + "\r\n" + strings.Repeat("C", 4); !strings.HasPrefix(body, want) {
+		t.Errorf("expected body %q, got %q", want, body)
+	}
+}
+
+func TestReadDataLine_Wrap(t *testing.T) {
+	reader := newLineReader(strings.NewReader(strings.Repeat("B", 25) + "\r\nnext\r\n"))
+	var chunks []string
+	for {
+		line, truncated, err := reader.readDataLine(10)
+		if err != nil {
+			break
+		}
+		chunks = append(chunks, line)
+		if !truncated && line == "next\r\n" {
+			break
+		}
+	}
+	want := []string{"BBBBBBBBBB", "BBBBBBBBBB", "BBBBB\r\n", "next\r\n"}
+	if strings.Join(chunks, "|") != strings.Join(want, "|") {
+		t.Errorf("expected chunks %q, got %q", want, chunks)
+	}
+}
+
+func TestGetCachedOAuth2Token_CountsCacheHits(t *testing.T) {
+	initTestConfig(false)
+	TokenCache.Store("cached@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("cached@example.com")
+
+	before := tokenStats.hits.Load()
+	token, err := getCachedOAuth2Token(context.Background(), "cached@example.com", "pass")
+	if err != nil {
+		t.Fatalf("getCachedOAuth2Token failed: %v", err)
+	}
+	if token != "tok" {
+		t.Errorf("expected cached token 'tok', got '%s'", token)
+	}
+	if got := tokenStats.hits.Load() - before; got != 1 {
+		t.Errorf("expected 1 cache hit, got %d", got)
+	}
+}
+
+func TestGetCachedOAuth2Token_RefreshToken(t *testing.T) {
+	initTestConfig(false)
+	const user = "refresh@example.com"
+	defer TokenCache.Delete(user)
+
+	var grants []string
+	refreshFails := false
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		grant := r.PostForm.Get("grant_type")
+		grants = append(grants, grant)
+		switch {
+		case grant == "refresh_token" && refreshFails:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant","error_description":"AADSTS70008: The refresh token has expired"}`))
+		case grant == "refresh_token":
+			if r.PostForm.Get("refresh_token") != "rt1" || r.PostForm.Has("password") {
+				t.Errorf("unexpected refresh request: %v", r.PostForm)
+			}
+			w.Write([]byte(`{"access_token":"refreshed","expires_in":3600}`))
+		default:
+			w.Write([]byte(`{"access_token":"tok","refresh_token":"rt1","expires_in":3600}`))
+		}
+	}))
+	defer idp.Close()
+	prevClient := authHTTPClient
+	authHTTPClient = idp.Client()
+	defer func() { authHTTPClient = prevClient }()
+	config.OAuth2Config.TokenEndpoint = idp.URL + "/{tenant}/token"
+
+	expire := func() {
+		val, _ := TokenCache.Load(user)
+		tok := val.(cachedToken)
+		tok.expiresAt = time.Now().Add(-time.Second)
+		TokenCache.Store(user, tok)
+	}
+	get := func(password string) string {
+		token, err := getCachedOAuth2Token(context.Background(), user, password)
+		if err != nil {
+			t.Fatalf("getCachedOAuth2Token failed: %v", err)
+		}
+		return token
+	}
+
+	if token := get("pass"); token != "tok" {
+		t.Fatalf("expected token from the password grant, got %q", token)
+	}
+	expire()
+	if token := get("pass"); token != "refreshed" {
+		t.Errorf("expected token from the refresh token grant, got %q", token)
+	}
+	// The refresh token is kept when the response does not rotate it
+	if val, _ := TokenCache.Load(user); val.(cachedToken).refreshToken != "rt1" {
+		t.Errorf("expected refresh token kept, got %q", val.(cachedToken).refreshToken)
+	}
+
+	// A different password never uses the refresh token
+	expire()
+	get("other")
+	// A failed refresh falls back to the password grant
+	expire()
+	refreshFails = true
+	if token := get("other"); token != "tok" {
+		t.Errorf("expected token from the password grant after a failed refresh, got %q", token)
+	}
+
+	want := []string{"password", "refresh_token", "password", "refresh_token", "password"}
+	if !slices.Equal(grants, want) {
+		t.Errorf("grants = %v, want %v", grants, want)
+	}
+}
+
+func TestGetCachedOAuth2Token_MaxCacheAge(t *testing.T) {
+	initTestConfig(false)
+	config.TokenMaxCacheAge = 600
+	const user = "maxage@example.com"
+	defer TokenCache.Delete(user)
+
+	fetches := 0
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		fmt.Fprintf(w, `{"access_token":"tok%d","expires_in":3600}`, fetches)
+	}))
+	defer idp.Close()
+	prevClient := authHTTPClient
+	authHTTPClient = idp.Client()
+	defer func() { authHTTPClient = prevClient }()
+	config.OAuth2Config.TokenEndpoint = idp.URL + "/{tenant}/token"
+
+	get := func() string {
+		token, err := getCachedOAuth2Token(context.Background(), user, "pass")
+		if err != nil {
+			t.Fatalf("getCachedOAuth2Token failed: %v", err)
+		}
+		return token
+	}
+	// age moves the cache entry's fetch time back by d, keeping its expiry
+	age := func(d time.Duration) {
+		val, _ := TokenCache.Load(user)
+		tok := val.(cachedToken)
+		tok.cachedAt = tok.cachedAt.Add(-d)
+		TokenCache.Store(user, tok)
+	}
+
+	if got := get(); got != "tok1" {
+		t.Fatalf("expected tok1, got %s", got)
+	}
+	age(9 * time.Minute)
+	if got := get(); got != "tok1" || fetches != 1 {
+		t.Errorf("expected the token reused within token_max_cache_age, got %s after %d fetches", got, fetches)
+	}
+	// Still valid for most of an hour, but older than token_max_cache_age
+	age(time.Minute)
+	if got := get(); got != "tok2" || fetches != 2 {
+		t.Errorf("expected a re-fetch after token_max_cache_age, got %s after %d fetches", got, fetches)
+	}
+
+	config.TokenMaxCacheAge = 0
+	age(50 * time.Minute)
+	if got := get(); got != "tok2" {
+		t.Errorf("expected the token reused until expiry without token_max_cache_age, got %s", got)
+	}
+}
+
+func TestAcquireTenantTokenSlot_Limit(t *testing.T) {
+	initTestConfig(false)
+	config.MaxTokenRequestsPerTenant = 2
+	tenant := "limit-test-tenant"
+	defer tenantTokenSems.Delete(tenant)
+
+	release1, err := acquireTenantTokenSlot(context.Background(), tenant)
+	if err != nil {
+		t.Fatalf("first slot: %v", err)
+	}
+	release2, err := acquireTenantTokenSlot(context.Background(), tenant)
+	if err != nil {
+		t.Fatalf("second slot: %v", err)
+	}
+
+	// Third request waits and gives up when its context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := acquireTenantTokenSlot(ctx, tenant); err == nil {
+		t.Fatal("expected third request to wait for a slot and time out")
+	}
+
+	// A queued request proceeds as soon as a slot is released
+	acquired := make(chan struct{})
+	go func() {
+		release3, err := acquireTenantTokenSlot(context.Background(), tenant)
+		if err == nil {
+			release3()
+		}
+		close(acquired)
+	}()
+	release1()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("queued request did not get the released slot")
+	}
+	release2()
+
+	// Other tenants are not affected
+	releaseOther, err := acquireTenantTokenSlot(context.Background(), "other-tenant")
+	if err != nil {
+		t.Fatalf("other tenant: %v", err)
+	}
+	releaseOther()
+	tenantTokenSems.Delete("other-tenant")
+}
+
+func TestRetryDelay_Jitter(t *testing.T) {
+	backoff := 400 * time.Millisecond
+	if d := retryDelay(backoff, "none"); d != backoff {
+		t.Errorf("none: expected %v, got %v", backoff, d)
+	}
+	for i := 0; i < 100; i++ {
+		if d := retryDelay(backoff, "equal"); d < backoff || d >= backoff+backoff/4 {
+			t.Fatalf("equal: %v outside [%v, %v)", d, backoff, backoff+backoff/4)
+		}
+		if d := retryDelay(backoff, "full"); d < 0 || d >= backoff {
+			t.Fatalf("full: %v outside [0, %v)", d, backoff)
+		}
+	}
+	if d := retryDelay(2*time.Nanosecond, "equal"); d != 2*time.Nanosecond {
+		t.Errorf("equal: expected tiny backoff unchanged, got %v", d)
+	}
+}
+
+// fakeRetryClock replaces the doWithRetry timer: waits return at once and are recorded.
+// Sessions of earlier tests have returned (see startHandler), so no doWithRetry call
+// outside the test reads the swapped timer.
+func fakeRetryClock(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var waits []time.Duration
+	prev := retryAfter
+	retryAfter = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	t.Cleanup(func() { retryAfter = prev })
+	return &waits
+}
+
+func TestMaxProcessingTime_StopsRetries(t *testing.T) {
+	initTestConfig(false)
+	config.MaxProcessingTimeSeconds = 1
+	config.RetryAttempts = 10
+	config.RetryInitialDelay = 300
+	config.RetryJitter = "none"
+	TokenCache.Store("budget@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("budget@example.com")
+
+	var attempts atomic.Int32
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	// Attempts at 0, 300ms and 900ms; the next backoff (1.2s) would end past the 1s
+	// budget, so the send gives up instead of running all 10 attempts
+	start := time.Now()
+	runConversation(t, []conversationStep{
+		{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00budget@example.com\x00pass")) + "\r\n", "235 2.7.0 Authentication successful"},
+		{"MAIL FROM:<budget@example.com>\r\n", "250 2.1.0 Ok"},
+		{"RCPT TO:<to@example.com>\r\n", "250 2.1.5 Ok"},
+		{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+		{"Subject: budget\r\n\r\nbody\r\n.\r\n", "451 4.3.0 Temporary delivery failure, try again later"},
+	})
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected a reply within the 1s budget, took %v", elapsed)
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("expected 3 attempts within the budget, got %d", got)
+	}
+
+	if got := sendTimeout(&parsedMessage{}); got != time.Second {
+		t.Errorf("expected sendTimeout capped at 1s, got %v", got)
+	}
+	if code, _ := sendErrorReply(fmt.Errorf("send: %w", context.DeadlineExceeded)); code != "451 4.3.0" {
+		t.Errorf("expected 451 for an expired deadline, got %s", code)
+	}
+}
+
+func TestDoWithRetry_BackoffSchedule(t *testing.T) {
+	initTestConfig(false)
+	waits := fakeRetryClock(t)
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	cfg := RetryConfig{
+		MaxAttempts:     5,
+		InitialBackoff:  100 * time.Millisecond,
+		MaxBackoff:      300 * time.Millisecond,
+		RetryableStatus: []int{503},
+		Jitter:          "none",
+	}
+	req, _ := http.NewRequest("POST", srv.URL, nil)
+	resp, err := doWithRetry(context.Background(), srv.Client(), req, []byte("{}"), cfg)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the last 503 with an error, got %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	if got := attempts.Load(); got != 5 {
+		t.Errorf("expected 5 attempts, got %d", got)
+	}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	if !slices.Equal(*waits, want) {
+		t.Errorf("expected backoff %v, got %v", want, *waits)
+	}
+
+	// An injected jitter source makes the jittered schedule deterministic too
+	*waits = nil
+	prevJitter := retryJitterInt63n
+	retryJitterInt63n = func(n int64) int64 { return n - 1 }
+	t.Cleanup(func() { retryJitterInt63n = prevJitter })
+	cfg.MaxAttempts, cfg.Jitter = 3, "equal"
+	if resp, _ := doWithRetry(context.Background(), srv.Client(), req, []byte("{}"), cfg); resp != nil {
+		resp.Body.Close()
+	}
+	want = []time.Duration{125*time.Millisecond - 1, 250*time.Millisecond - 1}
+	if !slices.Equal(*waits, want) {
+		t.Errorf("expected jittered backoff %v, got %v", want, *waits)
+	}
+}
+
+func TestDoWithRetry_LogsTarget(t *testing.T) {
+	initTestConfig(false)
+	fakeRetryClock(t)
+	var logs bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("POST", srv.URL, nil)
+	cfg := RetryConfig{MaxAttempts: 2, RetryableStatus: []int{503}, Jitter: "none", Target: "webhook call"}
+	if resp, _ := doWithRetry(context.Background(), srv.Client(), req, nil, cfg); resp != nil {
+		resp.Body.Close()
+	}
+	if !strings.Contains(logs.String(), `msg="Retrying webhook call"`) || strings.Contains(logs.String(), "Graph") {
+		t.Errorf("expected retries to be logged for the webhook, got: %s", logs.String())
+	}
+}
+
+func TestTokenCacheTTL(t *testing.T) {
+	initTestConfig(false)
+	tests := []struct {
+		skew, expiresIn int
+		want            time.Duration
+	}{
+		{60, 3599, 3539 * time.Second},  // default skew
+		{300, 3599, 3299 * time.Second}, // larger skew for drifting clocks
+		{5000, 3599, 30 * time.Second},  // skew beyond lifetime: minimum cache
+		{60, 20, 20 * time.Second},      // never cached past the token lifetime
+	}
+	for _, tt := range tests {
+		config.TokenRefreshSkewSeconds = tt.skew
+		if got := tokenCacheTTL(tt.expiresIn); got != tt.want {
+			t.Errorf("tokenCacheTTL(%d) with skew %d = %v, want %v", tt.expiresIn, tt.skew, got, tt.want)
+		}
+	}
+}
+
+func TestRequireTLSForAuth_Cleartext(t *testing.T) {
+	initTestConfig(false)
+	config.RequireTLSForAuth = true
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+
+	client.Write([]byte("EHLO test\r\n"))
+	for _, l := range readMultiline(reader) {
+		if strings.Contains(l, "AUTH") {
+			t.Errorf("expected no AUTH advertisement on cleartext connection, got: %s", l)
+		}
+	}
+
+	client.Write([]byte("AUTH LOGIN\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "538 5.7.11") {
+		t.Errorf("expected 538 for AUTH on cleartext connection, got: %s", resp)
+	}
+	client.Write([]byte("QUIT\r\n"))
+	readResponse(reader)
+}
+
+func TestEhloCapabilities_AuthAdvertisement(t *testing.T) {
+	initTestConfig(false)
+	if caps := ehloCapabilities(false, config.MaxMessageSize); !slices.Contains(caps, "AUTH LOGIN PLAIN") {
+		t.Errorf("expected AUTH advertised by default, got %v", caps)
+	}
+	config.RequireTLSForAuth = true
+	if caps := ehloCapabilities(false, config.MaxMessageSize); slices.Contains(caps, "AUTH LOGIN PLAIN") {
+		t.Errorf("expected no AUTH before TLS, got %v", caps)
+	}
+	if caps := ehloCapabilities(true, config.MaxMessageSize); !slices.Contains(caps, "AUTH LOGIN PLAIN") {
+		t.Errorf("expected AUTH advertised after TLS, got %v", caps)
+	}
+}
+
+func TestAuthMechanisms_DisabledRefused(t *testing.T) {
+	initTestConfig(false)
+	config.AuthMechanisms = []string{"PLAIN"}
+	TokenCache.Store("mech@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("mech@example.com")
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+
+	client.Write([]byte("EHLO test\r\n"))
+	if lines := readMultiline(reader); lines[len(lines)-1] != "250 AUTH PLAIN" {
+		t.Errorf("expected only PLAIN advertised, got %v", lines)
+	}
+	for _, cmd := range []string{"AUTH LOGIN", "AUTH CRAM-MD5", "AUTH"} {
+		client.Write([]byte(cmd + "\r\n"))
+		if resp := readResponse(reader); resp != "504 5.5.4 Unrecognized authentication type" {
+			t.Errorf("%s: expected 504, got: %s", cmd, resp)
+		}
+	}
+	if resp := authPlain(client, reader, "mech@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Errorf("expected enabled mechanism to work, got: %s", resp)
+	}
+}
+
+func TestDecodeMessage_Base64(t *testing.T) {
+	input := base64.StdEncoding.EncodeToString([]byte("hello world"))
+	decoded, err := decodeMessage("base64", strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("decodeMessage base64 failed: %v", err)
+	}
+	if string(decoded) != "hello world" {
+		t.Errorf("expected 'hello world', got '%s'", string(decoded))
+	}
+}
+
+func TestDecodeMessage_CTEWhitespaceAndCase(t *testing.T) {
+	initTestConfig(false)
+	input := base64.StdEncoding.EncodeToString([]byte("hello world"))
+	for _, cte := range []string{"Base64 ", "BASE64\t", " base64"} {
+		decoded, err := decodeMessage(cte, strings.NewReader(input))
+		if err != nil || string(decoded) != "hello world" {
+			t.Errorf("decodeMessage(%q) = %q, %v; want 'hello world'", cte, decoded, err)
+		}
+	}
+	for _, cte := range []string{"7bit", "8BIT", "binary "} {
+		decoded, err := decodeMessage(cte, strings.NewReader("plain text"))
+		if err != nil || string(decoded) != "plain text" {
+			t.Errorf("decodeMessage(%q) = %q, %v; want content unchanged", cte, decoded, err)
+		}
+	}
+
+	// Through the MIME parser, with the trailing space on the attachment header
+	raw := "Subject: CTE\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nbody\r\n" +
+		"--b\r\nContent-Type: application/pdf; name=a.pdf\r\nContent-Disposition: attachment; filename=a.pdf\r\nContent-Transfer-Encoding: Base64 \r\n\r\n" +
+		base64.StdEncoding.EncodeToString([]byte("%PDF-1.4 test")) + "\r\n--b--\r\n"
+	pm, err := parseSubjectBodyAndAttachments(raw)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if len(pm.attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(pm.attachments))
+	}
+	if got, _ := base64.StdEncoding.DecodeString(pm.attachments[0].Content); string(got) != "%PDF-1.4 test" {
+		t.Errorf("expected the attachment decoded once, got %q", got)
+	}
+}
+
+func TestDecodeMessage_QuotedPrintable(t *testing.T) {
+	input := "hello=20world=21"
+	decoded, err := decodeMessage("quoted-printable", strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("decodeMessage quoted-printable failed: %v", err)
+	}
+	if string(decoded) != "hello world!" {
+		t.Errorf("expected 'hello world!', got '%s'", string(decoded))
+	}
+}
+
+func TestDecodeMessage_Default(t *testing.T) {
+	input := "plain text"
+	decoded, err := decodeMessage("", strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("decodeMessage default failed: %v", err)
+	}
+	if string(decoded) != input {
+		t.Errorf("expected '%s', got '%s'", input, string(decoded))
+	}
+}
+
+func TestNormalizeLineEndings_8bitBodyPreserved(t *testing.T) {
+	body := "Gr\xc3\xbc\xc3\x9fe\rstill the same line\r\nsecond line\n\rthird\r\n"
+	msg := "Subject: 8bit test\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n" + body
+
+	normalized := normalizeLineEndings(msg)
+	if !strings.HasPrefix(normalized, "Subject: 8bit test\r\nContent-Type: text/plain; charset=utf-8\r\n") {
+		t.Errorf("expected header line endings normalized, got: %q", normalized)
+	}
+	if !strings.HasSuffix(normalized, "\r\n\r\n"+body) {
+		t.Errorf("expected 8bit body unmodified, got: %q", normalized)
+	}
+
+	pm, err := parseSubjectBodyAndAttachments(normalized)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pm.body != body {
+		t.Errorf("expected body with embedded CR bytes to survive, got: %q", pm.body)
+	}
+}
+
+func TestNormalizeLineEndings_MultipartEncodedPartsPreserved(t *testing.T) {
+	initTestConfig(false)
+	b64Body := "AAEC\rAwQF\r\nBgcI\n"         // bytes 0-8 with a bare CR and LF
+	binBody := "\x00\x01\rraw\nbytes\r\n\xff" // binary part with CR and LF bytes
+	msg := "Subject: parts\nMIME-Version: 1.0\nContent-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+		"--b1\nContent-Type: text/plain\n\nline1\rline2\n" +
+		"--b1\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"a.bin\"\r\nContent-Transfer-Encoding: base64\r\n\r\n" + b64Body + "\r\n" +
+		"--b1\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"b.bin\"\r\nContent-Transfer-Encoding: binary\r\n\r\n" + binBody + "\r\n" +
+		"--b1--\n"
+
+	normalized := normalizeLineEndings(msg)
+	if !strings.Contains(normalized, "\r\n\r\nline1\r\nline2\r\n--b1\r\n") {
+		t.Errorf("expected the text part normalized, got: %q", normalized)
+	}
+	for _, body := range []string{b64Body, binBody} {
+		if !strings.Contains(normalized, "\r\n\r\n"+body+"\r\n--b1") {
+			t.Errorf("expected part body %q unmodified, got: %q", body, normalized)
+		}
+	}
+
+	pm, err := parseSubjectBodyAndAttachments(normalized)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pm.attachments) != 2 {
+		t.Fatalf("expected 2 attachments, got %d", len(pm.attachments))
+	}
+	if got, _ := base64.StdEncoding.DecodeString(pm.attachments[0].Content); !bytes.Equal(got, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("expected base64 attachment decoded intact, got %v", got)
+	}
+	if got, _ := base64.StdEncoding.DecodeString(pm.attachments[1].Content); string(got) != binBody {
+		t.Errorf("expected binary attachment with CR/LF bytes intact, got %q", got)
+	}
+}
+
+func TestNormalizeLineEndings_7bitNormalized(t *testing.T) {
+	msg := "Subject: 7bit\n\nline1\rline2\nline3\r\n"
+	want := "Subject: 7bit\r\n\r\nline1\r\nline2\r\nline3\r\n"
+	if got := normalizeLineEndings(msg); got != want {
+		t.Errorf("normalizeLineEndings() = %q, want %q", got, want)
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_LenientHeaders(t *testing.T) {
+	initTestConfig(false)
+	raw := "From: test@example.com\r\nTo: you@example.com\r\nX-Mailer legacy app 1.0\r\n" +
+		"Subject: Nightly\r\n report\r\nContent-Type: text/html\r\n\r\n<p>Body: ok</p>\r\nnot a header\r\n"
+	if _, err := parseSubjectBodyAndAttachments(raw); err == nil {
+		t.Fatal("expected a parse error without lenient_header_parsing")
+	}
+
+	config.LenientHeaderParsing = true
+	pm, err := parseSubjectBodyAndAttachments(raw)
+	if err != nil {
+		t.Fatalf("expected lenient parsing to succeed, got: %v", err)
+	}
+	if pm.subject != "Nightly report" {
+		t.Errorf("expected folded subject salvaged, got %q", pm.subject)
+	}
+	if !pm.isHTML || pm.body != "<p>Body: ok</p>\r\nnot a header\r\n" {
+		t.Errorf("expected HTML body unchanged, got %q (html %v)", pm.body, pm.isHTML)
+	}
+	if !slices.Equal(pm.toAddrs, []string{"you@example.com"}) {
+		t.Errorf("expected To salvaged, got %v", pm.toAddrs)
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_Simple(t *testing.T) {
+	raw := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Hello\r\n\r\nThis is the body."
+	pm, err := parseSubjectBodyAndAttachments(raw)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if pm.subject != "Hello" {
+		t.Errorf("expected subject 'Hello', got '%s'", pm.subject)
+	}
+	// Accept both with and without trailing newline
+	expectedBody := "This is the body."
+	if strings.TrimRight(pm.body, "\r\n") != expectedBody {
+		t.Errorf("expected body '%s', got '%s'", expectedBody, pm.body)
+	}
+	if pm.isHTML {
+		t.Errorf("expected isHTML false, got true")
+	}
+	if len(pm.attachments) != 0 {
+		t.Errorf("expected 0 attachments, got %d", len(pm.attachments))
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_SimpleHTML(t *testing.T) {
+	raw := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Hello\r\nContent-Type: text/html\r\n\r\n<html><body>Hi!</body></html>"
+	pm, err := parseSubjectBodyAndAttachments(raw)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if pm.subject != "Hello" {
+		t.Errorf("expected subject 'Hello', got '%s'", pm.subject)
+	}
+	expectedBody := "<html><body>Hi!</body></html>"
+	if strings.TrimRight(pm.body, "\r\n") != expectedBody {
+		t.Errorf("expected body '%s', got '%s'", expectedBody, pm.body)
+	}
+	if !pm.isHTML {
+		t.Errorf("expected isHTML true, got false")
+	}
+	if len(pm.attachments) != 0 {
+		t.Errorf("expected 0 attachments, got %d", len(pm.attachments))
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_MultipartWithAttachment(t *testing.T) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	boundary := w.Boundary()
+	// Body part
+	bodyPart, _ := w.CreatePart(map[string][]string{
+		"Content-Type":              {"text/plain"},
+		"Content-Transfer-Encoding": {"7bit"},
+	})
+	bodyPart.Write([]byte("This is the body."))
+	// Attachment part
+	attPart, _ := w.CreatePart(map[string][]string{
+		"Content-Type":              {"text/plain; name=\"file.txt\""},
+		"Content-Disposition":       {"attachment; filename=\"file.txt\""},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	attContent := base64.StdEncoding.EncodeToString([]byte("file content"))
+	attPart.Write([]byte(attContent))
+	w.Close()
+	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Multipart\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if pm.subject != "Multipart" {
+		t.Errorf("expected subject 'Multipart', got '%s'", pm.subject)
+	}
+	if strings.TrimRight(pm.body, "\r\n") != "This is the body." {
+		t.Errorf("expected body 'This is the body.', got '%s'", pm.body)
+	}
+	if pm.isHTML {
+		t.Errorf("expected isHTML false, got true")
+	}
+	if len(pm.attachments) != 1 {
+		t.Errorf("expected 1 attachment, got %d", len(pm.attachments))
+	}
+	if pm.attachments[0].Filename != "file.txt" {
+		t.Errorf("expected attachment filename 'file.txt', got '%s'", pm.attachments[0].Filename)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(pm.attachments[0].Content)
+	if string(decoded) != "file content" {
+		t.Errorf("expected attachment content 'file content', got '%s'", string(decoded))
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_MultipartHTMLBody(t *testing.T) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	boundary := w.Boundary()
+	// HTML body part
+	bodyPart, _ := w.CreatePart(map[string][]string{
+		"Content-Type":              {"text/html"},
+		"Content-Transfer-Encoding": {"7bit"},
+	})
+	bodyPart.Write([]byte("<b>HTML Body</b>"))
+	w.Close()
+	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: HTMLMultipart\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if pm.subject != "HTMLMultipart" {
+		t.Errorf("expected subject 'HTMLMultipart', got '%s'", pm.subject)
+	}
+	if strings.TrimRight(pm.body, "\r\n") != "<b>HTML Body</b>" {
+		t.Errorf("expected body '<b>HTML Body</b>', got '%s'", pm.body)
+	}
+	if !pm.isHTML {
+		t.Errorf("expected isHTML true, got false")
+	}
+	if len(pm.attachments) != 0 {
+		t.Errorf("expected 0 attachments, got %d", len(pm.attachments))
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_MultipartNoBody(t *testing.T) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	boundary := w.Boundary()
+	// Only attachment, no body part
+	attPart, _ := w.CreatePart(map[string][]string{
+		"Content-Type":              {"application/octet-stream; name=\"file.bin\""},
+		"Content-Disposition":       {"attachment; filename=\"file.bin\""},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	attContent := base64.StdEncoding.EncodeToString([]byte("binarydata"))
+	attPart.Write([]byte(attContent))
+	w.Close()
+	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: OnlyAttachment\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if pm.subject != "OnlyAttachment" {
+		t.Errorf("expected subject 'OnlyAttachment', got '%s'", pm.subject)
+	}
+	if pm.body != "" {
+		t.Errorf("expected empty body, got '%s'", pm.body)
+	}
+	if pm.isHTML {
+		t.Errorf("expected isHTML false, got true")
+	}
+	if len(pm.attachments) != 1 {
+		t.Errorf("expected 1 attachment, got %d", len(pm.attachments))
+	}
+	if pm.attachments[0].Filename != "file.bin" {
+		t.Errorf("expected attachment filename 'file.bin', got '%s'", pm.attachments[0].Filename)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(pm.attachments[0].Content)
+	if string(decoded) != "binarydata" {
+		t.Errorf("expected attachment content 'binarydata', got '%s'", string(decoded))
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_EncodedSubject(t *testing.T) {
+	raw := "From: test@example.com\r\nTo: you@example.com\r\nSubject: =?UTF-8?B?SGVsbG8g8J+agA==?=\r\n\r\nBody"
+	pm, err := parseSubjectBodyAndAttachments(raw)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if pm.subject != "Hello 🚀" {
+		t.Errorf("expected subject 'Hello 🚀', got '%s'", pm.subject)
+	}
+	if strings.TrimRight(pm.body, "\r\n") != "Body" {
+		t.Errorf("expected body 'Body', got '%s'", pm.body)
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_MaxMultipartDepth(t *testing.T) {
+	initTestConfig(false)
+	config.MaxMultipartDepth = 2
+
+	// Each level holds an attachment named after its depth and the next level
+	nested := func(levels int) string {
+		body := "--b" + strconv.Itoa(levels) + "\r\nContent-Type: text/plain\r\n\r\ninnermost\r\n--b" + strconv.Itoa(levels) + "--\r\n"
+		for depth := levels - 1; depth >= 0; depth-- {
+			b, inner := "b"+strconv.Itoa(depth), "b"+strconv.Itoa(depth+1)
+			body = "--" + b + "\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=level" + strconv.Itoa(depth) + ".txt\r\n\r\nlevel " + strconv.Itoa(depth) + "\r\n" +
+				"--" + b + "\r\nContent-Type: multipart/mixed; boundary=" + inner + "\r\n\r\n" + body + "--" + b + "--\r\n"
+		}
+		return "Subject: Deep\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b0\r\n\r\n" + body
+	}
+
+	pm, err := parseSubjectBodyAndAttachments(nested(6))
+	if err != nil {
+		t.Fatalf("expected deep nesting handled gracefully, got: %v", err)
+	}
+	var names []string
+	for _, a := range pm.attachments {
+		names = append(names, a.Filename)
+	}
+	if want := []string{"level0.txt", "level1.txt", "level2.txt"}; !slices.Equal(names, want) {
+		t.Errorf("expected attachments %v above the limit, got %v", want, names)
+	}
+	if pm.body != "" {
+		t.Errorf("expected the innermost body ignored, got %q", pm.body)
+	}
+
+	// Far beyond the default limit
+	config.MaxMultipartDepth = 0
+	if _, err := parseSubjectBodyAndAttachments(nested(500)); err != nil {
+		t.Errorf("expected 500 nested levels handled gracefully, got: %v", err)
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_NestedMultipartMixedAlternative(t *testing.T) {
+	// Build inner multipart/alternative with text and HTML
+	var innerBuf bytes.Buffer
+	innerWriter := multipart.NewWriter(&innerBuf)
+	innerBoundary := innerWriter.Boundary()
+	textPart, _ := innerWriter.CreatePart(map[string][]string{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"7bit"},
+	})
+	textPart.Write([]byte("Plain body"))
+	htmlPart, _ := innerWriter.CreatePart(map[string][]string{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"7bit"},
+	})
+	htmlPart.Write([]byte("<b>HTML body</b>"))
+	innerWriter.Close()
+
+	// Build outer multipart/mixed with the inner alternative + attachment
+	var outerBuf bytes.Buffer
+	outerWriter := multipart.NewWriter(&outerBuf)
+	outerBoundary := outerWriter.Boundary()
+	altPart, _ := outerWriter.CreatePart(map[string][]string{
+		"Content-Type": {"multipart/alternative; boundary=\"" + innerBoundary + "\""},
+	})
+	altPart.Write(innerBuf.Bytes())
+	attPart, _ := outerWriter.CreatePart(map[string][]string{
+		"Content-Type":              {"application/pdf; name=\"doc.pdf\""},
+		"Content-Disposition":       {"attachment; filename=\"doc.pdf\""},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	attPart.Write([]byte(base64.StdEncoding.EncodeToString([]byte("pdf content"))))
+	outerWriter.Close()
+
+	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Nested\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + outerBoundary + "\"\r\n\r\n" + outerBuf.String()
+
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if pm.subject != "Nested" {
+		t.Errorf("expected subject 'Nested', got '%s'", pm.subject)
+	}
+	if strings.TrimRight(pm.body, "\r\n") != "<b>HTML body</b>" {
+		t.Errorf("expected HTML body '<b>HTML body</b>', got '%s'", pm.body)
+	}
+	if !pm.isHTML {
+		t.Errorf("expected isHTML true, got false")
+	}
+	if len(pm.attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(pm.attachments))
+	}
+	if pm.attachments[0].Filename != "doc.pdf" {
+		t.Errorf("expected attachment filename 'doc.pdf', got '%s'", pm.attachments[0].Filename)
 	}
 }
 
 func TestParseSubjectBodyAndAttachments_MultipartAlternativePreferHTML(t *testing.T) {
 	var buf bytes.Buffer
 	w := multipart.NewWriter(&buf)
-	boundary := w.Boundary()
-	textPart, _ := w.CreatePart(map[string][]string{
-		"Content-Type":              {"text/plain"},
-		"Content-Transfer-Encoding": {"7bit"},
-	})
-	textPart.Write([]byte("Plain"))
-	htmlPart, _ := w.CreatePart(map[string][]string{
-		"Content-Type":              {"text/html"},
-		"Content-Transfer-Encoding": {"7bit"},
+	boundary := w.Boundary()
+	textPart, _ := w.CreatePart(map[string][]string{
+		"Content-Type":              {"text/plain"},
+		"Content-Transfer-Encoding": {"7bit"},
+	})
+	textPart.Write([]byte("Plain"))
+	htmlPart, _ := w.CreatePart(map[string][]string{
+		"Content-Type":              {"text/html"},
+		"Content-Transfer-Encoding": {"7bit"},
+	})
+	htmlPart.Write([]byte("<b>HTML</b>"))
+	w.Close()
+
+	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Alt\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
+
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if strings.TrimRight(pm.body, "\r\n") != "<b>HTML</b>" {
+		t.Errorf("expected body '<b>HTML</b>', got '%s'", pm.body)
+	}
+	if !pm.isHTML {
+		t.Errorf("expected isHTML true, got false")
+	}
+	if len(pm.attachments) != 0 {
+		t.Errorf("expected 0 attachments, got %d", len(pm.attachments))
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_MultipartAlternativePlainOnly(t *testing.T) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	boundary := w.Boundary()
+	textPart, _ := w.CreatePart(map[string][]string{
+		"Content-Type":              {"text/plain"},
+		"Content-Transfer-Encoding": {"7bit"},
+	})
+	textPart.Write([]byte("Just plain text"))
+	w.Close()
+
+	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: PlainOnly\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
+
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if strings.TrimRight(pm.body, "\r\n") != "Just plain text" {
+		t.Errorf("expected body 'Just plain text', got '%s'", pm.body)
+	}
+	if pm.isHTML {
+		t.Errorf("expected isHTML false, got true")
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_InlineTextWithFilenameIsBody(t *testing.T) {
+	msg := "Subject: Inline body\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Disposition: inline; filename=\"body.html\"\r\n\r\n" +
+		"<p>The real body</p>\r\n" +
+		"--b--\r\n"
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !pm.isHTML || !strings.Contains(pm.body, "The real body") {
+		t.Errorf("expected inline text part as HTML body, got: %q", pm.body)
+	}
+	if len(pm.attachments) != 0 {
+		t.Errorf("expected no attachments, got %d", len(pm.attachments))
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_InlineImageWithoutContentID(t *testing.T) {
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\nfake"))
+	msg := "Subject: Inline image\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"See picture\r\n" +
+		"--b\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Disposition: INLINE; filename=\"photo.png\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		png + "\r\n" +
+		"--b--\r\n"
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.TrimSpace(pm.body) != "See picture" {
+		t.Errorf("expected text body to be kept, got: %q", pm.body)
+	}
+	if len(pm.attachments) != 1 || pm.attachments[0].Filename != "photo.png" {
+		t.Fatalf("expected photo.png attachment, got %+v", pm.attachments)
+	}
+	if pm.attachments[0].IsInline {
+		t.Error("expected a regular attachment without Content-ID to reference")
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_DeliveryStatusReport(t *testing.T) {
+	initTestConfig(false)
+	msg := "From: MAILER-DAEMON@example.com\r\n" +
+		"Subject: Undelivered Mail Returned to Sender\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"dsn\"\r\n" +
+		"\r\n" +
+		"--dsn\r\n" +
+		"Content-Type: text/plain; charset=us-ascii\r\n" +
+		"\r\n" +
+		"Your message could not be delivered to nobody@example.org.\r\n" +
+		"--dsn\r\n" +
+		"Content-Type: message/delivery-status\r\n" +
+		"\r\n" +
+		"Reporting-MTA: dns; mx.example.com\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; nobody@example.org\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"--dsn\r\n" +
+		"Content-Type: text/rfc822-headers\r\n" +
+		"\r\n" +
+		"Subject: Original message\r\n" +
+		"--dsn--\r\n"
+
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pm.isHTML || !strings.Contains(pm.body, "could not be delivered") {
+		t.Errorf("expected human-readable part as plain body, got: %q", pm.body)
+	}
+	if len(pm.attachments) != 2 {
+		t.Fatalf("expected 2 attachments (delivery-status, headers), got %d", len(pm.attachments))
+	}
+	status := pm.attachments[0]
+	if status.Filename != "delivery-status.txt" || status.ContentType != "message/delivery-status" {
+		t.Errorf("unexpected delivery-status attachment: %s (%s)", status.Filename, status.ContentType)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(status.Content)
+	if !strings.Contains(string(decoded), "Status: 5.1.1") {
+		t.Errorf("expected delivery-status content to survive, got: %q", decoded)
+	}
+	if pm.attachments[1].Filename != "original-headers.txt" {
+		t.Errorf("expected original-headers.txt, got %s", pm.attachments[1].Filename)
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_AttachmentDecodeFailure(t *testing.T) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	body, _ := w.CreatePart(map[string][]string{"Content-Type": {"text/plain"}})
+	body.Write([]byte("see attachment"))
+	att, _ := w.CreatePart(map[string][]string{
+		"Content-Type":              {"application/pdf"},
+		"Content-Disposition":       {"attachment; filename=\"invoice.pdf\""},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	att.Write([]byte("!!!not*base64!!!"))
+	w.Close()
+	msg := "Subject: corrupt\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + w.Boundary() + "\"\r\n\r\n" + buf.String()
+
+	initTestConfig(false)
+	config.AttachmentDecodeFailure = "fail"
+	if _, err := parseSubjectBodyAndAttachments(msg); err == nil || !strings.Contains(err.Error(), "invoice.pdf") {
+		t.Errorf("expected decode error in fail mode, got: %v", err)
+	}
+
+	config.AttachmentDecodeFailure = "skip"
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if len(pm.attachments) != 0 || pm.body != "see attachment" {
+		t.Errorf("expected attachment skipped in skip mode, got %d attachments, body %q", len(pm.attachments), pm.body)
+	}
+
+	config.AttachmentDecodeFailure = "placeholder"
+	pm, err = parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if len(pm.attachments) != 1 {
+		t.Fatalf("expected placeholder attachment, got %d", len(pm.attachments))
+	}
+	placeholder := pm.attachments[0]
+	content, _ := base64.StdEncoding.DecodeString(placeholder.Content)
+	if placeholder.Filename != "invoice.pdf.txt" || !strings.HasPrefix(placeholder.ContentType, "text/plain") ||
+		!strings.Contains(string(content), `"invoice.pdf" could not be decoded`) {
+		t.Errorf("unexpected placeholder %+v with content %q", placeholder, content)
+	}
+
+	// strict_attachments keeps working as shorthand for fail
+	initTestConfig(false)
+	config.StrictAttachments = true
+	if _, err := parseSubjectBodyAndAttachments(msg); err == nil {
+		t.Error("expected decode error with strict_attachments")
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_SniffContentType(t *testing.T) {
+	pdf := []byte("%PDF-1.7\n1 0 obj\n<< /Type /Catalog >>\nendobj\n")
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0, 0, 0, 0x0d, 'I', 'H', 'D', 'R'}
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	body, _ := w.CreatePart(map[string][]string{"Content-Type": {"text/plain"}})
+	body.Write([]byte("scans attached"))
+	for _, part := range []struct {
+		filename, contentType string
+		data                  []byte
+	}{
+		{"scan.pdf", "application/octet-stream; name=\"scan.pdf\"", pdf},
+		{"photo.png", "", png},
+		{"declared.bin", "application/x-custom", pdf},
+	} {
+		header := map[string][]string{
+			"Content-Disposition":       {"attachment; filename=\"" + part.filename + "\""},
+			"Content-Transfer-Encoding": {"base64"},
+		}
+		if part.contentType != "" {
+			header["Content-Type"] = []string{part.contentType}
+		}
+		pw, _ := w.CreatePart(header)
+		pw.Write([]byte(base64.StdEncoding.EncodeToString(part.data)))
+	}
+	w.Close()
+	msg := "Subject: scans\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + w.Boundary() + "\"\r\n\r\n" + buf.String()
+
+	types := func() []string {
+		pm, err := parseSubjectBodyAndAttachments(msg)
+		if err != nil {
+			t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+		}
+		var types []string
+		for _, att := range pm.attachments {
+			types = append(types, att.ContentType)
+		}
+		return types
+	}
+
+	initTestConfig(false)
+	if got, want := types(), []string{"application/pdf", "image/png", "application/x-custom"}; !slices.Equal(got, want) {
+		t.Errorf("expected sniffed types %v, got %v", want, got)
+	}
+
+	disabled := false
+	config.SniffAttachmentContentType = &disabled
+	if got, want := types(), []string{"application/octet-stream; name=\"scan.pdf\"", "application/octet-stream", "application/x-custom"}; !slices.Equal(got, want) {
+		t.Errorf("expected declared types with sniffing disabled %v, got %v", want, got)
+	}
+}
+
+func TestBlockedAttachment(t *testing.T) {
+	initTestConfig(false)
+	config.BlockedAttachmentExtensions = []string{".exe", ".scr", ".js", ".vbs"}
+	for _, tc := range []struct {
+		filename string
+		blocked  bool
+	}{
+		{"setup.exe", true},
+		{"SETUP.EXE", true},
+		{"invoice.pdf.exe", true},
+		{"invoice.pdf.exe.", true},
+		{"invoice.pdf.scr  ", true},
+		{"report.pdf", false},
+		{"setup.exe.pdf", false},
+		{"notes.json", false},
+		{"exe", false},
+	} {
+		pm := &parsedMessage{attachments: []Attachment{{Filename: "readme.txt"}, {Filename: tc.filename}}}
+		if got := blockedAttachment(pm); (got != "") != tc.blocked {
+			t.Errorf("%q: expected blocked=%v, got %q", tc.filename, tc.blocked, got)
+		}
+	}
+
+	config.BlockedAttachmentExtensions = nil
+	if got := blockedAttachment(&parsedMessage{attachments: []Attachment{{Filename: "setup.exe"}}}); got != "" {
+		t.Errorf("expected nothing blocked without blocked_attachment_extensions, got %q", got)
+	}
+}
+
+func TestBlockedAttachment_SMTPReply(t *testing.T) {
+	initTestConfig(true)
+	config.BlockedAttachmentExtensions = []string{".exe"}
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	client.Write([]byte("MAIL FROM:<sender@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("DATA\r\n"))
+	readResponse(reader) // 354
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	body, _ := w.CreatePart(map[string][]string{"Content-Type": {"text/plain"}})
+	body.Write([]byte("your invoice"))
+	att, _ := w.CreatePart(map[string][]string{
+		"Content-Type":              {"application/octet-stream"},
+		"Content-Disposition":       {"attachment; filename=\"invoice.pdf.exe\""},
+		"Content-Transfer-Encoding": {"base64"},
 	})
-	htmlPart.Write([]byte("<b>HTML</b>"))
+	att.Write([]byte(base64.StdEncoding.EncodeToString([]byte("MZ\x90\x00"))))
 	w.Close()
+	go client.Write([]byte("Subject: invoice\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + w.Boundary() + "\"\r\n\r\n" + buf.String() + "\r\n.\r\n"))
+	if resp := readResponse(reader); resp != "550 5.7.1 Attachment type not allowed: invoice.pdf.exe" {
+		t.Errorf("expected 550 for blocked attachment, got: %s", resp)
+	}
+}
 
-	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Alt\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
+func TestParseSubjectBodyAndAttachments_DanglingCID(t *testing.T) {
+	initTestConfig(false)
+	var relBuf bytes.Buffer
+	relWriter := multipart.NewWriter(&relBuf)
+	htmlPart, _ := relWriter.CreatePart(map[string][]string{
+		"Content-Type": {"text/html; charset=utf-8"},
+	})
+	htmlPart.Write([]byte(`<p><img src="cid:logo@x" alt="logo"><img src="cid:missing@x" alt="gone"></p>`))
+	inlinePart, _ := relWriter.CreatePart(map[string][]string{
+		"Content-Type":              {"image/png"},
+		"Content-Disposition":       {"inline"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Id":                {"<logo@x>"},
+	})
+	inlinePart.Write([]byte(base64.StdEncoding.EncodeToString([]byte{0x89, 0x50, 0x4E, 0x47})))
+	relWriter.Close()
+	msg := "Subject: cid\r\nMIME-Version: 1.0\r\nContent-Type: multipart/related; boundary=\"" + relWriter.Boundary() + "\"\r\n\r\n" + relBuf.String()
 
-	_, body, isHTML, attachments, _, _, err := parseSubjectBodyAndAttachments(msg)
+	// Default: the dangling reference is only logged
+	pm, err := parseSubjectBodyAndAttachments(msg)
 	if err != nil {
 		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
 	}
-	if strings.TrimRight(body, "\r\n") != "<b>HTML</b>" {
-		t.Errorf("expected body '<b>HTML</b>', got '%s'", body)
+	if !strings.Contains(pm.body, "cid:missing@x") {
+		t.Errorf("expected body unchanged without strip_dangling_cid_images, got %q", pm.body)
 	}
-	if !isHTML {
-		t.Errorf("expected isHTML true, got false")
+
+	config.StripDanglingCIDImages = true
+	pm, err = parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
 	}
-	if len(attachments) != 0 {
-		t.Errorf("expected 0 attachments, got %d", len(attachments))
+	if got := strings.TrimRight(pm.body, "\r\n"); got != `<p><img src="cid:logo@x" alt="logo"></p>` {
+		t.Errorf("expected only the dangling image removed, got %q", got)
 	}
 }
 
-func TestParseSubjectBodyAndAttachments_MultipartAlternativePlainOnly(t *testing.T) {
-	var buf bytes.Buffer
-	w := multipart.NewWriter(&buf)
-	boundary := w.Boundary()
-	textPart, _ := w.CreatePart(map[string][]string{
-		"Content-Type":              {"text/plain"},
-		"Content-Transfer-Encoding": {"7bit"},
-	})
-	textPart.Write([]byte("Just plain text"))
-	w.Close()
-
-	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: PlainOnly\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
+func TestParseSubjectBodyAndAttachments_AttachmentWithContentID(t *testing.T) {
+	initTestConfig(false)
+	imgB64 := base64.StdEncoding.EncodeToString([]byte{0x89, 0x50, 0x4E, 0x47})
+	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Cid\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/related; boundary=\"b1\"\r\n\r\n" +
+		"--b1\r\nContent-Type: text/html\r\n\r\n<img src=\"cid:logo@example.com\">\r\n" +
+		"--b1\r\nContent-Type: image/png\r\nContent-Disposition: attachment; filename=\"logo.png\"\r\n" +
+		"Content-ID: <logo@example.com>\r\nContent-Transfer-Encoding: base64\r\n\r\n" + imgB64 + "\r\n" +
+		"--b1\r\nContent-Type: image/png\r\nContent-Disposition: attachment; filename=\"other.png\"\r\n" +
+		"Content-ID: <other@example.com>\r\nContent-Transfer-Encoding: base64\r\n\r\n" + imgB64 + "\r\n" +
+		"--b1--\r\n"
 
-	_, body, isHTML, _, _, _, err := parseSubjectBodyAndAttachments(msg)
+	pm, err := parseSubjectBodyAndAttachments(msg)
 	if err != nil {
 		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
 	}
-	if strings.TrimRight(body, "\r\n") != "Just plain text" {
-		t.Errorf("expected body 'Just plain text', got '%s'", body)
+	if len(pm.attachments) != 2 {
+		t.Fatalf("expected 2 attachments, got %d", len(pm.attachments))
 	}
-	if isHTML {
-		t.Errorf("expected isHTML false, got true")
+	// Referenced by the HTML body: inline, so the cid: reference resolves
+	if att := pm.attachments[0]; !att.IsInline || att.ContentID != "logo@example.com" {
+		t.Errorf("expected referenced attachment inline with its Content-ID, got %+v", att)
+	}
+	// Not referenced: stays a regular attachment but keeps its Content-ID
+	if att := pm.attachments[1]; att.IsInline || att.ContentID != "other@example.com" {
+		t.Errorf("expected unreferenced attachment not inline with its Content-ID, got %+v", att)
+	}
+
+	payload, err := json.Marshal(buildGraphMessage("test@example.com", []string{"you@example.com"}, pm))
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	for _, want := range []string{`"contentId":"logo@example.com","contentType":"image/png","isInline":true`, `"contentId":"other@example.com","contentType":"image/png","name":"other.png"`} {
+		if !strings.Contains(string(payload), want) {
+			t.Errorf("expected %s in payload, got: %s", want, payload)
+		}
+	}
+}
+
+func TestParseSubjectBodyAndAttachments_ReportScopedToItsPart(t *testing.T) {
+	initTestConfig(false)
+	// A bounce forwarded as one part of a multipart/mixed message: the report rules
+	// apply inside the report only, the parts after it are parsed as usual
+	msg := "Subject: Fwd: bounce\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"dsn\"\r\n" +
+		"\r\n" +
+		"--dsn\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Delivery failed.\r\n" +
+		"--dsn\r\n" +
+		"Content-Type: message/delivery-status\r\n" +
+		"\r\n" +
+		"Status: 5.1.1\r\n" +
+		"--dsn--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See the bounce above.\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/rfc822-headers\r\n" +
+		"\r\n" +
+		"Subject: not part of a report\r\n" +
+		"--outer--\r\n"
+
+	pm, err := parseSubjectBodyAndAttachments(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pm.attachments) != 1 || pm.attachments[0].Filename != "delivery-status.txt" {
+		t.Fatalf("expected only the delivery-status part as attachment, got %v", pm.attachments)
+	}
+	if strings.Contains(pm.body, "Delivery failed.") || !strings.Contains(pm.body, "not part of a report") {
+		t.Errorf("expected the parts after the report to be parsed as usual, got body %q", pm.body)
 	}
 }
 
@@ -503,29 +2233,29 @@ func TestParseSubjectBodyAndAttachments_InlineImage(t *testing.T) {
 
 	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: InlineImg\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + mixedBoundary + "\"\r\n\r\n" + mixedBuf.String()
 
-	subject, body, isHTML, attachments, _, _, err := parseSubjectBodyAndAttachments(msg)
+	pm, err := parseSubjectBodyAndAttachments(msg)
 	if err != nil {
 		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
 	}
-	if subject != "InlineImg" {
-		t.Errorf("expected subject 'InlineImg', got '%s'", subject)
+	if pm.subject != "InlineImg" {
+		t.Errorf("expected subject 'InlineImg', got '%s'", pm.subject)
 	}
-	if strings.TrimRight(body, "\r\n") != "<html><body><img src=\"cid:img001\"></body></html>" {
-		t.Errorf("expected HTML body with cid reference, got '%s'", body)
+	if strings.TrimRight(pm.body, "\r\n") != "<html><body><img src=\"cid:img001\"></body></html>" {
+		t.Errorf("expected HTML body with cid reference, got '%s'", pm.body)
 	}
-	if !isHTML {
+	if !pm.isHTML {
 		t.Errorf("expected isHTML true, got false")
 	}
-	if len(attachments) != 2 {
-		t.Fatalf("expected 2 attachments, got %d", len(attachments))
+	if len(pm.attachments) != 2 {
+		t.Fatalf("expected 2 attachments, got %d", len(pm.attachments))
 	}
 	// Find inline attachment
 	var inlineAtt, regularAtt *Attachment
-	for i := range attachments {
-		if attachments[i].IsInline {
-			inlineAtt = &attachments[i]
+	for i := range pm.attachments {
+		if pm.attachments[i].IsInline {
+			inlineAtt = &pm.attachments[i]
 		} else {
-			regularAtt = &attachments[i]
+			regularAtt = &pm.attachments[i]
 		}
 	}
 	if inlineAtt == nil {
@@ -537,11 +2267,577 @@ func TestParseSubjectBodyAndAttachments_InlineImage(t *testing.T) {
 	if inlineAtt.Filename != "logo.png" {
 		t.Errorf("expected inline filename 'logo.png', got '%s'", inlineAtt.Filename)
 	}
-	if regularAtt == nil {
-		t.Fatal("expected a regular attachment, found none")
+	if regularAtt == nil {
+		t.Fatal("expected a regular attachment, found none")
+	}
+	if regularAtt.Filename != "report.pdf" {
+		t.Errorf("expected regular attachment filename 'report.pdf', got '%s'", regularAtt.Filename)
+	}
+}
+
+func TestBuildGraphMessage_Categories(t *testing.T) {
+	initTestConfig(false)
+	raw := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Invoice\r\nX-Categories: Billing, Automated\r\n\r\nBody"
+	pm, err := parseSubjectBodyAndAttachments(raw)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	payload, err := json.Marshal(buildGraphMessage("test@example.com", []string{"you@example.com"}, pm))
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	if !strings.Contains(string(payload), `"categories":["Billing","Automated"]`) {
+		t.Errorf("expected categories in payload, got: %s", payload)
+	}
+}
+
+func TestBuildGraphMessage_NoCategories(t *testing.T) {
+	initTestConfig(false)
+	pm := &parsedMessage{subject: "Hi", body: "Body"}
+	if _, ok := buildGraphMessage("test@example.com", []string{"you@example.com"}, pm)["categories"]; ok {
+		t.Error("expected no categories field when X-Categories is absent")
+	}
+}
+
+func TestSendMailGraphAPI_SuccessStatuses(t *testing.T) {
+	initTestConfig(false)
+	var logs bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	status := 0
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	pm := &parsedMessage{subject: "s", body: "b"}
+	for _, tc := range []struct {
+		status int
+		log    string
+	}{
+		{http.StatusOK, "Graph API request succeeded"},
+		{http.StatusAccepted, "Graph API accepted message for delivery"},
+		{http.StatusNoContent, "Graph API request succeeded"},
+		{http.StatusPartialContent, "Unexpected Graph API success status"},
+	} {
+		status = tc.status
+		logs.Reset()
+		if _, err := sendMailGraphAPI(context.Background(), "tok", "user@example.com", "user@example.com", []string{"to@example.com"}, pm); err != nil {
+			t.Errorf("status %d: expected success, got %v", tc.status, err)
+		}
+		if !strings.Contains(logs.String(), tc.log) {
+			t.Errorf("status %d: expected log %q, got: %s", tc.status, tc.log, logs.String())
+		}
+	}
+}
+
+func TestSendMailGraphAPI_UseMeEndpoint(t *testing.T) {
+	initTestConfig(false)
+	var paths []string
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	pm := &parsedMessage{subject: "s", body: "b"}
+	send := func() {
+		if _, err := sendMailGraphAPI(context.Background(), "tok", "j.doe@corp.example.com", "jane@example.com", []string{"to@example.com"}, pm); err != nil {
+			t.Fatalf("sendMailGraphAPI failed: %v", err)
+		}
+	}
+	send()
+	config.UseMeEndpoint = true
+	send()
+	if want := []string{"/users/j.doe@corp.example.com/sendMail", "/me/sendMail"}; !slices.Equal(paths, want) {
+		t.Errorf("expected paths %v, got %v", want, paths)
+	}
+}
+
+func TestSendMailGraphAPI_GraphTimeout(t *testing.T) {
+	initTestConfig(false)
+	config.GraphTimeoutSeconds = 1
+	config.RetryAttempts = 1
+	release := make(chan struct{})
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // a hung Graph request
+	}))
+	defer graph.Close()
+	defer close(release)
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	// The context allows far more; the request timeout ends the hung call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	_, err := sendMailGraphAPI(ctx, "tok", "from@example.com", "from@example.com", []string{"to@example.com"}, &parsedMessage{subject: "s", body: "b"})
+	if err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the request to time out after graph_timeout_seconds, took %v", elapsed)
+	}
+	if graphHTTPClient.Timeout != 0 {
+		t.Errorf("expected the shared client unchanged, got timeout %v", graphHTTPClient.Timeout)
+	}
+}
+
+func TestSendMailGraphAPI_CreateDraft(t *testing.T) {
+	initTestConfig(false)
+	var paths []string
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		var msg map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+		if _, wrapped := msg["message"]; wrapped {
+			t.Error("draft payload must be the message itself, not a sendMail wrapper")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"AAMkADraft123"}`))
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	pm, err := parseSubjectBodyAndAttachments("Subject: Review me\r\nX-Create-Draft: true\r\n\r\nDraft body\r\n")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if !pm.createDraft {
+		t.Fatal("expected X-Create-Draft: true to request a draft")
+	}
+
+	id, err := sendMailGraphAPI(context.Background(), "tok", "user@example.com", "user@example.com", []string{"to@example.com"}, pm)
+	if err != nil {
+		t.Fatalf("sendMailGraphAPI failed: %v", err)
+	}
+	if id != "AAMkADraft123" {
+		t.Errorf("expected draft id AAMkADraft123, got %q", id)
+	}
+	if len(paths) != 1 || paths[0] != "/users/user@example.com/messages" {
+		t.Errorf("expected a single POST to /users/user@example.com/messages, got %v", paths)
+	}
+}
+
+func TestReceivedHeader_Format(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 50123}
+	now := time.Date(2025, 3, 14, 9, 26, 53, 0, time.FixedZone("CET", 3600))
+
+	got := receivedHeader("printer.local", remote, "scanner@example.com", false, false, now)
+	want := "from printer.local ([192.0.2.10]) by " + relayHostname + " with ESMTPA (user scanner@example.com); Fri, 14 Mar 2025 09:26:53 +0100"
+	if got != want {
+		t.Errorf("unexpected Received header:\n got: %s\nwant: %s", got, want)
+	}
+
+	if got := receivedHeader("", remote, "fallback@example.com", true, false, now); !strings.HasPrefix(got, "from unknown ([192.0.2.10]) by ") || !strings.Contains(got, " with ESMTP (user fallback@example.com); ") {
+		t.Errorf("unexpected anonymous Received header: %s", got)
+	}
+}
+
+func TestBuildGraphMessage_InternetMessageHeaders(t *testing.T) {
+	pm := &parsedMessage{subject: "s", body: "b", headers: []messageHeader{{Name: "X-Received", Value: "from a by b"}}}
+	msg := buildGraphMessage("from@example.com", []string{"to@example.com"}, pm)
+	b, _ := json.Marshal(msg)
+	if !strings.Contains(string(b), `"internetMessageHeaders":[{"name":"X-Received","value":"from a by b"}]`) {
+		t.Errorf("expected internetMessageHeaders in payload, got: %s", b)
+	}
+
+	msg = buildGraphMessage("from@example.com", []string{"to@example.com"}, &parsedMessage{})
+	if _, ok := msg["internetMessageHeaders"]; ok {
+		t.Error("expected no internetMessageHeaders without custom headers")
+	}
+}
+
+func TestBuildGraphMessage_StripHeaders(t *testing.T) {
+	initTestConfig(false)
+	config.StripHeaders = []string{"x-secret-token", " X-Internal-Route "}
+	pm := &parsedMessage{subject: "s", body: "b", headers: []messageHeader{
+		{Name: "X-Secret-Token", Value: "hunter2"},
+		{Name: "X-INTERNAL-ROUTE", Value: "core-7"},
+		{Name: "X-Received", Value: "from a by b"},
+	}}
+
+	b, _ := json.Marshal(buildGraphMessage("from@example.com", []string{"to@example.com"}, pm))
+	payload := string(b)
+	for _, leaked := range []string{"X-Secret-Token", "hunter2", "X-INTERNAL-ROUTE", "core-7"} {
+		if strings.Contains(payload, leaked) {
+			t.Errorf("stripped header data %q found in payload: %s", leaked, payload)
+		}
+	}
+	if !strings.Contains(payload, `"name":"X-Received"`) {
+		t.Errorf("expected non-stripped header to be kept, got: %s", payload)
+	}
+
+	// Nothing left to send: no internetMessageHeaders at all
+	pm.headers = pm.headers[:2]
+	if _, ok := buildGraphMessage("from@example.com", []string{"to@example.com"}, pm)["internetMessageHeaders"]; ok {
+		t.Error("expected internetMessageHeaders to be omitted when every header is stripped")
+	}
+}
+
+func TestBuildGraphMessage_RecipientDisplayNames(t *testing.T) {
+	initTestConfig(false)
+	raw := "From: test@example.com\r\nTo: \"Jane Doe\" <Jane@example.com>, bob@example.com\r\nCc: =?UTF-8?Q?J=C3=B6rg?= <joerg@example.com>\r\nSubject: Hi\r\n\r\nBody"
+	pm, err := parseSubjectBodyAndAttachments(raw)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	payload, err := json.Marshal(buildGraphMessage("test@example.com", []string{"jane@example.com", "bob@example.com", "joerg@example.com"}, pm))
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	for _, want := range []string{
+		`"toRecipients":[{"emailAddress":{"address":"jane@example.com","name":"Jane Doe"}},{"emailAddress":{"address":"bob@example.com"}}]`,
+		`"ccRecipients":[{"emailAddress":{"address":"joerg@example.com","name":"Jörg"}}]`,
+	} {
+		if !strings.Contains(string(payload), want) {
+			t.Errorf("expected %s in payload, got: %s", want, payload)
+		}
+	}
+}
+
+func TestBuildGraphMessage_Sensitivity(t *testing.T) {
+	initTestConfig(false)
+	raw := "From: test@example.com\r\nTo: bob@example.com\r\nSubject: Records\r\nSensitivity: Company-Confidential\r\n\r\nBody"
+	pm, err := parseSubjectBodyAndAttachments(raw)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	payload, err := json.Marshal(buildGraphMessage("test@example.com", []string{"bob@example.com"}, pm))
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	if want := `"singleValueExtendedProperties":[{"id":"Integer 0x0036","value":"3"}]`; !strings.Contains(string(payload), want) {
+		t.Errorf("expected %s in payload, got: %s", want, payload)
+	}
+
+	for header, want := range map[string]int{"Personal": 1, " private ": 2, "Normal": 0, "Secret": 0, "": 0} {
+		if got := parseSensitivity(header); got != want {
+			t.Errorf("parseSensitivity(%q) = %d, want %d", header, got, want)
+		}
+	}
+	pm.sensitivity = 0
+	if _, ok := buildGraphMessage("test@example.com", []string{"bob@example.com"}, pm)["singleValueExtendedProperties"]; ok {
+		t.Error("expected no extended property without a Sensitivity header")
+	}
+}
+
+func TestBuildGraphMessage_ListHeaders(t *testing.T) {
+	initTestConfig(false)
+	config.ForwardListHeaders = true
+	raw := "From: news@example.com\r\nTo: bob@example.com\r\nSubject: Newsletter\r\n" +
+		"List-Unsubscribe: <https://example.com/unsub?id=1>, <mailto:unsub@example.com>\r\n" +
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n" +
+		"List-Id: Example News <news.example.com>\r\n\r\nBody"
+	pm, err := parseSubjectBodyAndAttachments(raw)
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	payload, err := json.Marshal(buildGraphMessage("news@example.com", []string{"bob@example.com"}, pm))
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	want := `"singleValueExtendedProperties":[` +
+		`{"id":"String {00020386-0000-0000-C000-000000000046} Name List-Id","value":"Example News \u003cnews.example.com\u003e"},` +
+		`{"id":"String {00020386-0000-0000-C000-000000000046} Name List-Unsubscribe","value":"\u003chttps://example.com/unsub?id=1\u003e, \u003cmailto:unsub@example.com\u003e"},` +
+		`{"id":"String {00020386-0000-0000-C000-000000000046} Name List-Unsubscribe-Post","value":"List-Unsubscribe=One-Click"}]`
+	if !strings.Contains(string(payload), want) {
+		t.Errorf("expected %s in payload, got: %s", want, payload)
+	}
+
+	config.StripHeaders = []string{"List-Id"}
+	payload, _ = json.Marshal(buildGraphMessage("news@example.com", []string{"bob@example.com"}, pm))
+	if strings.Contains(string(payload), "Name List-Id") {
+		t.Errorf("expected strip_headers to drop List-Id, got: %s", payload)
+	}
+
+	config.ForwardListHeaders = false
+	if pm, _ = parseSubjectBodyAndAttachments(raw); len(pm.listHeaders) != 0 {
+		t.Errorf("expected no List-* headers without forward_list_headers, got %v", pm.listHeaders)
+	}
+}
+
+func TestRejectEmptyBody(t *testing.T) {
+	initTestConfig(false)
+	TokenCache.Store("empty@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("empty@example.com")
+	sends := 0
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		sends++
+		return "", nil
+	}
+	defer func() { sendMessage = prevSend }()
+
+	conversation := func(message, want string) []conversationStep {
+		return []conversationStep{
+			{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00empty@example.com\x00pass")) + "\r\n", "235 2.7.0 Authentication successful"},
+			{"MAIL FROM:<empty@example.com>\r\n", "250 2.1.0 Ok"},
+			{"RCPT TO:<to@example.com>\r\n", "250 2.1.5 Ok"},
+			{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+			{message, want},
+			{"QUIT\r\n", "221 2.0.0 Bye"},
+		}
+	}
+	empty := "Subject: monitoring\r\n\r\n \r\n\t\r\n.\r\n"
+
+	runConversation(t, conversation(empty, "250 2.0.0 Ok: queued as graphapi"))
+	if sends != 1 {
+		t.Errorf("expected the empty message sent without reject_empty_body, got %d sends", sends)
+	}
+
+	config.RejectEmptyBody = true
+	runConversation(t, conversation(empty, "554 5.6.0 Empty message"))
+	if sends != 1 {
+		t.Errorf("expected the empty message not sent with reject_empty_body, got %d sends", sends)
+	}
+
+	// An attachment alone is content
+	attachmentOnly := "Subject: report\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\n\r\n" +
+		"--b\r\nContent-Type: text/csv\r\nContent-Disposition: attachment; filename=report.csv\r\n\r\na,b\r\n--b--\r\n.\r\n"
+	runConversation(t, conversation(attachmentOnly, "250 2.0.0 Ok: queued as graphapi"))
+	if sends != 2 {
+		t.Errorf("expected the attachment-only message sent, got %d sends", sends)
+	}
+}
+
+func TestBuildGraphMessage_MessageIDDomain(t *testing.T) {
+	initTestConfig(false)
+	config.MessageIDDomain = "relay.example.com"
+	pm, err := parseSubjectBodyAndAttachments("From: a@example.com\r\nTo: b@example.com\r\nSubject: Hi\r\n\r\nBody")
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	id, _ := buildGraphMessage("a@example.com", []string{"b@example.com"}, pm)["internetMessageId"].(string)
+	if !regexp.MustCompile(`^<[0-9a-f]{32}@relay\.example\.com>$`).MatchString(id) {
+		t.Errorf("expected a generated Message-ID in relay.example.com, got %q", id)
+	}
+	if raw := rawMIMEMessage(nil, &parsedMessage{messageID: id}); !strings.HasPrefix(raw, "Message-ID: "+id+"\r\n") {
+		t.Errorf("expected the generated Message-ID prepended in raw_passthrough, got: %q", raw)
+	}
+
+	pm, _ = parseSubjectBodyAndAttachments("Message-ID: <orig@client.example.com>\r\nSubject: Hi\r\n\r\nBody")
+	if id := buildGraphMessage("a@example.com", []string{"b@example.com"}, pm)["internetMessageId"]; id != "<orig@client.example.com>" {
+		t.Errorf("expected the client's Message-ID kept, got %v", id)
+	}
+	if pm, _ = parseRawPassthrough("Message-ID: <orig@client.example.com>\r\nSubject: Hi\r\n\r\nBody"); pm.messageID != "" {
+		t.Errorf("expected no Message-ID added in raw_passthrough when the client sent one, got %q", pm.messageID)
+	}
+
+	config.MessageIDDomain = ""
+	pm, _ = parseSubjectBodyAndAttachments("Subject: Hi\r\n\r\nBody")
+	if _, ok := buildGraphMessage("a@example.com", []string{"b@example.com"}, pm)["internetMessageId"]; ok {
+		t.Error("expected no internetMessageId without message_id_domain")
+	}
+}
+
+func TestForwardedHeaders_Limits(t *testing.T) {
+	initTestConfig(false)
+	names := func(headers []messageHeader) []string {
+		var n []string
+		for _, h := range headers {
+			n = append(n, h.Name)
+		}
+		return n
+	}
+	relay := func(n int) []messageHeader {
+		var headers []messageHeader
+		for i := range n {
+			headers = append(headers, messageHeader{Name: fmt.Sprintf("X-H%d", i), Value: "v"})
+		}
+		return headers
+	}
+
+	// Graph's internetMessageHeaders limit: exactly 5 pass, a 6th is dropped without overLimit
+	if set := forwardedHeaders(&parsedMessage{headers: relay(5)}); len(set.headers) != 5 || set.dropped != nil {
+		t.Errorf("expected 5 headers kept, got %v dropped %v", names(set.headers), set.dropped)
+	}
+	set := forwardedHeaders(&parsedMessage{headers: relay(6)})
+	if len(set.headers) != 5 || !slices.Equal(set.dropped, []string{"X-H5"}) || set.overLimit {
+		t.Errorf("expected X-H5 dropped by the Graph limit, got %v dropped %v overLimit %v", names(set.headers), set.dropped, set.overLimit)
+	}
+	config.MaxInternetMessageHeaders = 6
+	if set := forwardedHeaders(&parsedMessage{headers: relay(6)}); len(set.headers) != 6 {
+		t.Errorf("expected max_internet_message_headers to raise the limit, got %v", names(set.headers))
+	}
+
+	// max_forwarded_headers counts internetMessageHeaders and List-* properties
+	config.MaxForwardedHeaders = 3
+	pm := &parsedMessage{headers: relay(2), listHeaders: []messageHeader{{Name: "List-Id", Value: "a"}}}
+	if set := forwardedHeaders(pm); len(set.headers)+len(set.properties) != 3 || set.overLimit {
+		t.Errorf("expected 3 headers at max_forwarded_headers 3, got %v %v", names(set.headers), names(set.properties))
+	}
+	pm.listHeaders = append(pm.listHeaders, messageHeader{Name: "List-Unsubscribe", Value: "b"})
+	set = forwardedHeaders(pm)
+	if !slices.Equal(set.dropped, []string{"List-Unsubscribe"}) || !set.overLimit {
+		t.Errorf("expected List-Unsubscribe dropped over max_forwarded_headers, got dropped %v overLimit %v", set.dropped, set.overLimit)
+	}
+
+	// max_forwarded_header_bytes: "X-H0"+"v" and "X-H1"+"v" are 5 bytes each
+	config.MaxForwardedHeaders = 0
+	config.MaxForwardedHeaderBytes = 10
+	pm = &parsedMessage{headers: relay(2)}
+	if set := forwardedHeaders(pm); len(set.headers) != 2 || set.overLimit {
+		t.Errorf("expected 10 bytes of headers to fit, got %v", names(set.headers))
+	}
+	config.MaxForwardedHeaderBytes = 9
+	if set := forwardedHeaders(pm); !slices.Equal(set.dropped, []string{"X-H1"}) || !set.overLimit {
+		t.Errorf("expected X-H1 dropped over max_forwarded_header_bytes, got dropped %v", set.dropped)
+	}
+}
+
+func TestForwardedHeaders_OverflowReject(t *testing.T) {
+	initTestConfig(false)
+	config.ForwardListHeaders = true
+	config.MaxForwardedHeaders = 1
+	config.ForwardedHeaderOverflow = "reject"
+	TokenCache.Store("lists@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("lists@example.com")
+	var sent *parsedMessage
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		sent = pm
+		return "", nil
+	}
+	defer func() { sendMessage = prevSend }()
+
+	message := "List-Id: <news.example.com>\r\nList-Unsubscribe: <mailto:u@example.com>\r\nSubject: news\r\n\r\nbody\r\n.\r\n"
+	steps := []conversationStep{
+		{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00lists@example.com\x00pass")) + "\r\n", "235 2.7.0 Authentication successful"},
+		{"MAIL FROM:<lists@example.com>\r\n", "250 2.1.0 Ok"},
+		{"RCPT TO:<to@example.com>\r\n", "250 2.1.5 Ok"},
+		{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+		{message, "552 5.3.4 Too many or too large message headers"},
+		{"QUIT\r\n", "221 2.0.0 Bye"},
+	}
+	runConversation(t, steps)
+	if sent != nil {
+		t.Fatal("expected the message not to be sent")
+	}
+
+	config.ForwardedHeaderOverflow = "truncate"
+	steps[4].want = "250 2.0.0 Ok: queued as graphapi"
+	runConversation(t, steps)
+	if sent == nil {
+		t.Fatal("expected the message to be sent with truncate")
+	}
+	if set := forwardedHeaders(sent); len(set.properties) != 1 || set.properties[0].Name != "List-Id" {
+		t.Errorf("expected only List-Id forwarded, got %v", set.properties)
+	}
+}
+
+func TestBuildGraphMessage_AutoSubmitted(t *testing.T) {
+	initTestConfig(false)
+	suppressed := func(pm *parsedMessage) bool {
+		headers, _ := buildGraphMessage("from@example.com", []string{"to@example.com"}, pm)["internetMessageHeaders"].([]messageHeader)
+		return slices.Contains(headers, autoResponseSuppress)
+	}
+
+	// Preserved from the message
+	pm, err := parseSubjectBodyAndAttachments("Subject: Report\r\nAuto-Submitted: Auto-Generated\r\n\r\nBody")
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	if pm.autoSubmitted != "auto-generated" || !suppressed(pm) {
+		t.Errorf("expected Auto-Submitted forwarded as auto-reply suppression, got %q", pm.autoSubmitted)
+	}
+	pm, _ = parseSubjectBodyAndAttachments("Subject: Hi\r\nAuto-Submitted: no\r\n\r\nBody")
+	if suppressed(pm) {
+		t.Error("expected Auto-Submitted: no to be treated as human mail")
+	}
+
+	// Injected for every message
+	config.AddAutoSubmitted = true
+	if !suppressed(pm) {
+		t.Error("expected add_auto_submitted to mark every message")
+	}
+	raw := rawMIMEMessage([]string{"to@example.com"}, &parsedMessage{rawMIME: "To: to@example.com\r\nSubject: Hi\r\n\r\nBody", toAddrs: []string{"to@example.com"}})
+	if !strings.HasPrefix(raw, "Auto-Submitted: auto-generated\r\nTo:") {
+		t.Errorf("expected Auto-Submitted prepended to the raw message, got %q", raw)
+	}
+	raw = rawMIMEMessage(nil, &parsedMessage{rawMIME: "Auto-Submitted: auto-replied\r\n\r\nBody", autoSubmitted: "auto-replied"})
+	if strings.Count(raw, "Auto-Submitted") != 1 {
+		t.Errorf("expected the existing Auto-Submitted kept as the only one, got %q", raw)
+	}
+}
+
+func TestFallbackAuth_SendLogAttrs(t *testing.T) {
+	initTestConfig(false)
+	config.LogFallbackUsername = true
+	var logs bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&logs, nil))
+	TokenCache.Store("fallback@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("fallback@example.com")
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		return "", nil
+	}
+	defer func() { sendMessage = prevSend }()
+
+	// A username without password falls back to the fallback credentials
+	runConversation(t, []conversationStep{
+		{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00claimed@example.com\x00")) + "\r\n", "235 2.7.0 Authentication successful"},
+		{"MAIL FROM:<fallback@example.com>\r\n", "250 2.1.0 Ok"},
+		{"RCPT TO:<to@example.com>\r\n", "250 2.1.5 Ok"},
+		{"DATA\r\n", "354 End data with <CR><LF>.<CR><LF>"},
+		{"Subject: audit\r\n\r\nbody\r\n.\r\n", "250 2.0.0 Ok: queued as graphapi"},
+		{"QUIT\r\n", "221 2.0.0 Bye"},
+	})
+
+	var sent string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "E-mail sent successfully") {
+			sent = line
+		}
+	}
+	for _, want := range []string{"username=fallback@example.com", "remote=pipe", "auth_mode=fallback", "client_username=claimed@example.com"} {
+		if !strings.Contains(sent, want) {
+			t.Errorf("expected %s in send log, got: %s", want, sent)
+		}
+	}
+}
+
+func TestRecipientAttrs(t *testing.T) {
+	pm := &parsedMessage{toAddrs: []string{"a@example.com", "b@example.com"}, bccAddrs: []string{"c@example.com"}}
+	got := recipientAttrs([]string{"a@example.com", "b@example.com", "c@example.com"}, pm)
+	want := []any{"rcptTo", "a@example.com,b@example.com,c@example.com", "to", "a@example.com,b@example.com", "bcc", "c@example.com"}
+	if !slices.Equal(got, want) {
+		t.Errorf("recipientAttrs = %v, want %v", got, want)
+	}
+}
+
+func TestBuildGraphMessage_SanitizesHeaders(t *testing.T) {
+	initTestConfig(false)
+	pm := &parsedMessage{subject: "s", body: "b", headers: []messageHeader{
+		{Name: "X-Received", Value: "from a\r\nBcc: victim@example.com\nX-Injected: 1"},
+		{Name: "X-Long", Value: strings.Repeat("v", 2000)},
+		{Name: "Bad Name:", Value: "dropped"},
+	}}
+
+	headers := buildGraphMessage("from@example.com", []string{"to@example.com"}, pm)["internetMessageHeaders"].([]messageHeader)
+	if len(headers) != 2 {
+		t.Fatalf("expected invalid header name to be dropped, got %v", headers)
+	}
+	if got := headers[0].Value; got != "from a Bcc: victim@example.com X-Injected: 1" {
+		t.Errorf("expected CR/LF neutralized, got %q", got)
 	}
-	if regularAtt.Filename != "report.pdf" {
-		t.Errorf("expected regular attachment filename 'report.pdf', got '%s'", regularAtt.Filename)
+	if strings.ContainsAny(headers[0].Value, "\r\n") {
+		t.Errorf("header value still contains CR/LF: %q", headers[0].Value)
+	}
+	if len(headers[1].Value) != maxHeaderValueLength {
+		t.Errorf("expected value truncated to %d bytes, got %d", maxHeaderValueLength, len(headers[1].Value))
 	}
 }
 
@@ -615,6 +2911,23 @@ func TestExtractAddress_Empty(t *testing.T) {
 	}
 }
 
+func TestExtractAddress_Whitespace(t *testing.T) {
+	if addr := extractAddress("MAIL FROM: < >"); addr != "" {
+		t.Errorf("expected empty string for '< >', got '%s'", addr)
+	}
+	if addr := extractAddress("MAIL FROM:<  user@x  >"); addr != "user@x" {
+		t.Errorf("expected 'user@x', got '%s'", addr)
+	}
+	for _, line := range []string{"MAIL FROM:<>", "MAIL FROM: < >", "MAIL FROM:<   > SIZE=10"} {
+		if !isNullSender(line) {
+			t.Errorf("expected %q to be the null sender", line)
+		}
+	}
+	if isNullSender("MAIL FROM:<user@example.com>") || isNullSender("MAIL FROM: garbage") {
+		t.Error("expected non-empty reverse paths not to be the null sender")
+	}
+}
+
 func TestIsValidEmail_Valid(t *testing.T) {
 	valid := []string{
 		"user@example.com",
@@ -643,3 +2956,857 @@ func TestIsValidEmail_Invalid(t *testing.T) {
 		}
 	}
 }
+
+func TestEXPNandVRFY(t *testing.T) {
+	initTestConfig(false)
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+
+	// Answered before authentication, never disclosing membership
+	client.Write([]byte("EXPN staff\r\n"))
+	if resp := readResponse(reader); resp != "252 2.1.5 Cannot EXPN list" {
+		t.Errorf("unexpected EXPN response: %s", resp)
+	}
+	client.Write([]byte("VRFY bob@example.com\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "252 2.1.5") {
+		t.Errorf("unexpected VRFY response: %s", resp)
+	}
+	client.Write([]byte("QUIT\r\n"))
+	readResponse(reader)
+}
+
+func TestXStatus(t *testing.T) {
+	initTestConfig(true)
+	TokenCache.Store("status@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("status@example.com")
+
+	session := func() (net.Conn, *bufio.Reader, func()) {
+		client, server := net.Pipe()
+		stop := startHandler(client, server, handleSMTPConnection)
+		reader := bufio.NewReader(client)
+		readResponse(reader) // 220 greeting
+		return client, reader, stop
+	}
+
+	// Disabled (default): not advertised, unknown command
+	client, reader, stop := session()
+	client.Write([]byte("EHLO test\r\n"))
+	if lines := readMultiline(reader); slices.Contains(lines, "250-XSTATUS") {
+		t.Errorf("XSTATUS advertised while disabled: %v", lines)
+	}
+	client.Write([]byte("XSTATUS\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "502") {
+		t.Errorf("expected 502 while disabled, got: %s", resp)
+	}
+	stop()
+
+	config.EnableXStatus = true
+	client, reader, stop = session()
+	defer stop()
+	client.Write([]byte("EHLO test\r\n"))
+	if lines := readMultiline(reader); !slices.Contains(lines, "250-XSTATUS") {
+		t.Errorf("expected XSTATUS in EHLO, got %v", lines)
+	}
+	// Anonymous access is allowed for mail, but not for status
+	client.Write([]byte("XSTATUS\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "530") {
+		t.Errorf("expected 530 before authentication, got: %s", resp)
+	}
+	if resp := authPlain(client, reader, "status@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Fatalf("expected 235, got: %s", resp)
+	}
+	client.Write([]byte("XSTATUS\r\n"))
+	lines := readMultiline(reader)
+	if len(lines) != 4 || lines[0] != "211-azureSMTPwithOAuth "+version || !strings.HasPrefix(lines[3], "211 uptime ") {
+		t.Fatalf("unexpected XSTATUS reply: %v", lines)
+	}
+	if lines[1] == "211-active_connections 0" || !strings.HasPrefix(lines[2], "211-token_cache_size ") || lines[2] == "211-token_cache_size 0" {
+		t.Errorf("unexpected XSTATUS counters: %v", lines)
+	}
+}
+
+func TestMailFromBody8BitMIME(t *testing.T) {
+	initTestConfig(false)
+	TokenCache.Store("eightbit@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("eightbit@example.com")
+
+	var payload struct {
+		Message struct {
+			Subject string `json:"subject"`
+			Body    struct {
+				Content string `json:"content"`
+			} `json:"body"`
+		} `json:"message"`
+	}
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	client.Write([]byte("EHLO test\r\n"))
+	if lines := readMultiline(reader); !slices.Contains(lines, "250-8BITMIME") {
+		t.Errorf("expected 8BITMIME in EHLO, got %v", lines)
+	}
+	if resp := authPlain(client, reader, "eightbit@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Fatalf("expected 235, got: %s", resp)
+	}
+
+	client.Write([]byte("MAIL FROM:<eightbit@example.com> BODY=BINARYMIME\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "501") {
+		t.Errorf("expected 501 for unsupported BODY value, got: %s", resp)
+	}
+	client.Write([]byte("MAIL FROM:<eightbit@example.com> BODY=8BITMIME\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected 250 for BODY=8BITMIME, got: %s", resp)
+	}
+	client.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("DATA\r\n"))
+	readResponse(reader) // 354
+	go client.Write([]byte("Subject: Grüße\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\nSchöne Grüße\r\n.\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected 250, got: %s", resp)
+	}
+	if payload.Message.Subject != "Grüße" || strings.TrimRight(payload.Message.Body.Content, "\r\n") != "Schöne Grüße" {
+		t.Errorf("expected 8-bit content intact, got subject %q body %q", payload.Message.Subject, payload.Message.Body.Content)
+	}
+}
+
+func TestMaxGraphPayloadSize(t *testing.T) {
+	initTestConfig(false)
+	TokenCache.Store("payload@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("payload@example.com")
+
+	sent := 0
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent++
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	// 3000 bytes sent as 8bit on the wire become 4000 bytes of base64 in the request
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	body, _ := w.CreatePart(map[string][]string{"Content-Type": {"text/plain"}})
+	body.Write([]byte("report attached"))
+	att, _ := w.CreatePart(map[string][]string{
+		"Content-Type":              {"text/csv"},
+		"Content-Disposition":       {"attachment; filename=\"report.csv\""},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	att.Write(bytes.Repeat([]byte("a,b\n"), 750))
+	w.Close()
+	msg := "Subject: report\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + w.Boundary() + "\"\r\n\r\n" + buf.String()
+
+	pm, err := parseSubjectBodyAndAttachments(normalizeLineEndings(msg))
+	if err != nil {
+		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
+	}
+	estimate := estimateGraphPayloadSize([]string{"to@example.com"}, pm)
+	if estimate < 4000 {
+		t.Fatalf("expected estimate to include the base64 expansion, got %d", estimate)
+	}
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	if resp := authPlain(client, reader, "payload@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Fatalf("expected 235, got: %s", resp)
+	}
+	send := func() string {
+		client.Write([]byte("MAIL FROM:<payload@example.com>\r\n"))
+		readResponse(reader)
+		client.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+		readResponse(reader)
+		client.Write([]byte("DATA\r\n"))
+		readResponse(reader) // 354
+		go client.Write([]byte(msg + "\r\n.\r\n"))
+		return readResponse(reader)
+	}
+
+	// One byte below the estimate: the wire size fits, the Graph request would not
+	config.MaxGraphPayloadSize = estimate - 1
+	if resp := send(); !strings.HasPrefix(resp, "552 5.3.4 Message too large for Graph API after base64 encoding") {
+		t.Errorf("expected 552 explaining the base64 overhead, got: %s", resp)
+	}
+	if sent != 0 {
+		t.Errorf("expected no Graph request for an oversized payload, got %d", sent)
+	}
+
+	config.MaxGraphPayloadSize = estimate
+	if resp := send(); !strings.HasPrefix(resp, "250") {
+		t.Errorf("expected 250 at the limit, got: %s", resp)
+	}
+}
+
+func TestDuplicateRecipients(t *testing.T) {
+	initTestConfig(false)
+	TokenCache.Store("dup@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("dup@example.com")
+
+	var payload struct {
+		Message struct {
+			ToRecipients []map[string]map[string]string `json:"toRecipients"`
+		} `json:"message"`
+	}
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	if resp := authPlain(client, reader, "dup@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Fatalf("expected 235, got: %s", resp)
+	}
+	send := func() []string {
+		var replies []string
+		client.Write([]byte("MAIL FROM:<dup@example.com>\r\n"))
+		readResponse(reader)
+		for _, rcpt := range []string{"bob@example.com", "Bob@Example.com", "carol@example.com", "bob@example.com"} {
+			client.Write([]byte("RCPT TO:<" + rcpt + ">\r\n"))
+			replies = append(replies, readResponse(reader))
+		}
+		client.Write([]byte("DATA\r\n"))
+		readResponse(reader) // 354
+		go client.Write([]byte("Subject: dup\r\n\r\nbody\r\n.\r\n"))
+		if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+			t.Fatalf("expected 250, got: %s", resp)
+		}
+		return replies
+	}
+
+	replies := send()
+	want := []string{"250 2.1.5 Ok", "250 2.1.5 Ok (duplicate ignored)", "250 2.1.5 Ok", "250 2.1.5 Ok (duplicate ignored)"}
+	if !slices.Equal(replies, want) {
+		t.Errorf("expected replies %v, got %v", want, replies)
+	}
+	if len(payload.Message.ToRecipients) != 2 {
+		t.Errorf("expected 2 unique recipients, got %v", payload.Message.ToRecipients)
+	}
+
+	config.AllowDuplicateRecipients = true
+	send()
+	if len(payload.Message.ToRecipients) != 4 {
+		t.Errorf("expected duplicates kept with allow_duplicate_recipients, got %v", payload.Message.ToRecipients)
+	}
+}
+
+func TestDATA_Incomplete(t *testing.T) {
+	initTestConfig(true)
+
+	startData := func(client net.Conn) *bufio.Reader {
+		reader := bufio.NewReader(client)
+		readResponse(reader) // 220 greeting
+		client.Write([]byte("MAIL FROM:<sender@example.com>\r\n"))
+		readResponse(reader)
+		client.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+		readResponse(reader)
+		client.Write([]byte("DATA\r\n"))
+		if resp := readResponse(reader); !strings.HasPrefix(resp, "354") {
+			t.Fatalf("expected 354, got: %s", resp)
+		}
+		return reader
+	}
+
+	// Truncated stream: the client closes its side before the terminating dot
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		handleSMTPConnection(conn)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	reader := startData(conn)
+	conn.Write([]byte("Subject: cut off\r\n\r\nfirst half of the bo"))
+	conn.(*net.TCPConn).CloseWrite()
+	if resp := readResponse(reader); resp != "421 4.4.2 Timeout during DATA" {
+		t.Errorf("expected 421 for truncated DATA, got: %s", resp)
+	}
+
+	// Stalled stream: data_total_timeout_seconds ends DATA although lines keep arriving in time
+	config.DataTotalTimeoutSeconds = 1
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader = startData(client)
+	done := make(chan string)
+	go func() { done <- readResponse(reader) }()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case resp := <-done:
+			if resp != "421 4.4.2 Timeout during DATA" {
+				t.Errorf("expected 421 after data_total_timeout_seconds, got: %s", resp)
+			}
+			return
+		case <-ticker.C:
+			go client.Write([]byte("still sending\r\n"))
+		case <-timeout:
+			t.Fatal("DATA was not ended by data_total_timeout_seconds")
+		}
+	}
+}
+
+func TestMaxMessagesPerConnection(t *testing.T) {
+	initTestConfig(false)
+	config.MaxMessagesPerConnection = 2
+	TokenCache.Store("limit@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("limit@example.com")
+
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	if resp := authPlain(client, reader, "limit@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+		t.Fatalf("expected 235, got: %s", resp)
+	}
+
+	for i := 1; i <= 2; i++ {
+		client.Write([]byte("MAIL FROM:<limit@example.com>\r\n"))
+		readResponse(reader)
+		client.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+		readResponse(reader)
+		client.Write([]byte("DATA\r\n"))
+		readResponse(reader) // 354
+		go client.Write([]byte("Subject: test\r\n\r\nbody\r\n.\r\n"))
+		if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+			t.Fatalf("expected message %d to be sent, got: %s", i, resp)
+		}
+	}
+
+	// The third message is refused and the connection closed
+	client.Write([]byte("MAIL FROM:<limit@example.com>\r\n"))
+	if resp := readResponse(reader); resp != "421 4.7.0 Too many messages this session" {
+		t.Errorf("expected 421 for message over the limit, got: %s", resp)
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("expected connection to be closed")
+	}
+}
+
+func TestTokenEndpoint(t *testing.T) {
+	initTestConfig(false)
+	config.OAuth2Config.TenantID = "contoso"
+	if got := tokenEndpointURL(); got != "https://login.microsoftonline.com/contoso/oauth2/v2.0/token" {
+		t.Errorf("default endpoint = %q", got)
+	}
+
+	var gotPath string
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Write([]byte(`{"access_token":"tok","expires_in":3600}`))
+	}))
+	defer idp.Close()
+	prevClient := authHTTPClient
+	authHTTPClient = idp.Client()
+	defer func() { authHTTPClient = prevClient }()
+
+	config.OAuth2Config.TokenEndpoint = idp.URL + "/proxy/{tenant}/token"
+	token, _, err := getOAuth2TokenWithExpiry(context.Background(), "user@example.com", "pass")
+	if err != nil || token != "tok" {
+		t.Fatalf("token request via token_endpoint failed: %q, %v", token, err)
+	}
+	if gotPath != "/proxy/contoso/token" {
+		t.Errorf("expected tenant substituted in path, got %q", gotPath)
+	}
+}
+
+func TestSendMailGraphAPI_CompressRequests(t *testing.T) {
+	initTestConfig(false)
+	config.CompressRequests = true
+	config.RetryAttempts = 2
+	config.RetryInitialDelay = 1
+
+	var attempts int
+	var bodies []string
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("invalid gzip body: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		b, _ := io.ReadAll(body)
+		var payload map[string]any
+		if err := json.Unmarshal(b, &payload); err != nil {
+			t.Errorf("body is not valid JSON after decoding: %v", err)
+		}
+		bodies = append(bodies, r.Header.Get("Content-Encoding"))
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable) // retried with the same compressed body
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	large := &parsedMessage{subject: "large", body: strings.Repeat("lorem ipsum ", 10000)}
+	if _, err := sendMailGraphAPI(context.Background(), "tok", "user@example.com", "user@example.com", []string{"to@example.com"}, large); err != nil {
+		t.Fatalf("sendMailGraphAPI failed: %v", err)
+	}
+	if len(bodies) != 2 || bodies[0] != "gzip" || bodies[1] != "gzip" {
+		t.Errorf("expected both attempts gzip-encoded, got %q", bodies)
+	}
+
+	// Small bodies are sent uncompressed
+	bodies = nil
+	small := &parsedMessage{subject: "small", body: "hi"}
+	if _, err := sendMailGraphAPI(context.Background(), "tok", "user@example.com", "user@example.com", []string{"to@example.com"}, small); err != nil {
+		t.Fatalf("sendMailGraphAPI failed: %v", err)
+	}
+	if len(bodies) != 1 || bodies[0] != "" {
+		t.Errorf("expected small request uncompressed, got %q", bodies)
+	}
+}
+
+func TestDeriveRecipientsFromHeaders(t *testing.T) {
+	initTestConfig(false)
+	TokenCache.Store("derive@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("derive@example.com")
+
+	var payload struct {
+		Message struct {
+			ToRecipients  []map[string]map[string]string `json:"toRecipients"`
+			CcRecipients  []map[string]map[string]string `json:"ccRecipients"`
+			BccRecipients []map[string]map[string]string `json:"bccRecipients"`
+		} `json:"message"`
+	}
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	session := func() (net.Conn, *bufio.Reader, func()) {
+		client, server := net.Pipe()
+		stop := startHandler(client, server, handleSMTPConnection)
+		reader := bufio.NewReader(client)
+		readResponse(reader) // 220 greeting
+		if resp := authPlain(client, reader, "derive@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+			t.Fatalf("expected 235, got: %s", resp)
+		}
+		client.Write([]byte("MAIL FROM:<derive@example.com>\r\n"))
+		readResponse(reader)
+		return client, reader, stop
+	}
+
+	// Disabled (default): DATA without RCPT TO is refused
+	client, reader, stop := session()
+	client.Write([]byte("DATA\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "503") {
+		t.Errorf("expected 503 without RCPT TO, got: %s", resp)
+	}
+	stop()
+
+	config.DeriveRecipientsFromHeaders = true
+	client, reader, stop = session()
+	defer stop()
+	client.Write([]byte("DATA\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "354") {
+		t.Fatalf("expected 354 with derive_recipients_from_headers, got: %s", resp)
+	}
+	go client.Write([]byte("To: Bob <bob@example.com>\r\nCc: carol@example.com\r\nSubject: test\r\n\r\nbody\r\n.\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected 250, got: %s", resp)
+	}
+	if len(payload.Message.ToRecipients) != 1 || payload.Message.ToRecipients[0]["emailAddress"]["address"] != "bob@example.com" {
+		t.Errorf("unexpected toRecipients: %v", payload.Message.ToRecipients)
+	}
+	if len(payload.Message.CcRecipients) != 1 || payload.Message.CcRecipients[0]["emailAddress"]["address"] != "carol@example.com" {
+		t.Errorf("unexpected ccRecipients: %v", payload.Message.CcRecipients)
+	}
+
+	// Header recipients are subject to allowed_recipient_domains
+	config.AllowedRecipientDomains = []string{"example.com"}
+	client.Write([]byte("MAIL FROM:<derive@example.com>\r\n"))
+	readResponse(reader)
+	client.Write([]byte("DATA\r\n"))
+	readResponse(reader) // 354
+	go client.Write([]byte("To: bob@example.com, eve@elsewhere.org\r\nSubject: test\r\n\r\nbody\r\n.\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "550 5.7.1") {
+		t.Errorf("expected 550 for header recipient outside allowed domains, got: %s", resp)
+	}
+}
+
+func TestHeaderRecipients(t *testing.T) {
+	initTestConfig(false)
+	pm := &parsedMessage{
+		toAddrs:  []string{"a@example.com", "B@example.com"},
+		ccAddrs:  []string{"b@example.com"},
+		bccAddrs: []string{"c@example.com"},
+	}
+	rcpts, _, _ := headerRecipients(pm)
+	if !slices.Equal(rcpts, []string{"a@example.com", "B@example.com", "c@example.com"}) {
+		t.Errorf("unexpected recipients (duplicates must be dropped): %v", rcpts)
+	}
+	if rcpts, code, _ := headerRecipients(&parsedMessage{}); rcpts != nil || code != "554 5.5.1" {
+		t.Errorf("expected 554 without header recipients, got %v %s", rcpts, code)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	initTestConfig(false)
+	config.SendTimeoutSeconds = 20
+
+	if got := sendTimeout(&parsedMessage{body: "small"}); got != 20*time.Second {
+		t.Errorf("expected 20s for a message without attachments, got %v", got)
+	}
+	large := &parsedMessage{attachments: []Attachment{{Content: strings.Repeat("A", 10*1024*1024)}}}
+	if got := sendTimeout(large); got != 60*time.Second {
+		t.Errorf("expected 20s + 40s for 10MB of attachments, got %v", got)
+	}
+}
+
+func TestMailAuthIdentity(t *testing.T) {
+	tests := map[string]string{
+		"MAIL FROM:<gw@example.com> AUTH=alice@example.com":         "alice@example.com",
+		"MAIL FROM:<gw@example.com> AUTH=<alice@example.com>":       "alice@example.com",
+		"MAIL FROM:<gw@example.com> AUTH=alice+2Bsales@example.com": "alice+sales@example.com",
+		"MAIL FROM:<gw@example.com> AUTH=<>":                        "",
+		"MAIL FROM:<gw@example.com> AUTH=alice+ZZ@example.com":      "",
+		"MAIL FROM:<gw@example.com> SIZE=100":                       "",
+	}
+	for line, want := range tests {
+		if got := mailAuthIdentity(line); got != want {
+			t.Errorf("mailAuthIdentity(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestMailFromAUTH_TrustedMTA(t *testing.T) {
+	initTestConfig(false)
+	TokenCache.Store("gateway@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("gateway@example.com")
+
+	var from string
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Message struct {
+				From map[string]map[string]string `json:"from"`
+			} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		from = payload.Message.From["emailAddress"]["address"]
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	// Wait for the accept loop and every session to return before the stubs are restored
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	defer ln.Close()
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				handleSMTPConnection(conn)
+			}()
+		}
+	}()
+
+	send := func() string {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(client)
+		readResponse(reader) // 220 greeting
+		if resp := authPlain(client, reader, "gateway@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+			t.Fatalf("expected 235, got: %s", resp)
+		}
+		from = ""
+		client.Write([]byte("MAIL FROM:<gateway@example.com> AUTH=alice@example.com\r\n"))
+		readResponse(reader)
+		client.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+		readResponse(reader)
+		client.Write([]byte("DATA\r\n"))
+		readResponse(reader) // 354
+		client.Write([]byte("Subject: test\r\n\r\nbody\r\n.\r\n"))
+		if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+			t.Fatalf("expected 250, got: %s", resp)
+		}
+		return from
+	}
+
+	// Untrusted client: AUTH= is ignored
+	config.TrustedMTACIDRs = []string{"192.0.2.0/24"}
+	if got := send(); got != "gateway@example.com" {
+		t.Errorf("untrusted client: expected envelope sender as from, got %q", got)
+	}
+
+	// Trusted client: the asserted identity becomes the Graph from address
+	config.TrustedMTACIDRs = []string{"127.0.0.1"}
+	if got := send(); got != "alice@example.com" {
+		t.Errorf("trusted client: expected AUTH= identity as from, got %q", got)
+	}
+}
+
+func TestNullSender(t *testing.T) {
+	TokenCache.Store("null@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("null@example.com")
+
+	for _, policy := range []string{"reject", "substitute"} {
+		initTestConfig(false)
+		config.NullSender = policy
+
+		client, server := net.Pipe()
+		stop := startHandler(client, server, handleSMTPConnection)
+		reader := bufio.NewReader(client)
+		readResponse(reader) // 220 greeting
+		if resp := authPlain(client, reader, "null@example.com", "pass"); !strings.HasPrefix(resp, "235") {
+			t.Fatalf("expected 235, got: %s", resp)
+		}
+
+		client.Write([]byte("MAIL FROM:<>\r\n"))
+		resp := readResponse(reader)
+		switch policy {
+		case "reject":
+			if resp != "501 5.1.7 Null sender not supported by this relay" {
+				t.Errorf("reject: unexpected response: %s", resp)
+			}
+		case "substitute":
+			if !strings.HasPrefix(resp, "250") {
+				t.Errorf("substitute: expected 250, got: %s", resp)
+			}
+		}
+		stop()
+	}
+}
+
+func TestSuccessMessage(t *testing.T) {
+	if got := renderSuccessMessage("", "", "user@example.com"); got != "Ok: queued as graphapi" {
+		t.Errorf("default success message = %q", got)
+	}
+	if got := renderSuccessMessage("Ok: {id} sent as {user}", "AAMkAD=", "user@example.com"); got != "Ok: AAMkAD= sent as user@example.com" {
+		t.Errorf("rendered success message = %q", got)
+	}
+	if err := validateSuccessMessage("Ok: queued as {id} for {user}"); err != nil {
+		t.Errorf("unexpected error for valid template: %v", err)
+	}
+	for _, tmpl := range []string{"Ok {queue}", "Ok\r\n250 injected", "Ok ✓"} {
+		if err := validateSuccessMessage(tmpl); err == nil {
+			t.Errorf("expected error for template %q", tmpl)
+		}
+	}
+}
+
+func TestPrefetchFallbackToken(t *testing.T) {
+	initTestConfig(true) // fallback credentials configured
+	defer TokenCache.Delete(config.FallbackSMTPuser)
+
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"prefetched","expires_in":3600}`))
+	}))
+	defer idp.Close()
+	prevClient := authHTTPClient
+	authHTTPClient = idp.Client()
+	defer func() { authHTTPClient = prevClient }()
+	config.OAuth2Config.TokenEndpoint = idp.URL + "/{tenant}/token"
+
+	PrefetchFallbackToken(context.Background())
+	cached, ok := TokenCache.Load(config.FallbackSMTPuser)
+	if !ok || cached.(cachedToken).token != "prefetched" {
+		t.Errorf("expected fallback token to be cached after prefetch, got %v", cached)
+	}
+}
+
+func TestSendMailGraphAPI_SetSenderOnBehalf(t *testing.T) {
+	initTestConfig(false)
+
+	var payload struct {
+		Message struct {
+			From   map[string]map[string]string `json:"from"`
+			Sender map[string]map[string]string `json:"sender"`
+		} `json:"message"`
+	}
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload.Message.From, payload.Message.Sender = nil, nil
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	send := func(mailFrom string) {
+		pm := &parsedMessage{subject: "s", body: "b"}
+		if _, err := sendMailGraphAPI(context.Background(), "tok", "assistant@example.com", mailFrom, []string{"to@example.com"}, pm); err != nil {
+			t.Fatalf("sendMailGraphAPI failed: %v", err)
+		}
+	}
+
+	send("boss@example.com")
+	if payload.Message.Sender != nil {
+		t.Errorf("expected no sender when disabled, got %v", payload.Message.Sender)
+	}
+
+	config.SetSenderOnBehalf = true
+	send("boss@example.com")
+	if got := payload.Message.From["emailAddress"]["address"]; got != "boss@example.com" {
+		t.Errorf("expected from = author, got %q", got)
+	}
+	if got := payload.Message.Sender["emailAddress"]["address"]; got != "assistant@example.com" {
+		t.Errorf("expected sender = authenticated mailbox, got %q", got)
+	}
+
+	// Sending as oneself: no sender field needed
+	send("Assistant@example.com")
+	if payload.Message.Sender != nil {
+		t.Errorf("expected no sender when from is the authenticated mailbox, got %v", payload.Message.Sender)
+	}
+}
+
+func TestMaxConcurrentGraphRequests(t *testing.T) {
+	initTestConfig(false)
+	config.MaxConcurrentGraphRequests = 1
+
+	started := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	send := func(ctx context.Context) error {
+		_, err := sendMailGraphAPI(ctx, "tok", "user@example.com", "user@example.com", []string{"to@example.com"}, &parsedMessage{subject: "s", body: "b"})
+		return err
+	}
+
+	first := make(chan error, 1)
+	go func() { first <- send(context.Background()) }()
+	<-started // first send holds the only slot
+
+	// Second send waits for the slot and gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := send(ctx); err == nil || !strings.Contains(err.Error(), "waiting for Graph request slot") {
+		t.Errorf("expected second send to wait for a slot, got: %v", err)
+	}
+
+	// Once the first send completes, the slot is free again
+	second := make(chan error, 1)
+	go func() { second <- send(context.Background()) }()
+	close(unblock)
+	if err := <-first; err != nil {
+		t.Fatalf("first send failed: %v", err)
+	}
+	if err := <-second; err != nil {
+		t.Errorf("expected send to proceed after the slot was freed, got: %v", err)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	initTestConfig(false)
+
+	var graphUA, tokenUA string
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		graphUA = r.UserAgent()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenUA = r.UserAgent()
+		w.Write([]byte(`{"access_token":"tok","expires_in":3600}`))
+	}))
+	defer idp.Close()
+	prevClient := authHTTPClient
+	authHTTPClient = idp.Client()
+	defer func() { authHTTPClient = prevClient }()
+	config.OAuth2Config.TokenEndpoint = idp.URL + "/{tenant}/token"
+
+	getOAuth2TokenWithExpiry(context.Background(), "user@example.com", "pass")
+	sendMailGraphAPI(context.Background(), "tok", "user@example.com", "user@example.com", []string{"to@example.com"}, &parsedMessage{})
+	if want := "azureSMTPwithOAuth/" + version; graphUA != want || tokenUA != want {
+		t.Errorf("expected User-Agent %q, got graph %q, token %q", want, graphUA, tokenUA)
+	}
+
+	config.UserAgent = "relay-tenantA/2"
+	sendMailGraphAPI(context.Background(), "tok", "user@example.com", "user@example.com", []string{"to@example.com"}, &parsedMessage{})
+	if graphUA != "relay-tenantA/2" {
+		t.Errorf("expected configured User-Agent, got %q", graphUA)
+	}
+}
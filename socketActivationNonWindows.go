@@ -0,0 +1,43 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd (SD_LISTEN_FDS_START)
+const listenFdsStart = 3
+
+// systemdListener returns the socket passed by systemd socket activation, or nil
+// when the process was not socket-activated (LISTEN_PID/LISTEN_FDS unset or meant
+// for another process).
+func systemdListener() (net.Listener, error) {
+	listener, err := inheritedListener(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), listenFdsStart)
+	if listener != nil || err != nil {
+		// Don't leak the activation environment to child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}
+	return listener, err
+}
+
+// inheritedListener wraps fd as a listener when listenPID names this process and
+// listenFDs is at least 1. Only the first socket is used.
+func inheritedListener(listenPID, listenFDs string, fd uintptr) (net.Listener, error) {
+	pid, err := strconv.Atoi(listenPID)
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	if n, err := strconv.Atoi(listenFDs); err != nil || n < 1 {
+		return nil, nil
+	}
+	syscall.CloseOnExec(int(fd))
+	f := os.NewFile(fd, "systemd-socket")
+	defer f.Close() // net.FileListener dups the descriptor
+	return net.FileListener(f)
+}
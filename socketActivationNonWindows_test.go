@@ -0,0 +1,55 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestInheritedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	// A raw descriptor no *os.File owns, as systemd would pass it. inheritedListener
+	// takes ownership when it wraps it, so the test closes it only until then.
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Dup failed: %v", err)
+	}
+	owned := true
+	defer func() {
+		if owned {
+			syscall.Close(fd)
+		}
+	}()
+	pid := strconv.Itoa(os.Getpid())
+
+	// Not activated: PID of another process or no fds
+	if l, err := inheritedListener("1", "1", uintptr(fd)); l != nil || err != nil {
+		t.Errorf("expected no listener for foreign LISTEN_PID, got %v, %v", l, err)
+	}
+	if l, err := inheritedListener(pid, "0", uintptr(fd)); l != nil || err != nil {
+		t.Errorf("expected no listener for LISTEN_FDS=0, got %v, %v", l, err)
+	}
+
+	inherited, err := inheritedListener(pid, "1", uintptr(fd))
+	owned = false
+	if err != nil || inherited == nil {
+		t.Fatalf("expected inherited listener, got %v, %v", inherited, err)
+	}
+	defer inherited.Close()
+	if inherited.Addr().String() != ln.Addr().String() {
+		t.Errorf("expected address %s, got %s", ln.Addr(), inherited.Addr())
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// systemdListener always returns nil: socket activation is a systemd feature
+func systemdListener() (net.Listener, error) {
+	return nil, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// tlsServerConfig is used by STARTTLS; nil when tls_cert_file is not configured
+	tlsServerConfig *tls.Config
+	// tlsCerts holds the current certificate, reloaded on file change or SIGHUP
+	tlsCerts *certReloader
+)
+
+// setupTLS loads tls_cert_file/tls_key_file and enables STARTTLS. With
+// tls_client_ca_file, clients are asked for a certificate signed by that CA.
+func setupTLS() error {
+	if config.TLSCertFile == "" {
+		return nil
+	}
+	reloader, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	tlsCerts = reloader
+	tlsServerConfig = &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if config.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(config.TLSClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read tls_client_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in tls_client_ca_file %s", config.TLSClientCAFile)
+		}
+		tlsServerConfig.ClientCAs = pool
+		tlsServerConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.RequireClientCert {
+			tlsServerConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return nil
+}
+
+// clientCertIdentities returns the identities of a verified client certificate
+// selected by client_cert_identity: the CN, or the DNS and e-mail SANs
+func clientCertIdentities(cert *x509.Certificate) []string {
+	if config.ClientCertIdentity == "san" {
+		return append(slices.Clone(cert.DNSNames), cert.EmailAddresses...)
+	}
+	if cert.Subject.CommonName == "" {
+		return nil
+	}
+	return []string{cert.Subject.CommonName}
+}
+
+// clientCertUser maps the verified client certificate of a TLS session to the
+// user_map entry whose client_cert matches (case-insensitively). ok is false when
+// the client sent no certificate or its identity is not mapped.
+func clientCertUser(state tls.ConnectionState) (username, password string, ok bool) {
+	if len(state.VerifiedChains) == 0 {
+		return "", "", false
+	}
+	identities := clientCertIdentities(state.PeerCertificates[0])
+	for user, settings := range config.UserMap {
+		if settings.ClientCert == "" {
+			continue
+		}
+		for _, id := range identities {
+			if strings.EqualFold(id, settings.ClientCert) {
+				return user, settings.Password, true
+			}
+		}
+	}
+	logger.Warn("Client certificate not mapped to a user", "identities", identities, "client_cert_identity", config.ClientCertIdentity)
+	return "", "", false
+}
+
+// certReloader serves a certificate pair and swaps it atomically when the files
+// change, so renewals (e.g. Let's Encrypt) apply to new connections without a
+// restart. Established connections keep the certificate they negotiated.
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+
+	mu      sync.Mutex // serializes reloads
+	modTime time.Time  // newest mtime of the loaded files
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate pair from disk. On failure the previous
+// certificate stays in use.
+func (r *certReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloadLocked()
+}
+
+func (r *certReloader) reloadLocked() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.cert.Store(&cert)
+	r.modTime = modTime
+	return nil
+}
+
+// filesModTime returns the newest modification time of the certificate and key file
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var newest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat TLS file: %w", err)
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. It reloads the pair first
+// when either file was modified since the last load.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if modTime, err := r.filesModTime(); err == nil {
+		r.mu.Lock()
+		if !modTime.Equal(r.modTime) {
+			if err := r.reloadLocked(); err != nil {
+				// Don't retry on every handshake; the next change of the files triggers a new attempt
+				r.modTime = modTime
+				logger.Error("TLS certificate reload failed, keeping previous certificate", "error", err)
+			} else {
+				logger.Info("TLS certificate reloaded", "cert_file", r.certFile)
+			}
+		}
+		r.mu.Unlock()
+	}
+	return r.cert.Load(), nil
+}
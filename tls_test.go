@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for commonName to certFile/keyFile
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling key: %v", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// initTestTLS enables STARTTLS with a fresh self-signed certificate
+func initTestTLS(t *testing.T, commonName string) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, commonName)
+	config.TLSCertFile, config.TLSKeyFile = certFile, keyFile
+	if err := setupTLS(); err != nil {
+		t.Fatalf("setupTLS failed: %v", err)
+	}
+	t.Cleanup(func() { tlsServerConfig, tlsCerts = nil, nil })
+	return certFile, keyFile
+}
+
+// startTLS runs EHLO + STARTTLS on a fresh connection and returns the TLS client side
+func startTLS(t *testing.T) (*tls.Conn, *bufio.Reader) {
+	t.Helper()
+	return startTLSWithConfig(t, &tls.Config{InsecureSkipVerify: true})
+}
+
+// startTLSWithConfig is startTLS with a custom client configuration (e.g. a client certificate)
+func startTLSWithConfig(t *testing.T, clientConfig *tls.Config) (*tls.Conn, *bufio.Reader) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(startHandler(client, server, handleSMTPConnection))
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	client.Write([]byte("EHLO test\r\n"))
+	if lines := readMultiline(reader); !slices.Contains(lines, "250-STARTTLS") {
+		t.Fatalf("expected STARTTLS in EHLO, got %v", lines)
+	}
+	client.Write([]byte("STARTTLS\r\n"))
+	if resp := readResponse(reader); resp != "220 2.0.0 Ready to start TLS" {
+		t.Fatalf("expected 220 for STARTTLS, got: %s", resp)
+	}
+	tlsConn := tls.Client(client, clientConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	return tlsConn, bufio.NewReader(tlsConn)
+}
+
+func TestSTARTTLS(t *testing.T) {
+	initTestConfig(false)
+	initTestTLS(t, "relay.example.com")
+
+	tlsConn, reader := startTLS(t)
+	defer tlsConn.Close()
+
+	// After the upgrade the session starts over; STARTTLS is no longer offered
+	tlsConn.Write([]byte("EHLO test\r\n"))
+	lines := readMultiline(reader)
+	if slices.Contains(lines, "250-STARTTLS") {
+		t.Errorf("STARTTLS must not be offered inside TLS, got %v", lines)
+	}
+	if lines[len(lines)-1] != "250 AUTH LOGIN PLAIN" {
+		t.Errorf("expected AUTH after STARTTLS, got %v", lines)
+	}
+	tlsConn.Write([]byte("STARTTLS\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "502") {
+		t.Errorf("expected 502 for STARTTLS inside TLS, got: %s", resp)
+	}
+}
+
+func TestSTARTTLS_DiscardsSessionState(t *testing.T) {
+	initTestConfig(true)
+	initTestTLS(t, "relay.example.com")
+	config.MaxMessagesPerConnection = 1
+	TokenCache.Store(config.FallbackSMTPuser, cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete(config.FallbackSMTPuser)
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		return "", nil
+	}
+	defer func() { sendMessage = prevSend }()
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	send := func(w io.Writer, r *bufio.Reader, line string) string {
+		go w.Write([]byte(line + "\r\n"))
+		lines := readMultiline(r)
+		return lines[len(lines)-1]
+	}
+
+	// A message in cleartext uses up max_messages_per_connection
+	send(client, reader, "EHLO test")
+	send(client, reader, "MAIL FROM:<sender@example.com>")
+	send(client, reader, "RCPT TO:<to@example.com>")
+	send(client, reader, "DATA")
+	if resp := send(client, reader, "Subject: before TLS\r\n\r\nbody\r\n."); !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected 250 for the cleartext message, got: %s", resp)
+	}
+	if resp := send(client, reader, "STARTTLS"); resp != "220 2.0.0 Ready to start TLS" {
+		t.Fatalf("expected 220 for STARTTLS, got: %s", resp)
+	}
+	tlsConn := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	tlsReader := bufio.NewReader(tlsConn)
+
+	// RFC 3207 §4.2: the TLS session starts over, the message count included
+	send(tlsConn, tlsReader, "EHLO test")
+	if resp := send(tlsConn, tlsReader, "MAIL FROM:<sender@example.com>"); resp != "250 2.1.0 Ok" {
+		t.Errorf("expected a fresh message count after STARTTLS, got: %s", resp)
+	}
+}
+
+func TestSTARTTLS_NotConfigured(t *testing.T) {
+	initTestConfig(false)
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	client.Write([]byte("STARTTLS\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "502") {
+		t.Errorf("expected 502 without a certificate, got: %s", resp)
+	}
+}
+
+func TestCertReloader_FileChange(t *testing.T) {
+	initTestConfig(false)
+	certFile, keyFile := initTestTLS(t, "old.example.com")
+
+	handshakeCN := func() string {
+		tlsConn, _ := startTLS(t)
+		defer tlsConn.Close()
+		return tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if cn := handshakeCN(); cn != "old.example.com" {
+		t.Fatalf("expected initial certificate, got %s", cn)
+	}
+
+	// Renewal: new files with a newer mtime are served to new handshakes
+	writeTestCert(t, certFile, keyFile, "new.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if cn := handshakeCN(); cn != "new.example.com" {
+		t.Errorf("expected reloaded certificate, got %s", cn)
+	}
+
+	// A broken renewal keeps the previous certificate
+	os.WriteFile(certFile, []byte("not a certificate"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if cn := handshakeCN(); cn != "new.example.com" {
+		t.Errorf("expected previous certificate after failed reload, got %s", cn)
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	initTestConfig(false)
+	dir := t.TempDir()
+	clientCert, clientKey := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writeTestCert(t, clientCert, clientKey, "printer01.example.com")
+	config.TLSClientCAFile = clientCert // self-signed: the certificate is its own CA
+	config.UserMap = map[string]tUserSettings{
+		"printer@example.com": {ClientCert: "PRINTER01.example.com", Password: "printer-pass"},
+	}
+	initTestTLS(t, "relay.example.com")
+	TokenCache.Store("printer@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("printer@example.com")
+
+	var gotPath string
+	graph := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graph.Close()
+	prevURL := graphBaseURL
+	graphBaseURL = graph.URL
+	defer func() { graphBaseURL = prevURL }()
+
+	pair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn, reader := startTLSWithConfig(t, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{pair}})
+	defer tlsConn.Close()
+
+	// No AUTH: the certificate CN maps to printer@example.com
+	tlsConn.Write([]byte("EHLO printer\r\n"))
+	readMultiline(reader)
+	tlsConn.Write([]byte("MAIL FROM:<printer@example.com>\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected MAIL FROM accepted without AUTH, got: %s", resp)
+	}
+	tlsConn.Write([]byte("RCPT TO:<to@example.com>\r\n"))
+	readResponse(reader)
+	tlsConn.Write([]byte("DATA\r\n"))
+	readResponse(reader) // 354
+	go tlsConn.Write([]byte("Subject: cert\r\n\r\nbody\r\n.\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected message sent, got: %s", resp)
+	}
+	if gotPath != "/users/printer@example.com/sendMail" {
+		t.Errorf("expected send as the mapped mailbox, got path %q", gotPath)
+	}
+}
+
+func TestClientCertAuth_NotMapped(t *testing.T) {
+	initTestConfig(false)
+	dir := t.TempDir()
+	clientCert, clientKey := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writeTestCert(t, clientCert, clientKey, "unknown.example.com")
+	config.TLSClientCAFile = clientCert
+	config.UserMap = map[string]tUserSettings{
+		"printer@example.com": {ClientCert: "printer01.example.com", Password: "printer-pass"},
+	}
+	initTestTLS(t, "relay.example.com")
+
+	pair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn, reader := startTLSWithConfig(t, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{pair}})
+	defer tlsConn.Close()
+	tlsConn.Write([]byte("MAIL FROM:<printer@example.com>\r\n"))
+	if resp := readResponse(reader); !strings.HasPrefix(resp, "530") {
+		t.Errorf("expected 530 for an unmapped certificate, got: %s", resp)
+	}
+}
+
+func TestClientCertAuth_Required(t *testing.T) {
+	initTestConfig(false)
+	dir := t.TempDir()
+	clientCert, clientKey := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writeTestCert(t, clientCert, clientKey, "printer01.example.com")
+	config.TLSClientCAFile = clientCert
+	config.RequireClientCert = true
+	initTestTLS(t, "relay.example.com")
+
+	client, server := net.Pipe()
+	defer startHandler(client, server, handleSMTPConnection)()
+
+	reader := bufio.NewReader(client)
+	readResponse(reader) // 220 greeting
+	client.Write([]byte("STARTTLS\r\n"))
+	readResponse(reader) // 220 Ready to start TLS
+	tlsConn := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	tlsConn.Handshake()
+	// TLS 1.3 reports the missing certificate on the first read after the handshake
+	tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := tlsConn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the handshake to fail without a client certificate")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates spans for the send pipeline. Until setupTracing installs a
+// provider, the global provider is a no-op, so spans cost next to nothing.
+var tracer = otel.Tracer("azureSMTPwithOAuth")
+
+// setupTracing installs an OTLP/HTTP exporter when otel_endpoint is configured.
+// The returned function flushes and stops the exporter; it is safe to call when
+// tracing is disabled.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if config.OtelEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	endpoint, err := url.Parse(config.OtelEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Path == "" || endpoint.Path == "/" {
+		endpoint.Path = "/v1/traces" // OTLP/HTTP default traces path
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint.String()))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "azureSMTPwithOAuth"),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// injectTraceContext propagates the span context in ctx to an outgoing HTTP request
+func injectTraceContext(ctx context.Context, req *http.Request) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// endSpan records err (if any) on the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
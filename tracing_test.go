@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing_TokenSpanIsChildOfMessageSpan(t *testing.T) {
+	initTestConfig(false)
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	TokenCache.Store("traced@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("traced@example.com")
+
+	ctx, root := tp.Tracer("test").Start(context.Background(), "smtp.message")
+	if _, err := getCachedOAuth2Token(ctx, "traced@example.com", "pass"); err != nil {
+		t.Fatalf("getCachedOAuth2Token failed: %v", err)
+	}
+	root.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	token := spans[0]
+	if token.Name() != "oauth2.token" {
+		t.Fatalf("expected first ended span 'oauth2.token', got '%s'", token.Name())
+	}
+	if token.Parent().SpanID() != root.SpanContext().SpanID() {
+		t.Error("expected token span to be a child of the message span")
+	}
+	found := false
+	for _, a := range token.Attributes() {
+		if a.Key == attribute.Key("oauth2.cache_hit") && a.Value.AsBool() {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected oauth2.cache_hit=true attribute on token span")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxPendingWebhooks bounds concurrent webhook deliveries; further events are dropped
+const maxPendingWebhooks = 20
+
+var (
+	// webhookHTTPClient is used for delivery notifications (webhook_url)
+	webhookHTTPClient = &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConns:        10,
+			MaxIdleConnsPerHost: 5,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	// webhookSem limits the number of in-flight webhook goroutines
+	webhookSem = make(chan struct{}, maxPendingWebhooks)
+)
+
+// deliveryEvent is the JSON document POSTed to webhook_url after each send attempt
+type deliveryEvent struct {
+	Timestamp      time.Time `json:"timestamp"`
+	User           string    `json:"user"`
+	From           string    `json:"from"`
+	Recipients     []string  `json:"recipients"`
+	Subject        string    `json:"subject"`
+	Status         string    `json:"status"` // "delivered", "draft_created" or "failed"
+	GraphMessageID string    `json:"graph_message_id,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// newDeliveryEvent describes the outcome of a send attempt (sendErr nil = delivered)
+func newDeliveryEvent(user, from string, rcptTo []string, pm *parsedMessage, sendErr error) deliveryEvent {
+	event := deliveryEvent{
+		Timestamp:  time.Now().UTC(),
+		User:       user,
+		From:       from,
+		Recipients: rcptTo,
+		Subject:    pm.subject,
+		Status:     "delivered",
+	}
+	if sendErr != nil {
+		event.Status = "failed"
+		event.Error = sendErr.Error()
+	}
+	return event
+}
+
+// notifyWebhook posts the event to webhook_url in the background. It never blocks
+// the caller: when maxPendingWebhooks deliveries are already in flight the event
+// is dropped with a warning.
+func notifyWebhook(event deliveryEvent) {
+	webhookURL := config.WebhookURL
+	if webhookURL == "" {
+		return
+	}
+	select {
+	case webhookSem <- struct{}{}:
+	default:
+		logger.Warn("Webhook notification dropped: too many pending", "max", maxPendingWebhooks, "status", event.Status)
+		return
+	}
+	go func() {
+		defer func() { <-webhookSem }()
+		if err := postWebhook(webhookURL, event); err != nil {
+			logger.Warn("Webhook notification failed", "error", err, "status", event.Status)
+		}
+	}()
+}
+
+// postWebhook delivers a single event with a short retry
+func postWebhook(webhookURL string, event deliveryEvent) error {
+	jsonBody, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(jsonBody))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", userAgent())
+
+	resp, err := doWithRetry(ctx, webhookHTTPClient, request, jsonBody, RetryConfig{
+		MaxAttempts:     3,
+		InitialBackoff:  500 * time.Millisecond,
+		MaxBackoff:      2 * time.Second,
+		RetryableStatus: []int{429, 500, 502, 503, 504},
+		Target:          "webhook call",
+	})
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return fmt.Errorf("webhook call failed after retries: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook error (status %d)", resp.StatusCode)
+	}
+	return nil
+}
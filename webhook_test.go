@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotifyWebhook_PostsDeliveryEvent(t *testing.T) {
+	initTestConfig(false)
+	received := make(chan deliveryEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event deliveryEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("invalid webhook body: %v", err)
+		}
+		received <- event
+	}))
+	defer srv.Close()
+	config.WebhookURL = srv.URL
+
+	pm := &parsedMessage{subject: "Report"}
+	notifyWebhook(newDeliveryEvent("user@example.com", "from@example.com", []string{"to@example.com"}, pm, errors.New("Graph API error (status 400)")))
+
+	select {
+	case event := <-received:
+		if event.Status != "failed" || event.Error != "Graph API error (status 400)" {
+			t.Errorf("unexpected status/error: %q / %q", event.Status, event.Error)
+		}
+		if event.User != "user@example.com" || event.From != "from@example.com" || event.Subject != "Report" {
+			t.Errorf("unexpected event fields: %+v", event)
+		}
+		if len(event.Recipients) != 1 || event.Recipients[0] != "to@example.com" {
+			t.Errorf("unexpected recipients: %v", event.Recipients)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+}
+
+func TestNotifyWebhook_DropsWhenSaturated(t *testing.T) {
+	initTestConfig(false)
+	config.WebhookURL = "http://127.0.0.1:1"
+
+	// Fill every slot; notifyWebhook must return immediately instead of blocking
+	for i := 0; i < maxPendingWebhooks; i++ {
+		webhookSem <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < maxPendingWebhooks; i++ {
+			<-webhookSem
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		notifyWebhook(newDeliveryEvent("u@example.com", "f@example.com", nil, &parsedMessage{}, nil))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("notifyWebhook blocked while all slots were busy")
+	}
+}
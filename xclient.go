@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// xclientConn is a connection whose client address was passed by a trusted proxy
+// with XCLIENT. RemoteAddr reports that address, so logs, GeoIP, X-Received and
+// trusted_mta_cidrs see the real client instead of the proxy.
+type xclientConn struct {
+	net.Conn
+	client net.Addr
+}
+
+func (c *xclientConn) RemoteAddr() net.Addr {
+	return c.client
+}
+
+// withClientAddr makes conn report addr as its remote address, also below TLS
+// when XCLIENT follows STARTTLS, and returns the connection to use from now on
+func withClientAddr(conn net.Conn, addr net.Addr) net.Conn {
+	inner := conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		inner = tlsConn.NetConn()
+	}
+	if x, ok := inner.(*xclientConn); ok {
+		x.client = addr
+		return conn
+	}
+	return &xclientConn{Conn: conn, client: addr}
+}
+
+// peerAddr returns the address of the host actually connected, the proxy when
+// XCLIENT changed the reported client address
+func peerAddr(conn net.Conn) net.Addr {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if x, ok := conn.(*xclientConn); ok {
+		return x.Conn.RemoteAddr()
+	}
+	return conn.RemoteAddr()
+}
+
+// isTrustedProxy reports whether the connected host is within trusted_proxies and
+// may use XCLIENT
+func isTrustedProxy(conn net.Conn) bool {
+	return addrInCIDRs(peerAddr(conn), config.TrustedProxies)
+}
+
+// parseXClient returns the client address of an XCLIENT command (Postfix XCLIENT
+// protocol), e.g. "XCLIENT ADDR=192.0.2.10 PORT=51234 NAME=host.example.com".
+// ADDR (IPv6 as IPV6:2001:db8::1) and PORT change current; the other attributes
+// are accepted and ignored. [UNAVAILABLE] and [TEMPUNAVAIL] leave a value unchanged.
+// The result is nil when neither ADDR nor PORT carried a value.
+func parseXClient(line string, current net.Addr) (net.Addr, error) {
+	var addr netip.Addr
+	port := -1
+	for _, attr := range strings.Fields(line)[1:] {
+		name, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return nil, fmt.Errorf("attribute %q without value", attr)
+		}
+		value, err := decodeXtext(value)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", name, err)
+		}
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			continue
+		}
+		switch strings.ToUpper(name) {
+		case "ADDR":
+			if len(value) > 5 && strings.EqualFold(value[:5], "IPV6:") {
+				value = value[5:]
+			}
+			if addr, err = netip.ParseAddr(value); err != nil {
+				return nil, fmt.Errorf("invalid ADDR %q", value)
+			}
+		case "PORT":
+			if port, err = strconv.Atoi(value); err != nil || port < 0 || port > 65535 {
+				return nil, fmt.Errorf("invalid PORT %q", value)
+			}
+		}
+	}
+	if !addr.IsValid() && port < 0 {
+		return nil, nil
+	}
+	client := &net.TCPAddr{}
+	if tcpAddr, ok := current.(*net.TCPAddr); ok {
+		client.IP, client.Port = tcpAddr.IP, tcpAddr.Port
+	}
+	if addr.IsValid() {
+		client.IP = net.IP(addr.Unmap().AsSlice())
+	}
+	if port >= 0 {
+		client.Port = port
+	}
+	return client, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// remoteConn reports a fixed remote address, standing in for a TCP peer
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestParseXClient(t *testing.T) {
+	current := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4000}
+	tests := []struct {
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{"XCLIENT ADDR=198.51.100.7 PORT=51234 NAME=client.example.com", "198.51.100.7:51234", false},
+		{"xclient addr=IPV6:2001:db8::7", "[2001:db8::7]:4000", false},
+		{"XCLIENT ADDR=198.51.100.7 PORT=[UNAVAILABLE]", "198.51.100.7:4000", false},
+		{"XCLIENT NAME=[UNAVAILABLE] HELO=client", "", false},
+		{"XCLIENT ADDR=not-an-ip", "", true},
+		{"XCLIENT PORT=70000", "", true},
+		{"XCLIENT ADDR", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseXClient(tt.line, current)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseXClient(%q) error = %v, want error %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		gotStr := ""
+		if got != nil {
+			gotStr = got.String()
+		}
+		if gotStr != tt.want {
+			t.Errorf("parseXClient(%q) = %q, want %q", tt.line, gotStr, tt.want)
+		}
+	}
+}
+
+func TestXClient(t *testing.T) {
+	initTestConfig(false)
+	config.TrustedProxies = []string{"192.0.2.0/24"}
+	TokenCache.Store("xclient@example.com", cachedToken{token: "tok", expiresAt: time.Now().Add(time.Hour)})
+	defer TokenCache.Delete("xclient@example.com")
+	prevSend := sendMessage
+	sendMessage = func(ctx context.Context, token, sender, mailFrom string, rcptTo []string, pm *parsedMessage) (string, error) {
+		return "", nil
+	}
+	defer func() { sendMessage = prevSend }()
+
+	// session connects from proxy, sends XCLIENT ADDR=198.51.100.7 and a message,
+	// and returns the EHLO capabilities, the XCLIENT reply and the send log line
+	session := func(proxy string) (caps []string, xclientReply, sendLog string) {
+		var logs bytes.Buffer
+		logger = slog.New(slog.NewTextHandler(&logs, nil))
+		client, server := net.Pipe()
+		stop := startHandler(client, remoteConn{server, &net.TCPAddr{IP: net.ParseIP(proxy), Port: 4000}}, handleSMTPConnection)
+		defer stop()
+		reader := bufio.NewReader(client)
+		readResponse(reader) // 220 greeting
+		send := func(line string) []string {
+			go client.Write([]byte(line + "\r\n"))
+			return readMultiline(reader)
+		}
+		caps = send("EHLO proxy.example.com")
+		xclientReply = send("XCLIENT ADDR=198.51.100.7 PORT=51234")[0]
+		send("EHLO proxy.example.com")
+		send("AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00xclient@example.com\x00pass")))
+		send("MAIL FROM:<xclient@example.com>")
+		send("RCPT TO:<to@example.com>")
+		send("DATA")
+		send("Subject: xclient\r\n\r\nbody\r\n.")
+		send("QUIT")
+		stop() // the session logs until it returns
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, "E-mail sent successfully") {
+				sendLog = line
+			}
+		}
+		return caps, xclientReply, sendLog
+	}
+
+	caps, reply, sendLog := session("192.0.2.1")
+	if !slices.ContainsFunc(caps, func(c string) bool { return c[4:] == "XCLIENT ADDR PORT" }) {
+		t.Errorf("expected XCLIENT advertised to a trusted proxy, got %v", caps)
+	}
+	if reply != "220 SMTP Relay Ready" {
+		t.Errorf("expected the greeting after XCLIENT, got %q", reply)
+	}
+	if !strings.Contains(sendLog, "remote=198.51.100.7:51234") {
+		t.Errorf("expected the XCLIENT address in the send log, got: %s", sendLog)
+	}
+
+	caps, reply, sendLog = session("203.0.113.1")
+	if slices.ContainsFunc(caps, func(c string) bool { return strings.Contains(c, "XCLIENT") }) {
+		t.Errorf("expected XCLIENT not advertised to an untrusted client, got %v", caps)
+	}
+	if reply != "550 5.7.0 Error: insufficient authorization" {
+		t.Errorf("expected XCLIENT refused from an untrusted client, got %q", reply)
+	}
+	if !strings.Contains(sendLog, "remote=203.0.113.1:4000") {
+		t.Errorf("expected the connection address in the send log, got: %s", sendLog)
+	}
+}